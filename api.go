@@ -15,14 +15,21 @@
 package apidApigeeSync
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/apid/apid-core"
+	"github.com/apigee-labs/transicator/common"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const tokenEndpoint = "/accesstoken"
+const (
+	tokenEndpoint      = "/accesstoken"
+	deadLetterEndpoint = "/apigeesync/deadletters"
+)
 
 const (
 	// long-polling timeout from http header
@@ -32,13 +39,53 @@ const (
 	parTag = "If-None-Match"
 )
 
+const (
+	headerAccept       = "Accept"
+	headerETag         = "ETag"
+	headerVary         = "Vary"
+	headerCacheControl = "Cache-Control"
+	headerExpires      = "Expires"
+	contentTypeJson    = "application/json"
+)
+
 type ApiManager struct {
 	tokenMan tokenManager
 	endpoint string
+	// nil for no access control
+	auth *tokenApiAuth
+	// nil to not offer the dead-letter API
+	dbMan              DbManager
+	deadLetterEndpoint string
+}
+
+// metadata of the current token, returned for "Accept: application/json"
+type tokenMetadata struct {
+	ExpiresAt    time.Time `json:"expiresAt"`
+	Scope        string    `json:"scope"`
+	ApiProdList  []string  `json:"apiProductList"`
+	RefreshCount int64     `json:"refreshCount"`
+	TokenType    string    `json:"tokenType"`
 }
 
 func (a *ApiManager) InitAPI(api apid.APIService) {
-	api.HandleFunc(a.endpoint, a.getAccessToken).Methods("GET")
+	api.HandleFunc(a.endpoint, a.protect(a.getAccessToken)).Methods("GET")
+	if a.dbMan == nil {
+		return
+	}
+	// reapplying changes is never open to any client
+	if a.auth == nil || !a.auth.isConfigured() {
+		log.Warnf("%s is disabled, it requires access control for %s to be configured", a.deadLetterEndpoint, tokenEndpoint)
+		return
+	}
+	api.HandleFunc(a.deadLetterEndpoint, a.protect(a.getDeadLetters)).Methods("GET")
+	api.HandleFunc(a.deadLetterEndpoint+"/{id}/reapply", a.protect(a.reapplyDeadLetter)).Methods("POST")
+}
+
+func (a *ApiManager) protect(handler http.HandlerFunc) http.HandlerFunc {
+	if a.auth != nil {
+		return a.auth.wrap(handler)
+	}
+	return handler
 }
 
 func (a *ApiManager) getAccessToken(w http.ResponseWriter, r *http.Request) {
@@ -55,19 +102,151 @@ func (a *ApiManager) getAccessToken(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("api timeout: %d", timeout)
 	ifNoneMatch := r.Header.Get(parTag)
 	log.Debugf("ifNoneMatch: %s", ifNoneMatch)
-	if a.tokenMan.getBearerToken() != ifNoneMatch {
-		w.Write([]byte(a.tokenMan.getBearerToken()))
+	isJson := strings.Contains(r.Header.Get(headerAccept), contentTypeJson)
+	// get the channel before comparing, so that a refresh in between is not missed
+	tokenReady := a.tokenMan.getTokenReadyChannel()
+	token := a.tokenMan.getToken()
+	// the raw token and the JSON metadata are different representations
+	w.Header().Set(headerVary, headerAccept)
+	if !tokenMatches(token, ifNoneMatch, isJson) {
+		writeToken(w, token, isJson)
 		return
 	}
 
 	select {
-	case <-a.tokenMan.getTokenReadyChannel():
-		w.Write([]byte(a.tokenMan.getBearerToken()))
+	case <-tokenReady:
+		writeToken(w, a.tokenMan.getToken(), isJson)
 	case <-time.After(time.Duration(timeout) * time.Second):
+		w.Header().Set(headerETag, tokenETag(token, isJson))
 		w.WriteHeader(http.StatusNotModified)
 	}
 }
 
+// lists the changes quarantined by the dead_letter failure policy
+func (a *ApiManager) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := a.dbMan.getDeadLetters()
+	if err != nil {
+		log.Errorf("unable to get dead letters: %v", err)
+		writeError(w, http.StatusInternalServerError, "unable to get dead letters")
+		return
+	}
+	writeJson(w, http.StatusOK, letters)
+}
+
+/*
+ * Applies a quarantined change again. On success it is removed from the dead letters,
+ * and emitted to the plugins as a change list of its own. The change list has no
+ * sequences: the change is older than the last applied change list.
+ */
+func (a *ApiManager) reapplyDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(apiService.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad id, must be a number")
+		return
+	}
+	dl, err := a.dbMan.reapplyDeadLetter(id)
+	switch {
+	case dl == nil && err == nil:
+		writeError(w, http.StatusNotFound, "no such dead letter")
+		return
+	case dl == nil:
+		log.Errorf("unable to reapply dead letter %d: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "unable to reapply dead letter")
+		return
+	case err != nil:
+		writeError(w, http.StatusConflict, "change failed again: "+err.Error())
+		return
+	}
+
+	log.Infof("Reapplied dead letter %d of change list %s", id, dl.Sequence)
+	cl := &common.ChangeList{
+		Changes: []common.Change{dl.Change},
+	}
+	select {
+	case <-time.After(httpTimeout):
+		log.Errorf("Timeout. Plugins failed to respond to reapplied dead letter %d.", id)
+	case <-eventService.Emit(ApigeeSyncEventSelector, cl):
+	}
+	writeJson(w, http.StatusOK, dl)
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("unable to marshal response: %v", err)
+		writeError(w, http.StatusInternalServerError, "unable to marshal response")
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJson)
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+func writeToken(w http.ResponseWriter, token *OauthToken, isJson bool) {
+	if token == nil {
+		writeError(w, http.StatusServiceUnavailable, "token not available")
+		return
+	}
+	w.Header().Set(headerETag, tokenETag(token, isJson))
+	refreshIn := token.refreshIn()
+	if refreshIn < 0 {
+		refreshIn = 0
+	}
+	w.Header().Set(headerCacheControl, "private, max-age="+strconv.Itoa(int(refreshIn.Seconds())))
+	w.Header().Set(headerExpires, time.Now().Add(refreshIn).UTC().Format(http.TimeFormat))
+	if !isJson {
+		w.Write([]byte(token.AccessToken))
+		return
+	}
+	bytes, err := json.Marshal(tokenMetadata{
+		ExpiresAt:    token.ExpiresAt,
+		Scope:        token.Scope,
+		ApiProdList:  token.ApiProdList,
+		RefreshCount: token.RefreshCount,
+		TokenType:    token.TokenType,
+	})
+	if err != nil {
+		log.Errorf("unable to marshal tokenMetadata: %v", err)
+		writeError(w, http.StatusInternalServerError, "unable to marshal token metadata")
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJson)
+	w.Write(bytes)
+}
+
+// opaque tag of the token, so that clients never have to send the token itself back, one per representation
+func tokenETag(token *OauthToken, isJson bool) string {
+	if token == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token.AccessToken))
+	if isJson {
+		return `"` + hex.EncodeToString(sum[:16]) + `-json"`
+	}
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+/*
+ * Whether If-None-Match matches the representation of the token: "*", or any tag of the list
+ * by weak comparison. The raw token is still accepted as tag for older clients.
+ */
+func tokenMatches(token *OauthToken, ifNoneMatch string, isJson bool) bool {
+	if token == nil || ifNoneMatch == "" {
+		return false
+	}
+	if ifNoneMatch == token.AccessToken {
+		return true
+	}
+	etag := tokenETag(token, isJson)
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func writeError(w http.ResponseWriter, status int, reason string) {
 	w.WriteHeader(status)
 	e := errorResponse{
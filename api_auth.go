@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	headerAuthorization = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+/*
+ * Access control for the local token API. Checks, in order:
+ * 1. the source address, against an allowlist of IPs/CIDRs
+ * 2. the client credential, a shared secret
+ * If nothing is configured, every request is allowed.
+ */
+type tokenApiAuth struct {
+	allowedNets []*net.IPNet
+	secret      string
+	// number of rejected requests
+	numRejected *int64
+}
+
+func createTokenApiAuth() (*tokenApiAuth, error) {
+	// apid serves its API over plain TCP, there is neither a Unix socket nor a client certificate to check
+	for _, key := range []string{configTokenApiUnixSocketOnly, configTokenApiClientCertRequired} {
+		if config.GetBool(key) {
+			return nil, fmt.Errorf("%s is not supported, apid serves %s over plain TCP", key, tokenEndpoint)
+		}
+	}
+	if len(getConfigList(configTokenApiClientNames)) > 0 {
+		return nil, fmt.Errorf("%s is not supported, apid serves %s over plain TCP", configTokenApiClientNames, tokenEndpoint)
+	}
+	numRejected := int64(0)
+	a := &tokenApiAuth{
+		secret:      config.GetString(configTokenApiSecret),
+		numRejected: &numRejected,
+	}
+	for _, addr := range getConfigList(configTokenApiAllowedAddrs) {
+		ipNet, err := parseAddrOrCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("illegal value for %s: %v", configTokenApiAllowedAddrs, err)
+		}
+		a.allowedNets = append(a.allowedNets, ipNet)
+	}
+	if !a.isConfigured() {
+		log.Warnf("%s is not protected. Any client able to reach apid can read the bearer token.", tokenEndpoint)
+	}
+	return a, nil
+}
+
+// false if every request is allowed
+func (a *tokenApiAuth) isConfigured() bool {
+	return len(a.allowedNets) > 0 || a.secret != ""
+}
+
+func parseAddrOrCIDR(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, ipNet, err := net.ParseCIDR(addr)
+		return ipNet, err
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", addr)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (a *tokenApiAuth) wrap(target http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status, reason := a.check(r); status != http.StatusOK {
+			atomic.AddInt64(a.numRejected, 1)
+			log.Warnf("Rejected %s request from %s: %s", r.URL.Path, r.RemoteAddr, reason)
+			writeError(w, status, reason)
+			return
+		}
+		target(w, r)
+	}
+}
+
+func (a *tokenApiAuth) check(r *http.Request) (int, string) {
+	if len(a.allowedNets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !a.isAllowedIP(ip) {
+			return http.StatusForbidden, "source address not allowed"
+		}
+	}
+
+	if a.secret != "" && !a.hasValidSecret(r) {
+		return http.StatusUnauthorized, "missing or invalid client credentials"
+	}
+	return http.StatusOK, ""
+}
+
+func (a *tokenApiAuth) isAllowedIP(ip net.IP) bool {
+	for _, ipNet := range a.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *tokenApiAuth) hasValidSecret(r *http.Request) bool {
+	auth := r.Header.Get(headerAuthorization)
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	secret := strings.TrimPrefix(auth, bearerPrefix)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(a.secret)) == 1
+}
+
+func (a *tokenApiAuth) getNumRejected() int64 {
+	return atomic.LoadInt64(a.numRejected)
+}
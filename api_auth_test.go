@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("token API access control", func() {
+
+	var testAuth *tokenApiAuth
+	var called bool
+	BeforeEach(func() {
+		var err error
+		testAuth, err = createTokenApiAuth()
+		Expect(err).Should(Succeed())
+		called = false
+	})
+
+	AfterEach(func() {
+		config.Set(configTokenApiAllowedAddrs, "")
+		config.Set(configTokenApiUnixSocketOnly, false)
+		config.Set(configTokenApiSecret, "")
+		config.Set(configTokenApiClientCertRequired, false)
+		config.Set(configTokenApiClientNames, "")
+	})
+
+	serve := func(r *http.Request) (int, errorResponse) {
+		w := httptest.NewRecorder()
+		testAuth.wrap(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})(w, r)
+		var e errorResponse
+		if w.Code != http.StatusOK {
+			Expect(json.Unmarshal(w.Body.Bytes(), &e)).Should(Succeed())
+		}
+		return w.Code, e
+	}
+
+	newRequest := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", tokenEndpoint, nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	It("should allow everything by default", func() {
+		code, _ := serve(newRequest("10.1.1.1:1234"))
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(called).Should(BeTrue())
+		Expect(testAuth.getNumRejected()).Should(BeZero())
+	})
+
+	It("should check source address against allowlist", func() {
+		config.Set(configTokenApiAllowedAddrs, "127.0.0.1, 10.0.0.0/8,::1")
+		var err error
+		testAuth, err = createTokenApiAuth()
+		Expect(err).Should(Succeed())
+
+		for _, addr := range []string{"127.0.0.1:1234", "10.20.30.40:80", "[::1]:8080"} {
+			code, _ := serve(newRequest(addr))
+			Expect(code).Should(Equal(http.StatusOK))
+		}
+
+		called = false
+		code, e := serve(newRequest("192.168.1.1:1234"))
+		Expect(code).Should(Equal(http.StatusForbidden))
+		Expect(e.ErrorCode).Should(Equal(http.StatusForbidden))
+		Expect(e.Reason).ShouldNot(BeEmpty())
+		Expect(called).Should(BeFalse())
+		Expect(testAuth.getNumRejected()).Should(Equal(int64(1)))
+	})
+
+	It("should reject invalid allowlist", func() {
+		config.Set(configTokenApiAllowedAddrs, "127.0.0.1,not_an_ip")
+		_, err := createTokenApiAuth()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should check shared secret", func() {
+		config.Set(configTokenApiSecret, "s3cr3t")
+		var err error
+		testAuth, err = createTokenApiAuth()
+		Expect(err).Should(Succeed())
+
+		code, e := serve(newRequest("127.0.0.1:1234"))
+		Expect(code).Should(Equal(http.StatusUnauthorized))
+		Expect(e.ErrorCode).Should(Equal(http.StatusUnauthorized))
+
+		r := newRequest("127.0.0.1:1234")
+		r.Header.Set(headerAuthorization, "Bearer wrong")
+		code, _ = serve(r)
+		Expect(code).Should(Equal(http.StatusUnauthorized))
+
+		r = newRequest("127.0.0.1:1234")
+		r.Header.Set(headerAuthorization, "Bearer s3cr3t")
+		code, _ = serve(r)
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(testAuth.getNumRejected()).Should(Equal(int64(2)))
+	})
+
+	It("should refuse settings apid's TCP listener can't check", func() {
+		for _, setting := range []struct {
+			key          string
+			value, unset interface{}
+		}{
+			{configTokenApiUnixSocketOnly, true, false},
+			{configTokenApiClientCertRequired, true, false},
+			{configTokenApiClientNames, []string{"gateway-1"}, ""},
+		} {
+			config.Set(setting.key, setting.value)
+			_, err := createTokenApiAuth()
+			Expect(err).Should(MatchError(ContainSubstring(setting.key)))
+			config.Set(setting.key, setting.unset)
+		}
+	})
+})
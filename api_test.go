@@ -15,8 +15,10 @@
 package apidApigeeSync
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/apid/apid-core"
+	"github.com/apigee-labs/transicator/common"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
@@ -50,7 +52,7 @@ var _ = Describe("API Manager", func() {
 		client = &http.Client{}
 	})
 
-	clientGet := func(path string, pars map[string][]string, header map[string][]string) (int, []byte) {
+	clientGetWithHeader := func(path string, pars map[string][]string, header map[string][]string) (int, []byte, http.Header) {
 		uri, err := url.Parse(apiTestUrl + path)
 		Expect(err).Should(Succeed())
 		query := url.Values(pars)
@@ -63,7 +65,12 @@ var _ = Describe("API Manager", func() {
 		defer res.Body.Close()
 		responseBody, err := ioutil.ReadAll(res.Body)
 		Expect(err).Should(Succeed())
-		return res.StatusCode, responseBody
+		return res.StatusCode, responseBody, res.Header
+	}
+
+	clientGet := func(path string, pars map[string][]string, header map[string][]string) (int, []byte) {
+		code, body, _ := clientGetWithHeader(path, pars, header)
+		return code, body
 	}
 
 	It("should get token without long-polling", func() {
@@ -122,4 +129,218 @@ var _ = Describe("API Manager", func() {
 		Expect(string(res)).Should(Equal(dummyTokenMan.getBearerToken()))
 	}, 3)
 
+	It("should get token metadata as json", func() {
+		dummyTokenMan.tokenInfo = OauthToken{
+			Scope:        "test_scope",
+			ApiProdList:  []string{"p1", "p2"},
+			RefreshCount: 2,
+			TokenType:    "BearerToken",
+			ExpiresAt:    time.Now().Add(10 * time.Minute),
+		}
+		code, res, header := clientGetWithHeader(testApiMan.endpoint, nil, map[string][]string{
+			headerAccept: {contentTypeJson},
+		})
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(header.Get("Content-Type")).Should(Equal(contentTypeJson))
+		Expect(string(res)).ShouldNot(ContainSubstring(dummyTokenMan.token))
+
+		var metadata tokenMetadata
+		Expect(json.Unmarshal(res, &metadata)).Should(Succeed())
+		Expect(metadata.Scope).Should(Equal("test_scope"))
+		Expect(metadata.ApiProdList).Should(Equal([]string{"p1", "p2"}))
+		Expect(metadata.RefreshCount).Should(Equal(int64(2)))
+		Expect(metadata.TokenType).Should(Equal("BearerToken"))
+		Expect(metadata.ExpiresAt).Should(BeTemporally("~", dummyTokenMan.tokenInfo.ExpiresAt, time.Second))
+
+		// 10 minutes to expire, refresh 1 minute ahead
+		Expect(header.Get(headerCacheControl)).Should(MatchRegexp(`^private, max-age=5(39|40)$`))
+		expires, err := http.ParseTime(header.Get(headerExpires))
+		Expect(err).Should(Succeed())
+		Expect(expires).Should(BeTemporally("~", time.Now().Add(9*time.Minute), 2*time.Second))
+	})
+
+	It("should use an opaque ETag", func() {
+		code, res, header := clientGetWithHeader(testApiMan.endpoint, nil, nil)
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(string(res)).Should(Equal(dummyTokenMan.token))
+		etag := header.Get(headerETag)
+		Expect(etag).ShouldNot(BeEmpty())
+		Expect(etag).ShouldNot(ContainSubstring(dummyTokenMan.token))
+		Expect(etag).Should(Equal(tokenETag(dummyTokenMan.getToken(), false)))
+		Expect(header.Get(headerVary)).Should(Equal(headerAccept))
+
+		code, _, header = clientGetWithHeader(testApiMan.endpoint, map[string][]string{
+			parBlock: {"1"},
+		}, map[string][]string{
+			parTag: {etag},
+		})
+		Expect(code).Should(Equal(http.StatusNotModified))
+		Expect(header.Get(headerETag)).Should(Equal(etag))
+		Expect(header.Get(headerVary)).Should(Equal(headerAccept))
+	}, 3)
+
+	It("should tag each representation of the token", func() {
+		code, _, header := clientGetWithHeader(testApiMan.endpoint, nil, map[string][]string{
+			headerAccept: {contentTypeJson},
+		})
+		Expect(code).Should(Equal(http.StatusOK))
+		jsonETag := header.Get(headerETag)
+		Expect(jsonETag).Should(Equal(tokenETag(dummyTokenMan.getToken(), true)))
+		Expect(jsonETag).ShouldNot(Equal(tokenETag(dummyTokenMan.getToken(), false)))
+
+		// the tag of the raw token doesn't match the JSON metadata
+		code, _, header = clientGetWithHeader(testApiMan.endpoint, map[string][]string{
+			parBlock: {"10"},
+		}, map[string][]string{
+			parTag:       {tokenETag(dummyTokenMan.getToken(), false)},
+			headerAccept: {contentTypeJson},
+		})
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(header.Get(headerETag)).Should(Equal(jsonETag))
+	}, 3)
+
+	It("should compare If-None-Match as a list of weak tags", func() {
+		token := dummyTokenMan.getToken()
+		etag := tokenETag(token, false)
+		Expect(tokenMatches(token, etag, false)).Should(BeTrue())
+		Expect(tokenMatches(token, "W/"+etag, false)).Should(BeTrue())
+		Expect(tokenMatches(token, `"other", W/"more" , `+etag, false)).Should(BeTrue())
+		Expect(tokenMatches(token, "*", true)).Should(BeTrue())
+		Expect(tokenMatches(token, token.AccessToken, true)).Should(BeTrue())
+		Expect(tokenMatches(token, `"other", W/"more"`, false)).Should(BeFalse())
+		Expect(tokenMatches(token, etag, true)).Should(BeFalse())
+		Expect(tokenMatches(token, "", false)).Should(BeFalse())
+	})
+
+	It("should return new metadata after long-polling", func() {
+		etag := tokenETag(dummyTokenMan.getToken(), true)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			dummyTokenMan.token = "new_token"
+			dummyTokenMan.tokenReadyChan <- true
+		}()
+		code, _, header := clientGetWithHeader(testApiMan.endpoint, map[string][]string{
+			parBlock: {"10"},
+		}, map[string][]string{
+			parTag:       {etag},
+			headerAccept: {contentTypeJson},
+		})
+		Expect(code).Should(Equal(http.StatusOK))
+		Expect(header.Get(headerETag)).ShouldNot(Equal(etag))
+		Expect(header.Get(headerETag)).Should(Equal(tokenETag(dummyTokenMan.getToken(), true)))
+	}, 3)
+
+	It("should release all long-polling clients on refresh", func() {
+		numClients := 5
+		oldToken := dummyTokenMan.getBearerToken()
+		results := make(chan string, numClients)
+		for i := 0; i < numClients; i++ {
+			go func() {
+				defer GinkgoRecover()
+				code, res := clientGet(testApiMan.endpoint, map[string][]string{
+					parBlock: {"10"},
+				}, map[string][]string{
+					parTag: {oldToken},
+				})
+				Expect(code).Should(Equal(http.StatusOK))
+				results <- string(res)
+			}()
+		}
+		// let all clients block before refreshing
+		time.Sleep(200 * time.Millisecond)
+		dummyTokenMan.token = "new_token"
+		close(dummyTokenMan.tokenReadyChan)
+		for i := 0; i < numClients; i++ {
+			Eventually(results, 2).Should(Receive(Equal("new_token")))
+		}
+	}, 3)
+
+	Context("dead letters", func() {
+		var dummyDbMan *dummyDbManager
+
+		BeforeEach(func() {
+			dummyDbMan = &dummyDbManager{
+				deadLetters: []deadLetter{
+					{Id: 1, Sequence: "1.1.1", Change: common.Change{Table: "kms_developer", Operation: common.Insert}, Error: "failed"},
+					{Id: 2, Sequence: "2.2.2", Change: common.Change{Table: "kms_app", Operation: common.Delete}, Error: "failed"},
+				},
+			}
+			testApiMan.dbMan = dummyDbMan
+			testApiMan.deadLetterEndpoint = deadLetterEndpoint + strconv.Itoa(testCount)
+			config.Set(configTokenApiAllowedAddrs, "127.0.0.1")
+			auth, err := createTokenApiAuth()
+			Expect(err).Should(Succeed())
+			testApiMan.auth = auth
+			testApiMan.InitAPI(apid.API())
+		})
+
+		AfterEach(func() {
+			config.Set(configTokenApiAllowedAddrs, "")
+		})
+
+		reapply := func(id string) (int, []byte) {
+			res, err := client.Post(apiTestUrl+testApiMan.deadLetterEndpoint+"/"+id+"/reapply", "", nil)
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).Should(Succeed())
+			return res.StatusCode, body
+		}
+
+		It("should list dead letters", func() {
+			code, res := clientGet(testApiMan.deadLetterEndpoint, nil, nil)
+			Expect(code).Should(Equal(http.StatusOK))
+			var letters []deadLetter
+			Expect(json.Unmarshal(res, &letters)).Should(Succeed())
+			Expect(letters).Should(Equal(dummyDbMan.deadLetters))
+		})
+
+		It("should reapply dead letters and emit them", func() {
+			emitted := make(chan *common.ChangeList, 1)
+			eventService.ListenFunc(ApigeeSyncEventSelector, func(e apid.Event) {
+				if cl, ok := e.(*common.ChangeList); ok {
+					emitted <- cl
+				}
+			})
+
+			code, res := reapply("2")
+			Expect(code).Should(Equal(http.StatusOK))
+			var dl deadLetter
+			Expect(json.Unmarshal(res, &dl)).Should(Succeed())
+			Expect(dl.Id).Should(Equal(int64(2)))
+			Expect(dummyDbMan.deadLetters).Should(HaveLen(1))
+
+			var cl *common.ChangeList
+			Eventually(emitted).Should(Receive(&cl))
+			// out of order with the live change lists
+			Expect(cl.FirstSequence).Should(BeEmpty())
+			Expect(cl.LastSequence).Should(BeEmpty())
+			Expect(cl.Changes).Should(Equal([]common.Change{{Table: "kms_app", Operation: common.Delete}}))
+		})
+
+		It("should fail to reapply", func() {
+			code, _ := reapply("3")
+			Expect(code).Should(Equal(http.StatusNotFound))
+			code, _ = reapply("x")
+			Expect(code).Should(Equal(http.StatusBadRequest))
+
+			dummyDbMan.processErr = fmt.Errorf("failed again")
+			code, res := reapply("1")
+			Expect(code).Should(Equal(http.StatusConflict))
+			Expect(string(res)).Should(ContainSubstring("failed again"))
+			Expect(dummyDbMan.deadLetters).Should(HaveLen(2))
+		})
+
+		It("should not offer dead letters without access control", func() {
+			testApiMan.auth = &tokenApiAuth{}
+			testApiMan.deadLetterEndpoint = deadLetterEndpoint + "_open" + strconv.Itoa(testCount)
+			testApiMan.InitAPI(apid.API())
+			code, _ := clientGet(testApiMan.deadLetterEndpoint, nil, nil)
+			Expect(code).Should(Equal(http.StatusNotFound))
+			code, _ = reapply("1")
+			Expect(code).Should(Equal(http.StatusNotFound))
+			Expect(dummyDbMan.deadLetters).Should(HaveLen(2))
+		})
+	})
+
 })
@@ -41,6 +41,7 @@ var _ = BeforeSuite(func() {
 	go apiService.Listen()
 	//dataService = apid.Data()
 	log = apid.Log().ForModule("apigeeSync")
+	initConfigDefaults()
 	var err error
 	tmpDir, err = ioutil.TempDir("", "apid_test")
 	Expect(err).NotTo(HaveOccurred())
@@ -85,4 +86,6 @@ func cleanCommonDb() {
 	Expect(err).Should(Succeed())
 	_, err = db.Exec(`DROP TABLE IF EXISTS APID;`)
 	Expect(err).Should(Succeed())
+	_, err = db.Exec(`DROP TABLE IF EXISTS APID_TOKEN;`)
+	Expect(err).Should(Succeed())
 }
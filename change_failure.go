@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"github.com/apigee-labs/transicator/common"
+	"time"
+)
+
+// what to do with a change list that keeps failing to apply
+const (
+	// retry forever
+	changeFailurePolicyRetry = "retry"
+	// quarantine the failing changes, apply the rest
+	changeFailurePolicyDeadLetter = "dead_letter"
+	// download a new snapshot
+	changeFailurePolicySnapshot = "snapshot"
+)
+
+// a change that failed to apply, kept in the dead-letter table
+type deadLetter struct {
+	Id            int64         `json:"id"`
+	Sequence      string        `json:"sequence"`
+	Change        common.Change `json:"change"`
+	Error         string        `json:"error"`
+	QuarantinedAt time.Time     `json:"quarantinedAt"`
+}
+
+/*
+ * Applies the change list to the DB, see processChangeList(), and returns the applied changes.
+ * A change list that fails is retried by pollWithBackoff(). Once the changes since the same
+ * sequence failed configChangeFailureRetries more times, the failing changes are quarantined
+ * or a new snapshot is requested, depending on configChangeFailurePolicy. Only the changes
+ * applied around the quarantined ones are returned. A change list changing the data scopes
+ * always gets a new snapshot.
+ */
+func (c *pollChangeManager) applyChangeList(scopes []string, cl *common.ChangeList) (*common.ChangeList, *ScopeChange, error) {
+	scopeChange, err := c.processChangeList(scopes, cl)
+	if err == nil {
+		c.failedSequence, c.failedAttempts = "", 0
+		return cl, scopeChange, nil
+	}
+	if _, ok := err.(changeServerError); ok {
+		return nil, nil, err
+	}
+	log.Errorf("Error in processChangeList: %v", err)
+
+	// the change list fetched since the same sequence may grow between retries
+	if c.lastSequence != c.failedSequence {
+		c.failedSequence, c.failedAttempts = c.lastSequence, 0
+	}
+	c.failedAttempts++
+	policy := config.GetString(configChangeFailurePolicy)
+	// the data scopes change along with the data, whatever the policy
+	if changesDataScopes(cl) {
+		policy = changeFailurePolicySnapshot
+	}
+	if policy == changeFailurePolicyRetry || c.failedAttempts <= config.GetInt(configChangeFailureRetries) {
+		return nil, nil, err
+	}
+	c.failedSequence, c.failedAttempts = "", 0
+
+	if policy == changeFailurePolicySnapshot {
+		return nil, nil, changeServerError{
+			Code: "Unable to apply changes; must get new snapshot",
+		}
+	}
+	applied, err := c.dbMan.processChangeListQuarantining(cl)
+	if err != nil {
+		log.Errorf("Error in processChangeListQuarantining: %v", err)
+		return nil, nil, err
+	}
+	log.Warnf("Quarantined %d of %d changes up to sequence %s",
+		len(cl.Changes)-len(applied.Changes), len(cl.Changes), cl.LastSequence)
+	return applied, nil, nil
+}
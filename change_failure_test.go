@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"fmt"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("change failure policy", func() {
+	var dummyDbMan *dummyDbManager
+	var dummySnapMan *dummySnapshotManager
+	var testChangeMan *pollChangeManager
+	applyErr := fmt.Errorf("UNIQUE constraint failed")
+
+	changeList := func(seq string) *common.ChangeList {
+		return &common.ChangeList{
+			LastSequence: seq,
+			Changes: []common.Change{{
+				Table:     "kms_developer",
+				Operation: common.Insert,
+			}},
+		}
+	}
+
+	apply := func(cl *common.ChangeList) error {
+		_, _, err := testChangeMan.applyChangeList(nil, cl)
+		return err
+	}
+
+	BeforeEach(func() {
+		dummyDbMan = &dummyDbManager{
+			lastSeqUpdated: make(chan string, 10),
+			processErr:     applyErr,
+		}
+		dummySnapMan = &dummySnapshotManager{
+			downloadCalledChan: make(chan bool, 1),
+		}
+		dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+		client := &http.Client{}
+		testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+		config.Set(configChangeFailureRetries, 2)
+	})
+
+	AfterEach(func() {
+		config.Set(configChangeFailurePolicy, changeFailurePolicyRetry)
+		config.Set(configChangeFailureRetries, 3)
+	})
+
+	It("should retry forever by default", func() {
+		for i := 0; i < 10; i++ {
+			Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		}
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+	})
+
+	It("should quarantine the failing changes after the retries", func() {
+		config.Set(configChangeFailurePolicy, changeFailurePolicyDeadLetter)
+		dummyDbMan.failingTable = "kms_developer"
+		cl := changeList("1.1.1")
+		cl.Changes = append(cl.Changes, common.Change{
+			Table:     "kms_app",
+			Operation: common.Insert,
+		})
+		Expect(apply(cl)).Should(Equal(applyErr))
+		Expect(apply(cl)).Should(Equal(applyErr))
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+		applied, _, err := testChangeMan.applyChangeList(nil, cl)
+		Expect(err).Should(Succeed())
+		Expect(dummyDbMan.quarantined).Should(Equal([]*common.ChangeList{cl}))
+		Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("1.1.1")))
+
+		// only the applied changes are emitted
+		Expect(applied.LastSequence).Should(Equal("1.1.1"))
+		Expect(applied.Changes).Should(Equal(cl.Changes[1:]))
+
+		// the changes since the next sequence have their own retries
+		testChangeMan.lastSequence = "1.1.1"
+		Expect(apply(changeList("2.2.2"))).Should(Equal(applyErr))
+		Expect(dummyDbMan.quarantined).Should(HaveLen(1))
+	})
+
+	It("should count failures per sequence the changes are fetched since", func() {
+		config.Set(configChangeFailurePolicy, changeFailurePolicyDeadLetter)
+		testChangeMan.lastSequence = "0.0.1"
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		testChangeMan.lastSequence = "0.0.2"
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+
+		// a success resets the count
+		dummyDbMan.processErr = nil
+		Expect(apply(changeList("1.1.1"))).Should(Succeed())
+		dummyDbMan.processErr = applyErr
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		Expect(apply(changeList("1.1.1"))).Should(Equal(applyErr))
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+
+		// more changes since the same sequence don't reset the count
+		Expect(apply(changeList("1.1.2"))).Should(Succeed())
+		Expect(dummyDbMan.quarantined).Should(HaveLen(1))
+	})
+
+	It("should get a new snapshot after the retries", func() {
+		config.Set(configChangeFailurePolicy, changeFailurePolicySnapshot)
+		cl := changeList("1.1.1")
+		Expect(apply(cl)).Should(Equal(applyErr))
+		Expect(apply(cl)).Should(Equal(applyErr))
+		err := apply(cl)
+		Expect(err).Should(BeAssignableToTypeOf(changeServerError{}))
+		testChangeMan.handleChangeServerError(err)
+		Expect(dummySnapMan.downloadCalledChan).Should(Receive(BeTrue()))
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/apigee-labs/transicator/common"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	changeFormatJson     = "json"
+	changeFormatProtobuf = "protobuf"
+)
+
+const (
+	jsonContentType     = "application/json"
+	protobufContentType = "application/transicator+protobuf"
+)
+
+/*
+ * Asks for change lists in the configured format. JSON stays acceptable,
+ * so change servers without protobuf support keep working.
+ * Setting Accept-Encoding disables the transparent gzip of http.Transport,
+ * decompression is done by changesBody().
+ */
+func setChangesContentHeaders(req *http.Request) {
+	if config.GetString(configChangeFormat) == changeFormatProtobuf {
+		req.Header.Set("Accept", protobufContentType+", "+jsonContentType+";q=0.5")
+	} else {
+		req.Header.Set("Accept", jsonContentType)
+	}
+	if config.GetBool(configChangeGzip) {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// the response body, decompressed according to Content-Encoding
+func changesBody(r *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return r.Body, nil
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		log.Errorf("Unable to decompress change list: %v", err)
+		return nil, err
+	}
+	return gz, nil
+}
+
+// decodes JSON or protobuf, depending on the Content-Type chosen by the server
+func decodeChangeList(r *http.Response) (*common.ChangeList, error) {
+	body, err := changesBody(r)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == protobufContentType {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			log.Errorf("Unable to read change list: %v", err)
+			return nil, err
+		}
+		cl, err := common.UnmarshalChangeListProto(b)
+		if err != nil {
+			log.Errorf("Protobuf Response Data not parsable: %v", err)
+			return nil, err
+		}
+		return cl, nil
+	}
+
+	cl := &common.ChangeList{}
+	if err = json.NewDecoder(body).Decode(cl); err != nil {
+		log.Errorf("JSON Response Data not parsable: %v", err)
+		return nil, err
+	}
+	return cl, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"compress/gzip"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+var _ = Describe("change list formats", func() {
+	var testChangeMan *pollChangeManager
+	var changeList common.ChangeList
+
+	BeforeEach(func() {
+		dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+		client := &http.Client{}
+		testChangeMan = createChangeManager(&dummyDbManager{}, &dummySnapshotManager{}, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+		changeList = common.ChangeList{
+			FirstSequence: "1.1.1",
+			LastSequence:  "2.2.2",
+			Changes: []common.Change{{
+				Table:     "kms_developer",
+				Operation: common.Insert,
+				NewRow: common.Row{
+					"id":   &common.ColumnVal{Value: "dev-1", Type: 1043},
+					"name": &common.ColumnVal{Value: "name", Type: 1043},
+				},
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		config.Set(configChangeFormat, changeFormatJson)
+		config.Set(configChangeGzip, true)
+	})
+
+	// requests changes from a server encoding with writeChangeList(), unless a handler is given
+	getChanges := func(handler http.HandlerFunc) (*common.ChangeList, *http.Request, error) {
+		var received *http.Request
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			if handler != nil {
+				handler(w, r)
+				return
+			}
+			(&MockServer{}).writeChangeList(w, r, &changeList)
+		}))
+		defer ts.Close()
+		uri, err := url.Parse(ts.URL + "/changes")
+		Expect(err).Should(Succeed())
+		r, err := testChangeMan.getChanges(nil, uri)
+		Expect(err).Should(Succeed())
+		cl, err := testChangeMan.parseChangeResp(r)
+		return cl, received, err
+	}
+
+	for _, testCase := range []struct {
+		format         string
+		gzip           bool
+		accept         string
+		acceptEncoding string
+	}{
+		{changeFormatJson, false, jsonContentType, "identity"},
+		{changeFormatJson, true, jsonContentType, "gzip"},
+		{changeFormatProtobuf, false, protobufContentType + ", " + jsonContentType + ";q=0.5", "identity"},
+		{changeFormatProtobuf, true, protobufContentType + ", " + jsonContentType + ";q=0.5", "gzip"},
+	} {
+		testCase := testCase
+		It("should negotiate and decode format "+testCase.format+" with gzip "+map[bool]string{true: "on", false: "off"}[testCase.gzip], func() {
+			config.Set(configChangeFormat, testCase.format)
+			config.Set(configChangeGzip, testCase.gzip)
+			cl, req, err := getChanges(nil)
+			Expect(err).Should(Succeed())
+			Expect(req.Header.Get("Accept")).Should(Equal(testCase.accept))
+			Expect(req.Header.Get("Accept-Encoding")).Should(Equal(testCase.acceptEncoding))
+			Expect(cl.FirstSequence).Should(Equal(changeList.FirstSequence))
+			Expect(cl.LastSequence).Should(Equal(changeList.LastSequence))
+			Expect(cl.Changes).Should(HaveLen(1))
+			Expect(cl.Changes[0].Table).Should(Equal("kms_developer"))
+			Expect(cl.Changes[0].Operation).Should(Equal(common.Insert))
+			Expect(cl.Changes[0].NewRow["id"].Value).Should(BeEquivalentTo("dev-1"))
+		})
+	}
+
+	It("should decode JSON if the server doesn't support protobuf", func() {
+		config.Set(configChangeFormat, changeFormatProtobuf)
+		cl, _, err := getChanges(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("Accept", jsonContentType)
+			(&MockServer{}).writeChangeList(w, r, &changeList)
+		})
+		Expect(err).Should(Succeed())
+		Expect(cl.LastSequence).Should(Equal(changeList.LastSequence))
+	})
+
+	It("should decode compressed errors", func() {
+		_, _, err := getChanges(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", jsonContentType)
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusBadRequest)
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(`{"code":"SNAPSHOT_TOO_OLD"}`))
+			gz.Close()
+		})
+		Expect(err).Should(Equal(changeServerError{Code: "SNAPSHOT_TOO_OLD"}))
+	})
+
+	It("should fail on corrupt data", func() {
+		for _, contentType := range []string{jsonContentType, protobufContentType} {
+			contentType := contentType
+			_, _, err := getChanges(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write([]byte("not gzip"))
+			})
+			Expect(err).ShouldNot(Succeed())
+		}
+	})
+})
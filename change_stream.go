@@ -0,0 +1,227 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apigee-labs/transicator/common"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	changeTransportPoll = "poll"
+	changeTransportSse  = "sse"
+)
+
+const (
+	// how long to long-poll before trying the stream again, after the server didn't offer it
+	changeStreamRetryInterval = 10 * time.Minute
+	sseContentType            = "text/event-stream"
+)
+
+var (
+	changeStreamUnsupportedError = fmt.Errorf("change stream is not supported by the change server")
+	changeStreamClosedError      = fmt.Errorf("change stream closed by the change server")
+)
+
+// a single Server-Sent Event
+type streamEvent struct {
+	id    string
+	event string
+	data  []byte
+}
+
+func (c *pollChangeManager) useChangeStream() bool {
+	return config.GetString(configChangeTransport) == changeTransportSse && time.Now().After(c.streamRetryAt)
+}
+
+/*
+ * Holds one connection to the change server and applies the change lists as they are pushed.
+ * The stream resumes from the last applied sequence, sent as `since` and as Last-Event-ID.
+ * Returns changeStreamUnsupportedError if the server doesn't offer a stream, the caller should
+ * then long-poll instead. Any other error ends the connection, pollWithBackoff() reconnects.
+ */
+func (c *pollChangeManager) streamChanges(scopes []string, changesUri *url.URL) error {
+	streamUri := *changesUri
+	streamUri.Path = path.Join(changesUri.Path, "stream")
+	streamUri.RawQuery = c.changesQuery(scopes).Encode()
+	uri := streamUri.String()
+	log.Debugf("Streaming changes: %s", uri)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the stream is blocked in a read most of the time, close() has to interrupt it
+	quitReceived := false
+	watchDone := make(chan bool)
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-c.quitChan:
+			quitReceived = true
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := c.readChangeStream(ctx, cancel, scopes, uri)
+	cancel()
+	<-watchDone
+	if quitReceived {
+		log.Info("streamChanges; Recevied quit signal to stop streaming changes")
+		return quitSignalError
+	}
+	return err
+}
+
+func (c *pollChangeManager) readChangeStream(ctx context.Context, cancel context.CancelFunc, scopes []string, uri string) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	addHeaders(req, c.tokenMan.getBearerToken())
+	req.Header.Set("Accept", sseContentType)
+	if c.lastSequence != "" {
+		req.Header.Set("Last-Event-ID", c.lastSequence)
+	}
+
+	// without the timeout of c.client, the idle timer below ends stale connections
+	streamClient := &http.Client{
+		Transport:     c.client.Transport,
+		CheckRedirect: c.client.CheckRedirect,
+		Jar:           c.client.Jar,
+	}
+	r, err := streamClient.Do(req)
+	if err != nil {
+		log.Errorf("change stream comm error: %s", err)
+		return err
+	}
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotAcceptable, http.StatusNotImplemented:
+		r.Body.Close()
+		return changeStreamUnsupportedError
+	default:
+		// same handling of auth failures and outdated snapshots as long-polling
+		if _, err = c.parseChangeResp(r); err == nil {
+			err = fmt.Errorf("unexpected response code from change stream: %v", r.Status)
+		}
+		return err
+	}
+	defer r.Body.Close()
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sseContentType) {
+		log.Warnf("Change stream returned Content-Type %s", r.Header.Get("Content-Type"))
+		return changeStreamUnsupportedError
+	}
+
+	// heartbeats from the server restart the timer
+	idleTimeout := config.GetDuration(configChangeStreamIdleTimeout)
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		log.Warnf("No data on the change stream for %v, reconnecting", idleTimeout)
+		cancel()
+	})
+	defer idleTimer.Stop()
+
+	return readStreamEvents(r.Body, func() { idleTimer.Reset(idleTimeout) }, func(e streamEvent) error {
+		return c.handleStreamEvent(scopes, e)
+	})
+}
+
+func (c *pollChangeManager) handleStreamEvent(scopes []string, e streamEvent) error {
+	switch e.event {
+	case "", "changes":
+		cl := &common.ChangeList{}
+		if err := json.Unmarshal(e.data, cl); err != nil {
+			log.Errorf("JSON Response Data not parsable: %v", err)
+			return err
+		}
+		if err := c.emitChangeList(scopes, cl); err != nil {
+			return err
+		}
+		c.reporter.changesApplied(c.lastSequence)
+	case "heartbeat":
+		log.Debug("change stream heartbeat")
+	case "error":
+		var apiErr changeServerError
+		if err := json.Unmarshal(e.data, &apiErr); err != nil {
+			log.Errorf("JSON Response Data not parsable: %s", string(e.data))
+			return err
+		}
+		log.Debugf("Received %s from change stream.", apiErr.Code)
+		return apiErr
+	default:
+		log.Debugf("Ignoring change stream event %s", e.event)
+	}
+	return nil
+}
+
+/*
+ * Parses text/event-stream data, see https://html.spec.whatwg.org/multipage/server-sent-events.html
+ * onLine is called for every line received, including comments used as heartbeats.
+ * Returns the first error of handle, or changeStreamClosedError at the end of the stream.
+ */
+func readStreamEvents(body io.Reader, onLine func(), handle func(streamEvent) error) error {
+	reader := bufio.NewReader(body)
+	var e streamEvent
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return changeStreamClosedError
+			}
+			return err
+		}
+		onLine()
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// dispatch
+			if data.Len() > 0 || e.event != "" {
+				e.data = append([]byte(nil), bytes.TrimSuffix(data.Bytes(), []byte("\n"))...)
+				if err = handle(e); err != nil {
+					return err
+				}
+			}
+			e = streamEvent{}
+			data.Reset()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			e.event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			e.id = value
+		}
+	}
+}
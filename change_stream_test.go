@@ -0,0 +1,186 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"fmt"
+	"github.com/apid/apid-core/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("change stream", func() {
+
+	Context("event parsing", func() {
+		It("should parse Server-Sent Events", func() {
+			stream := strings.Join([]string{
+				": comment",
+				"",
+				"id: 1.1.1",
+				"event: changes",
+				"data: {\"a\":",
+				"data: 1}",
+				"",
+				"event: heartbeat",
+				"",
+				"data: default event\r",
+				"\r",
+				"retry",
+				"",
+			}, "\n")
+			var events []streamEvent
+			lines := 0
+			err := readStreamEvents(strings.NewReader(stream), func() { lines++ }, func(e streamEvent) error {
+				events = append(events, e)
+				return nil
+			})
+			Expect(err).Should(Equal(changeStreamClosedError))
+			Expect(lines).Should(Equal(12))
+			Expect(events).Should(Equal([]streamEvent{
+				{id: "1.1.1", event: "changes", data: []byte("{\"a\":\n1}")},
+				{event: "heartbeat"},
+				{data: []byte("default event")},
+			}))
+		})
+
+		It("should stop on handler errors", func() {
+			stream := "data: 1\n\ndata: 2\n\n"
+			handled := 0
+			err := readStreamEvents(strings.NewReader(stream), func() {}, func(e streamEvent) error {
+				handled++
+				return fmt.Errorf("failed")
+			})
+			Expect(err).Should(MatchError("failed"))
+			Expect(handled).Should(Equal(1))
+		})
+	})
+
+	Context("change manager", func() {
+		var testServer *httptest.Server
+		var testMock *MockServer
+		var dummyDbMan *dummyDbManager
+		var dummySnapMan *dummySnapshotManager
+		var testChangeMan *pollChangeManager
+
+		startMock := func(params MockParms) {
+			testRouter := api.CreateService().Router()
+			testServer = httptest.NewServer(testRouter)
+			params.ReliableAPI = true
+			params.ClusterID = config.GetString(configApidClusterId)
+			testMock = Mock(params, testRouter)
+			testMock.oauthToken = "stream_token"
+			apidInfo.ClusterID = config.GetString(configApidClusterId)
+			config.Set(configProxyServerBaseURI, testServer.URL)
+			config.Set(configChangeServerBaseURI, testServer.URL)
+
+			dummyTokenMan := &dummyTokenManager{
+				invalidateChan: make(chan bool, 1),
+				token:          testMock.oauthToken,
+			}
+			client := &http.Client{}
+			testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+			testChangeMan.block = 0
+		}
+
+		BeforeEach(func() {
+			config.Set(configChangeTransport, changeTransportSse)
+			config.Set(configPollInterval, 1*time.Millisecond)
+			initialBackoffInterval = time.Millisecond
+			dummyDbMan = &dummyDbManager{
+				knownTables: map[string]bool{
+					"_transicator_metadata":                true,
+					"_transicator_tables":                  true,
+					"attributes":                           true,
+					"edgex_apid_cluster":                   true,
+					"edgex_data_scope":                     true,
+					"kms_api_product":                      true,
+					"kms_app":                              true,
+					"kms_app_credential":                   true,
+					"kms_app_credential_apiproduct_mapper": true,
+					"kms_company":                          true,
+					"kms_company_developer":                true,
+					"kms_deployment":                       true,
+					"kms_developer":                        true,
+					"kms_organization":                     true,
+				},
+				scopes:         []string{"43aef41d"},
+				lastSeqUpdated: make(chan string, 1000),
+			}
+			dummySnapMan = &dummySnapshotManager{
+				downloadCalledChan: make(chan bool, 1),
+			}
+		})
+
+		AfterEach(func() {
+			<-testChangeMan.close()
+			testServer.Close()
+			config.Set(configChangeTransport, changeTransportPoll)
+			config.Set(configChangeStreamIdleTimeout, 90*time.Second)
+			config.Set(configProxyServerBaseURI, dummyConfigValue)
+			config.Set(configChangeServerBaseURI, dummyConfigValue)
+			config.Set(configPollInterval, 10*time.Millisecond)
+			initialBackoffInterval = defaultInitial
+		})
+
+		It("should apply pushed change lists and resume after a reconnect", func() {
+			startMock(MockParms{StreamChangeLists: 2})
+			testChangeMan.pollChangeWithBackoff()
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("1.1.1")))
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("2.2.2")))
+			Expect(testMock.changeStreamConnections()).Should(Equal([]string{""}))
+			Expect(testChangeMan.reporter.getHealth().LastSequence).Should(Equal("2.2.2"))
+
+			testMock.dropChangeStreams()
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+			Expect(testMock.changeStreamConnections()).Should(Equal([]string{"", "2.2.2"}))
+		}, 3)
+
+		It("should keep the connection while heartbeats arrive", func() {
+			config.Set(configChangeStreamIdleTimeout, 100*time.Millisecond)
+			startMock(MockParms{StreamChangeLists: 1})
+			testChangeMan.pollChangeWithBackoff()
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("1.1.1")))
+			Consistently(testMock.changeStreamConnections, 400*time.Millisecond).Should(HaveLen(1))
+		}, 3)
+
+		It("should reconnect if the stream is idle", func() {
+			config.Set(configChangeStreamIdleTimeout, 100*time.Millisecond)
+			startMock(MockParms{StreamChangeLists: 1, NoStreamHeartbeats: true})
+			testChangeMan.pollChangeWithBackoff()
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("1.1.1")))
+			Eventually(testMock.changeStreamConnections).Should(ContainElement("1.1.1"))
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("2.2.2")))
+		}, 3)
+
+		It("should fall back to long-polling", func() {
+			startMock(MockParms{NoChangeStream: true})
+			testChangeMan.pollChangeWithBackoff()
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("1.1.1")))
+			Eventually(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("2.2.2")))
+			Expect(testChangeMan.useChangeStream()).Should(BeFalse())
+		}, 3)
+
+		It("should get a new snapshot if told by the stream", func() {
+			startMock(MockParms{StreamChangeLists: 1})
+			testMock.forceNewSnapshot()
+			testChangeMan.pollChangeWithBackoff()
+			Eventually(dummySnapMan.downloadCalledChan).Should(Receive(BeTrue()))
+		}, 3)
+	})
+})
@@ -125,7 +125,7 @@ var _ = Describe("Change Agent", func() {
 					invalidateChan: make(chan bool, 1),
 				}
 				client := &http.Client{}
-				testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, client)
+				testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
 				testChangeMan.block = 0
 
 				// create a new API service to have a new router for testing
@@ -200,6 +200,166 @@ var _ = Describe("Change Agent", func() {
 
 		})
 
+		Context("sequence continuity", func() {
+			var testChangeMan *pollChangeManager
+			var dummyDbMan *dummyDbManager
+
+			changeList := func(first, last string, changeSequences ...string) *common.ChangeList {
+				cl := &common.ChangeList{
+					FirstSequence: first,
+					LastSequence:  last,
+					Changes: []common.Change{{
+						Table:     "kms_developer",
+						Operation: common.Insert,
+					}},
+				}
+				for _, sequence := range changeSequences {
+					cl.Changes = append(cl.Changes, common.Change{
+						Table:     "kms_developer",
+						Operation: common.Insert,
+						Sequence:  sequence,
+					})
+				}
+				return cl
+			}
+
+			BeforeEach(func() {
+				dummyDbMan = &dummyDbManager{
+					knownTables:    map[string]bool{"kms_developer": true},
+					lastSeqUpdated: make(chan string, 1),
+				}
+				dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+				client := &http.Client{}
+				testChangeMan = createChangeManager(dummyDbMan, &dummySnapshotManager{}, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+				testChangeMan.lastSequence = "2.2.2"
+			})
+
+			AfterEach(func() {
+				config.Set(configSequenceGapPolicy, sequenceGapPolicyLog)
+				config.Set(configSequenceResyncAttempts, 3)
+			})
+
+			It("should apply change lists continuing from the last sequence", func() {
+				config.Set(configSequenceGapPolicy, sequenceGapPolicyResync)
+				Expect(testChangeMan.emitChangeList(nil, changeList("2.2.2", "3.3.3", "2.2.3", "3.3.3"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+				// the oldest change the server keeps
+				Expect(testChangeMan.emitChangeList(nil, changeList("1.1.1", "4.4.4", "4.4.4"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("4.4.4")))
+				// first change list, or no FirstSequence sent
+				testChangeMan.lastSequence = ""
+				Expect(testChangeMan.emitChangeList(nil, changeList("5.5.5", "6.6.6"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("6.6.6")))
+				Expect(testChangeMan.emitChangeList(nil, changeList("", "7.7.7"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("7.7.7")))
+			})
+
+			It("should only log gaps by default", func() {
+				Expect(testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+			})
+
+			It("should resync from the last sequence on gaps and overlaps", func() {
+				config.Set(configSequenceGapPolicy, sequenceGapPolicyResync)
+				for at, cl := range map[string]*common.ChangeList{
+					"2.2.3": changeList("2.2.3", "3.3.3"),
+					"2.2.2": changeList("1.1.1", "3.3.3", "2.2.2", "3.3.3"),
+				} {
+					err := testChangeMan.emitChangeList(nil, cl)
+					Expect(err).Should(MatchError(ContainSubstring("2.2.2 and " + at)))
+					Expect(testChangeMan.lastSequence).Should(Equal("2.2.2"))
+					Expect(testChangeMan.changesQuery(nil).Get("since")).Should(Equal("2.2.2"))
+				}
+				Expect(dummyDbMan.lastSeqUpdated).ShouldNot(Receive())
+			})
+
+			It("should get a new snapshot if resyncs keep getting the gap", func() {
+				config.Set(configSequenceGapPolicy, sequenceGapPolicyResync)
+				config.Set(configSequenceResyncAttempts, 2)
+				for i := 0; i < 2; i++ {
+					err := testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))
+					Expect(err).Should(MatchError(ContainSubstring("fetching changes again")))
+				}
+				err := testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))
+				Expect(err).Should(Equal(changeServerError{Code: "Sequence gap persists; must get new snapshot"}))
+
+				// a change list without the gap starts counting again
+				err = testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))
+				Expect(err).Should(MatchError(ContainSubstring("fetching changes again")))
+				Expect(testChangeMan.emitChangeList(nil, changeList("2.2.2", "3.3.3"))).Should(Succeed())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+				testChangeMan.lastSequence = "2.2.2"
+				for i := 0; i < 2; i++ {
+					err = testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))
+					Expect(err).Should(MatchError(ContainSubstring("fetching changes again")))
+				}
+			})
+
+			It("should reject a negative number of resyncs", func() {
+				config.Set(configSequenceResyncAttempts, -1)
+				Expect(checkForRequiredValues(true)).Should(MatchError(ContainSubstring(configSequenceResyncAttempts)))
+			})
+
+			It("should get a new snapshot on gaps", func() {
+				config.Set(configSequenceGapPolicy, sequenceGapPolicySnapshot)
+				err := testChangeMan.emitChangeList(nil, changeList("2.2.3", "3.3.3"))
+				Expect(err).Should(Equal(changeServerError{Code: "Sequence gap detected; must get new snapshot"}))
+				Expect(dummyDbMan.lastSeqUpdated).ShouldNot(Receive())
+			})
+		})
+
+		Context("new tables", func() {
+			var testChangeMan *pollChangeManager
+			var dummyDbMan *dummyDbManager
+			var dummySnapMan *dummySnapshotManager
+
+			changeList := &common.ChangeList{
+				LastSequence: "3.3.3",
+				Changes: []common.Change{
+					{Table: "kms.developer", Operation: common.Insert},
+					{Table: "kms.widget", Operation: common.Insert},
+					{Table: "kms.widget", Operation: common.Insert},
+				},
+			}
+
+			BeforeEach(func() {
+				dummyDbMan = &dummyDbManager{
+					knownTables:    map[string]bool{"kms_developer": true},
+					lastSeqUpdated: make(chan string, 1),
+				}
+				dummySnapMan = &dummySnapshotManager{
+					tableSnapshots: map[string]string{"kms.widget": tableSnapshotPrefix + "kms_widget"},
+				}
+				dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+				client := &http.Client{}
+				testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+			})
+
+			AfterEach(func() {
+				config.Set(configIncrementalDdl, true)
+			})
+
+			It("should add new tables from table snapshots", func() {
+				Expect(testChangeMan.emitChangeList(nil, changeList)).Should(Succeed())
+				Expect(dummyDbMan.knownTables["kms_widget"]).Should(BeTrue())
+				Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+			})
+
+			It("should get a new snapshot if there is no table snapshot", func() {
+				dummySnapMan.tableSnapshots = nil
+				err := testChangeMan.emitChangeList(nil, changeList)
+				Expect(err).Should(Equal(changeServerError{Code: "DDL changes detected; must get new snapshot"}))
+				Expect(dummyDbMan.lastSeqUpdated).ShouldNot(Receive())
+			})
+
+			It("should get a new snapshot if incremental DDL is disabled", func() {
+				config.Set(configIncrementalDdl, false)
+				err := testChangeMan.emitChangeList(nil, changeList)
+				Expect(err).Should(Equal(changeServerError{Code: "DDL changes detected; must get new snapshot"}))
+				Expect(dummyDbMan.knownTables["kms_widget"]).Should(BeFalse())
+			})
+		})
+
 		Context("offline change manager", func() {
 			It("offline change manager should have no effect", func() {
 				o := &offlineChangeManager{}
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/apigee-labs/transicator/common"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -28,6 +29,13 @@ import (
 	"time"
 )
 
+// what to do if a change list doesn't continue from the last applied sequence
+const (
+	sequenceGapPolicyLog      = "log"
+	sequenceGapPolicyResync   = "resync"
+	sequenceGapPolicySnapshot = "snapshot"
+)
+
 type pollChangeManager struct {
 	// 0 for not closed, 1 for closed
 	isClosed *int32
@@ -39,10 +47,19 @@ type pollChangeManager struct {
 	dbMan        DbManager
 	snapMan      snapshotManager
 	tokenMan     tokenManager
+	reporter     *statusReporter
 	client       *http.Client
+	// long-poll until then, if the change stream is not available
+	streamRetryAt time.Time
+	// consecutive failures to apply the change list up to failedSequence
+	failedSequence string
+	failedAttempts int
+	// consecutive resyncs from resyncSequence for sequence gaps
+	resyncSequence string
+	resyncAttempts int
 }
 
-func createChangeManager(dbMan DbManager, snapMan snapshotManager, tokenMan tokenManager, client *http.Client) *pollChangeManager {
+func createChangeManager(dbMan DbManager, snapMan snapshotManager, tokenMan tokenManager, reporter *statusReporter, client *http.Client) *pollChangeManager {
 	isClosedInt := int32(0)
 	isLaunchedInt := int32(0)
 	return &pollChangeManager{
@@ -53,6 +70,7 @@ func createChangeManager(dbMan DbManager, snapMan snapshotManager, tokenMan toke
 		dbMan:      dbMan,
 		snapMan:    snapMan,
 		tokenMan:   tokenMan,
+		reporter:   reporter,
 		client:     client,
 	}
 }
@@ -60,6 +78,7 @@ func createChangeManager(dbMan DbManager, snapMan snapshotManager, tokenMan toke
 /*
  * thread-safe close of pollChangeManager
  * It marks status as closed immediately, quits backoff polling agent, and closes tokenManager
+ * The proxy server is told SHUTTING_DOWN first, and OFFLINE once everything is closed
  * use <- close() for blocking close
  */
 func (c *pollChangeManager) close() <-chan bool {
@@ -77,8 +96,10 @@ func (c *pollChangeManager) close() <-chan bool {
 	if atomic.LoadInt32(c.isLaunched) == int32(0) {
 		log.Warn("pollChangeManager: close() called when pollChangeWithBackoff unlaunched!")
 		go func() {
+			c.reporter.shuttingDown()
 			c.tokenMan.close()
 			<-c.snapMan.close()
+			c.reporter.offline()
 			log.Debug("change manager closed")
 			finishChan <- false
 		}()
@@ -87,9 +108,11 @@ func (c *pollChangeManager) close() <-chan bool {
 	// launched
 	log.Debug("pollChangeManager: close pollChangeWithBackoff and token manager")
 	go func() {
+		c.reporter.shuttingDown()
 		c.quitChan <- true
 		c.tokenMan.close()
 		<-c.snapMan.close()
+		c.reporter.offline()
 		log.Debug("change manager closed")
 		finishChan <- true
 	}()
@@ -140,6 +163,15 @@ func (c *pollChangeManager) pollChangeAgent(dummyQuit chan bool) error {
 			if err != nil {
 				return err
 			}
+			if c.useChangeStream() {
+				err = c.streamChanges(scopes, changesUri)
+				if err != changeStreamUnsupportedError {
+					return err
+				}
+				log.Warnf("Change stream is not available, long-polling for %v", changeStreamRetryInterval)
+				c.streamRetryAt = time.Now().Add(changeStreamRetryInterval)
+				continue
+			}
 			r, err := c.getChanges(scopes, changesUri)
 			if err != nil {
 				return err
@@ -151,6 +183,7 @@ func (c *pollChangeManager) pollChangeAgent(dummyQuit chan bool) error {
 			if err = c.emitChangeList(scopes, cl); err != nil {
 				return err
 			}
+			c.reporter.changesApplied(c.lastSequence)
 		}
 	}
 }
@@ -171,7 +204,12 @@ func (c *pollChangeManager) parseChangeResp(r *http.Response) (*common.ChangeLis
 		case http.StatusBadRequest:
 			var apiErr changeServerError
 			var b []byte
-			b, err = ioutil.ReadAll(r.Body)
+			var body io.ReadCloser
+			if body, err = changesBody(r); err != nil {
+				return nil, err
+			}
+			b, err = ioutil.ReadAll(body)
+			body.Close()
 			if err != nil {
 				log.Errorf("Unable to read response body: %v", err)
 				return nil, err
@@ -192,13 +230,7 @@ func (c *pollChangeManager) parseChangeResp(r *http.Response) (*common.ChangeLis
 		}
 	}
 
-	resp := &common.ChangeList{}
-	err = json.NewDecoder(r.Body).Decode(resp)
-	if err != nil {
-		log.Errorf("JSON Response Data not parsable: %v", err)
-		return nil, err
-	}
-	return resp, nil
+	return decodeChangeList(r)
 }
 
 func (c *pollChangeManager) emitChangeList(scopes []string, cl *common.ChangeList) error {
@@ -212,36 +244,44 @@ func (c *pollChangeManager) emitChangeList(scopes []string, cl *common.ChangeLis
 		return nil
 	}
 
+	if err = c.checkSequenceContinuity(cl); err != nil {
+		return err
+	}
+
 	if changesRequireDDLSync(c.dbMan.getKnowTables(), cl) {
-		return changeServerError{
-			Code: "DDL changes detected; must get new snapshot",
+		if err = c.addNewTables(cl); err != nil {
+			return err
 		}
 	}
 
 	/* If valid data present, Emit to plugins */
 	if len(cl.Changes) > 0 {
-		if err = c.dbMan.processChangeList(cl); err != nil {
-			log.Errorf("Error in processChangeList: %v", err)
-			return err
-		}
-		/*
-		* Check to see if there was any change in scope. If found, handle it
-		* by getting a new snapshot
-		 */
-		newScopes, err := c.dbMan.findScopesForId(apidInfo.ClusterID)
+		// also moves last_sequence, so the rows are never applied twice, and merges the data
+		// of added scopes and deletes the data of removed ones
+		applied, scopeChange, err := c.applyChangeList(scopes, cl)
 		if err != nil {
 			return err
 		}
-		cs := scopeChanged(newScopes, scopes)
-		if cs != nil {
-			return cs
+		c.lastSequence = cl.LastSequence
+		// quarantined changes are left out
+		if len(applied.Changes) > 0 {
+			select {
+			case <-time.After(httpTimeout):
+				log.Panic("Timeout. Plugins failed to respond to changes.")
+			case <-eventService.Emit(ApigeeSyncEventSelector, applied):
+			}
 		}
-		select {
-		case <-time.After(httpTimeout):
-			log.Panic("Timeout. Plugins failed to respond to changes.")
-		case <-eventService.Emit(ApigeeSyncEventSelector, cl):
+		if scopeChange != nil {
+			select {
+			case <-time.After(httpTimeout):
+				log.Panic("Timeout. Plugins failed to respond to scope changes.")
+			case <-eventService.Emit(ApigeeSyncEventSelector, scopeChange):
+			}
 		}
-	} else if c.lastSequence == "" { // emit the first changelist anyway
+		return nil
+	}
+
+	if c.lastSequence == "" { // emit the first changelist anyway
 		select {
 		case <-time.After(httpTimeout):
 			log.Panic("Timeout. Plugins failed to respond to changes.")
@@ -263,17 +303,37 @@ func (c *pollChangeManager) emitChangeList(scopes []string, cl *common.ChangeLis
 func (c *pollChangeManager) getChanges(scopes []string, changesUri *url.URL) (*http.Response, error) {
 	log.Debug("polling...")
 
+	v := c.changesQuery(scopes)
+	blockValue := strconv.Itoa(c.block)
+	if c.lastSequence == "" {
+		blockValue = "0"
+	}
+	v.Add("block", blockValue)
+	changesUri.RawQuery = v.Encode()
+	uri := changesUri.String()
+	log.Debugf("Fetching changes: %s", uri)
+
+	/* If error, break the loop, and retry after interval */
+	req, err := http.NewRequest("GET", uri, nil)
+	addHeaders(req, c.tokenMan.getBearerToken())
+	setChangesContentHeaders(req)
+	r, err := c.client.Do(req)
+	if err != nil {
+		log.Errorf("change agent comm error: %s", err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// query parameters of change requests
+func (c *pollChangeManager) changesQuery(scopes []string) url.Values {
 	/* Find the scopes associated with the config id */
 	v := url.Values{}
 
-	blockValue := strconv.Itoa(c.block)
 	/* Sequence added to the query if available */
 	if c.lastSequence != "" {
 		v.Add("since", c.lastSequence)
-	} else {
-		blockValue = "0"
 	}
-	v.Add("block", blockValue)
 
 	/*
 	 * Include all the scopes associated with the config Id
@@ -285,25 +345,51 @@ func (c *pollChangeManager) getChanges(scopes []string, changesUri *url.URL) (*h
 	}
 	v.Add("scope", apidInfo.ClusterID)
 	v.Add("snapshot", apidInfo.LastSnapshot)
-	changesUri.RawQuery = v.Encode()
-	uri := changesUri.String()
-	log.Debugf("Fetching changes: %s", uri)
-
-	/* If error, break the loop, and retry after interval */
-	req, err := http.NewRequest("GET", uri, nil)
-	addHeaders(req, c.tokenMan.getBearerToken())
-	r, err := c.client.Do(req)
-	if err != nil {
-		log.Errorf("change agent comm error: %s", err)
-		return nil, err
-	}
-	return r, nil
+	return v
 }
 
 func changesRequireDDLSync(knownTables map[string]bool, changes *common.ChangeList) bool {
 	return changesHaveNewTables(knownTables, changes.Changes)
 }
 
+/*
+ * Adds the tables of the change list unknown to the current DB version, each from a snapshot
+ * of just that table, so that the changes can be applied without a new data snapshot.
+ * Falls back to a new data snapshot if incremental DDL is disabled, or the snapshot server
+ * doesn't offer table snapshots.
+ */
+func (c *pollChangeManager) addNewTables(cl *common.ChangeList) error {
+	ddlError := changeServerError{
+		Code: "DDL changes detected; must get new snapshot",
+	}
+	knownTables := c.dbMan.getKnowTables()
+	if !config.GetBool(configIncrementalDdl) || len(knownTables) == 0 {
+		return ddlError
+	}
+
+	added := make(map[string]bool)
+	for _, change := range cl.Changes {
+		tableName := normalizeTableName(change.Table)
+		if knownTables[tableName] || added[tableName] {
+			continue
+		}
+		log.Infof("New table %s, fetching a snapshot of it", change.Table)
+		snapshotDbId, err := c.snapMan.downloadTableSnapshot(change.Table)
+		if err == partialSnapshotUnavailableError {
+			return ddlError
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.dbMan.processTableSnapshot(snapshotDbId, change.Table); err != nil {
+			log.Errorf("Unable to add table %s: %v", change.Table, err)
+			return ddlError
+		}
+		added[tableName] = true
+	}
+	return nil
+}
+
 func (c *pollChangeManager) handleChangeServerError(err error) {
 	// has been closed
 	if atomic.LoadInt32(c.isClosed) == int32(1) {
@@ -317,6 +403,7 @@ func (c *pollChangeManager) handleChangeServerError(err error) {
 		c.snapMan.downloadDataSnapshot()
 	default:
 		log.Debugf("Error connecting to changeserver: %v", err)
+		c.reporter.changesFailed()
 	}
 }
 
@@ -341,6 +428,69 @@ func changesHaveNewTables(a map[string]bool, changes []common.Change) bool {
 	return false
 }
 
+/*
+ * Detects change lists that don't continue from the last applied sequence. The change server
+ * may send a FirstSequence older than the last applied sequence, e.g. the oldest change it keeps,
+ * so only a newer one is a gap: the changes in between are gone. An overlap is a change whose
+ * own sequence isn't newer than the last applied sequence.
+ * Depending on configSequenceGapPolicy, the change list is applied anyway, dropped to fetch
+ * the changes since the last applied sequence again, or a new snapshot is requested.
+ * A resync that keeps getting the same gap requests a new snapshot after configSequenceResyncAttempts.
+ */
+func (c *pollChangeManager) checkSequenceContinuity(cl *common.ChangeList) error {
+	if c.lastSequence == "" {
+		return nil
+	}
+	kind, at := "", ""
+	if cl.FirstSequence != "" && getChangeStatus(c.lastSequence, cl.FirstSequence) == 1 {
+		kind, at = "gap", cl.FirstSequence
+	} else if overlap := c.findOverlap(cl); overlap != "" {
+		kind, at = "overlap", overlap
+	} else {
+		c.resyncSequence, c.resyncAttempts = "", 0
+		return nil
+	}
+	log.Errorf("Sequence %s: last applied sequence is %s, change list has %s", kind, c.lastSequence, at)
+
+	switch config.GetString(configSequenceGapPolicy) {
+	case sequenceGapPolicyResync:
+		if c.lastSequence != c.resyncSequence {
+			c.resyncSequence, c.resyncAttempts = c.lastSequence, 0
+		}
+		c.resyncAttempts++
+		if c.resyncAttempts <= config.GetInt(configSequenceResyncAttempts) {
+			return fmt.Errorf("sequence %s between %s and %s, fetching changes again", kind, c.lastSequence, at)
+		}
+		c.resyncSequence, c.resyncAttempts = "", 0
+		log.Errorf("Sequence %s persists after %d resyncs", kind, config.GetInt(configSequenceResyncAttempts))
+		return changeServerError{
+			Code: "Sequence " + kind + " persists; must get new snapshot",
+		}
+	case sequenceGapPolicySnapshot:
+		return changeServerError{
+			Code: "Sequence " + kind + " detected; must get new snapshot",
+		}
+	}
+	return nil
+}
+
+// returns the sequence of the first change not newer than the last applied sequence
+func (c *pollChangeManager) findOverlap(cl *common.ChangeList) string {
+	for _, change := range cl.Changes {
+		if change.Sequence == "" {
+			continue
+		}
+		if _, err := common.ParseSequence(change.Sequence); err != nil {
+			log.Debugf("Unable to parse sequence of change: %v", err)
+			continue
+		}
+		if getChangeStatus(c.lastSequence, change.Sequence) != 1 {
+			return change.Sequence
+		}
+	}
+	return ""
+}
+
 /*
  * seqCurr.Compare() will return 1, if its newer than seqPrev,
  * else will return 0, if same, or -1 if older.
@@ -0,0 +1,309 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Postgres type OIDs, as recorded in the typid column of _transicator_tables
+const (
+	typidBool        = 16
+	typidBytea       = 17
+	typidInt8        = 20
+	typidInt2        = 21
+	typidInt4        = 23
+	typidText        = 25
+	typidFloat4      = 700
+	typidFloat8      = 701
+	typidBpchar      = 1042
+	typidVarchar     = 1043
+	typidDate        = 1082
+	typidTimestamp   = 1114
+	typidTimestamptz = 1184
+	typidNumeric     = 1700
+	typidUuid        = 2950
+
+	typidBoolArray        = 1000
+	typidInt2Array        = 1005
+	typidInt4Array        = 1007
+	typidTextArray        = 1009
+	typidBpcharArray      = 1014
+	typidVarcharArray     = 1015
+	typidInt8Array        = 1016
+	typidFloat4Array      = 1021
+	typidFloat8Array      = 1022
+	typidTimestampArray   = 1115
+	typidTimestamptzArray = 1185
+	typidUuidArray        = 2951
+)
+
+// all timestamps are stored in this format, in UTC
+const timestampFormat = time.RFC3339Nano
+
+const dateFormat = "2006-01-02"
+
+// the element types of the array types
+var arrayElementTypids = map[int64]int64{
+	typidBoolArray:        typidBool,
+	typidInt2Array:        typidInt2,
+	typidInt4Array:        typidInt4,
+	typidTextArray:        typidText,
+	typidBpcharArray:      typidBpchar,
+	typidVarcharArray:     typidVarchar,
+	typidInt8Array:        typidInt8,
+	typidFloat4Array:      typidFloat4,
+	typidFloat8Array:      typidFloat8,
+	typidTimestampArray:   typidTimestamp,
+	typidTimestamptzArray: typidTimestamptz,
+	typidUuidArray:        typidUuid,
+}
+
+// formats of timestamps sent by the change server, or found in snapshots
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// whether values of the type are converted, text types are stored as they are
+func isConvertedTypid(typid int64) bool {
+	switch typid {
+	case typidBool, typidInt2, typidInt4, typidInt8, typidFloat4, typidFloat8, typidNumeric,
+		typidDate, typidTimestamp, typidTimestamptz:
+		return true
+	}
+	_, isArray := arrayElementTypids[typid]
+	return isArray
+}
+
+// the column type of tables created for the type, as in SQLite snapshots
+func sqliteColumnType(typid int64) string {
+	switch typid {
+	case typidBool, typidInt2, typidInt4, typidInt8:
+		return "integer"
+	case typidFloat4, typidFloat8, typidNumeric:
+		return "real"
+	case typidBytea, typidDate, typidTimestamp, typidTimestamptz:
+		return "blob"
+	}
+	return "text"
+}
+
+/*
+ * Converts a column value to the SQLite representation of its Postgres type:
+ * integers to int64, floats to float64, booleans to bool, timestamps to UTC strings
+ * in timestampFormat, dates to dateFormat and arrays to JSON arrays.
+ * Values of other types are returned as they are.
+ */
+func convertColumnValue(typid int64, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	if elemTypid, ok := arrayElementTypids[typid]; ok {
+		return convertArray(elemTypid, value)
+	}
+	switch typid {
+	case typidInt2, typidInt4, typidInt8:
+		return convertInt(value)
+	case typidFloat4, typidFloat8, typidNumeric:
+		return convertFloat(value)
+	case typidBool:
+		return convertBool(value)
+	case typidTimestamp, typidTimestamptz:
+		t, err := convertTime(value)
+		if err != nil {
+			return nil, err
+		}
+		return t.UTC().Format(timestampFormat), nil
+	case typidDate:
+		t, err := convertTime(value)
+		if err != nil {
+			return nil, err
+		}
+		return t.Format(dateFormat), nil
+	}
+	return value, nil
+}
+
+func convertInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("not an integer: %v", v)
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	return 0, fmt.Errorf("not an integer: %v (%T)", value, value)
+}
+
+func convertFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("not a number: %v (%T)", value, value)
+}
+
+func convertBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		// Postgres sends "t" and "f"
+		return strconv.ParseBool(strings.TrimSpace(v))
+	}
+	return false, fmt.Errorf("not a boolean: %v (%T)", value, value)
+}
+
+func convertTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		s := strings.TrimSpace(v)
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		if t, err := time.Parse(dateFormat, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("not a timestamp: %v (%T)", value, value)
+}
+
+// converts a Postgres array literal, a JSON array or a decoded JSON array to a JSON array
+func convertArray(elemTypid int64, value interface{}) (string, error) {
+	var elems []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		elems = v
+	case []string:
+		for _, e := range v {
+			elems = append(elems, e)
+		}
+	case string:
+		s := strings.TrimSpace(v)
+		if strings.HasPrefix(s, "[") {
+			if err := json.Unmarshal([]byte(s), &elems); err != nil {
+				return "", fmt.Errorf("not a JSON array: %v", err)
+			}
+			break
+		}
+		strs, err := parsePostgresArray(s)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range strs {
+			elems = append(elems, e)
+		}
+	default:
+		return "", fmt.Errorf("not an array: %v (%T)", value, value)
+	}
+
+	converted := make([]interface{}, len(elems))
+	for i, e := range elems {
+		c, err := convertColumnValue(elemTypid, e)
+		if err != nil {
+			return "", err
+		}
+		converted[i] = c
+	}
+	b, err := json.Marshal(converted)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*
+ * Parses a one dimensional Postgres array literal like {a,"b c",NULL}.
+ * NULL elements are returned as nil.
+ */
+func parsePostgresArray(s string) ([]interface{}, error) {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("not an array literal: %s", s)
+	}
+	s = s[1 : len(s)-1]
+	elems := []interface{}{}
+	if s == "" {
+		return elems, nil
+	}
+	var elem []byte
+	quoted, inQuotes, escaped := false, false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			elem = append(elem, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case c == '{' && !inQuotes:
+			return nil, fmt.Errorf("multi dimensional arrays are not supported: %s", s)
+		case c == ',' && !inQuotes:
+			elems = append(elems, arrayElement(elem, quoted))
+			elem, quoted = nil, false
+		default:
+			elem = append(elem, c)
+		}
+	}
+	if inQuotes || escaped {
+		return nil, fmt.Errorf("unterminated array literal: %s", s)
+	}
+	return append(elems, arrayElement(elem, quoted)), nil
+}
+
+func arrayElement(elem []byte, quoted bool) interface{} {
+	if !quoted && string(elem) == "NULL" {
+		return nil
+	}
+	return string(elem)
+}
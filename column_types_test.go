@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("column type conversion", func() {
+
+	for _, testCase := range []struct {
+		typid    int64
+		value    interface{}
+		expected interface{}
+	}{
+		{typidInt4, "42", int64(42)},
+		{typidInt4, " -7 ", int64(-7)},
+		{typidInt8, float64(9007199254740992), int64(9007199254740992)},
+		{typidInt2, []byte("3"), int64(3)},
+		{typidInt4, int64(5), int64(5)},
+		{typidFloat8, "1.5", 1.5},
+		{typidNumeric, int64(2), float64(2)},
+		{typidBool, "t", true},
+		{typidBool, "f", false},
+		{typidBool, "true", true},
+		{typidBool, int64(0), false},
+		{typidBool, true, true},
+		{typidTimestamp, "2017-08-23 17:23:00.123", "2017-08-23T17:23:00.123Z"},
+		{typidTimestamp, "2017-08-23 17:23:00.123+00:00", "2017-08-23T17:23:00.123Z"},
+		{typidTimestamptz, "2017-08-23 19:23:00+02", "2017-08-23T17:23:00Z"},
+		{typidTimestamptz, "2017-08-23T17:23:00.5-01:00", "2017-08-23T18:23:00.5Z"},
+		{typidTimestamp, time.Date(2017, 8, 23, 17, 23, 0, 0, time.UTC), "2017-08-23T17:23:00Z"},
+		{typidDate, "2017-08-23", "2017-08-23"},
+		{typidDate, "2017-08-23 00:00:00", "2017-08-23"},
+		{typidVarcharArray, "{/a,/b}", `["/a","/b"]`},
+		{typidVarcharArray, `{"a b","c,d","e\"f",NULL,"NULL"}`, `["a b","c,d","e\"f",null,"NULL"]`},
+		{typidVarcharArray, "{}", `[]`},
+		{typidVarcharArray, `["a","b"]`, `["a","b"]`},
+		{typidTextArray, []interface{}{"a", "b"}, `["a","b"]`},
+		{typidInt4Array, "{1,2,3}", `[1,2,3]`},
+		{typidBoolArray, "{t,f}", `[true,false]`},
+		{typidVarchar, "some text", "some text"},
+		{typidText, []byte("bytes"), "bytes"},
+		{typidUuid, "2d6d2c23-7f0f-4a2c-9f17-7c9e1f8f2b4e", "2d6d2c23-7f0f-4a2c-9f17-7c9e1f8f2b4e"},
+	} {
+		testCase := testCase
+		It(fmt.Sprintf("should convert %#v of typid %d", testCase.value, testCase.typid), func() {
+			Expect(convertColumnValue(testCase.typid, testCase.value)).Should(Equal(testCase.expected))
+		})
+	}
+
+	for _, testCase := range []struct {
+		typid int64
+		value interface{}
+	}{
+		{typidInt4, "forty-two"},
+		{typidInt4, 1.5},
+		{typidBool, "maybe"},
+		{typidTimestamp, "yesterday"},
+		{typidVarcharArray, "a,b"},
+		{typidVarcharArray, `{"a,b}`},
+		{typidVarcharArray, "{{a},{b}}"},
+		{typidInt4Array, "{1,x}"},
+	} {
+		testCase := testCase
+		It(fmt.Sprintf("should fail to convert %#v of typid %d", testCase.value, testCase.typid), func() {
+			_, err := convertColumnValue(testCase.typid, testCase.value)
+			Expect(err).Should(HaveOccurred())
+		})
+	}
+
+	It("should keep NULL values", func() {
+		Expect(convertColumnValue(typidInt4, nil)).Should(BeNil())
+		Expect(convertColumnValue(typidVarcharArray, nil)).Should(BeNil())
+	})
+
+	It("should only convert non text types", func() {
+		Expect(isConvertedTypid(typidInt4)).Should(BeTrue())
+		Expect(isConvertedTypid(typidTimestamp)).Should(BeTrue())
+		Expect(isConvertedTypid(typidVarcharArray)).Should(BeTrue())
+		Expect(isConvertedTypid(typidVarchar)).Should(BeFalse())
+		Expect(isConvertedTypid(typidUuid)).Should(BeFalse())
+	})
+})
@@ -0,0 +1,238 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	credentialsProviderConfig        = "config"
+	credentialsProviderEnv           = "env"
+	credentialsProviderFile          = "file"
+	credentialsProviderEncryptedFile = "encrypted_file"
+)
+
+type consumerCredentials struct {
+	Key    string `json:"key"`
+	Secret string `json:"secret"`
+}
+
+/*
+ * Source of the consumer key and secret used to get a token.
+ * getCredentials() is called for every token request, and periodically by the token manager
+ * to detect rotated credentials.
+ */
+type credentialProvider interface {
+	getCredentials() (consumerCredentials, error)
+}
+
+// the jwt_bearer grant type sends an assertion signed with the JWT key instead of the consumer secret
+func isConsumerSecretRequired() bool {
+	return config.GetString(configTokenGrantType) == grantTypeClientCredentials
+}
+
+func createCredentialProvider() (credentialProvider, error) {
+	provider := config.GetString(configCredentialsProvider)
+	switch provider {
+	case credentialsProviderConfig:
+		return &configCredentialProvider{}, nil
+	case credentialsProviderEnv:
+		return &envCredentialProvider{
+			keyVar:    config.GetString(configConsumerKeyEnv),
+			secretVar: config.GetString(configConsumerSecretEnv),
+		}, nil
+	case credentialsProviderFile:
+		p := &fileCredentialProvider{
+			keyFile:    config.GetString(configConsumerKeyFile),
+			secretFile: config.GetString(configConsumerSecretFile),
+		}
+		if p.keyFile == "" {
+			return nil, fmt.Errorf("%s is required for credentials provider %s", configConsumerKeyFile, provider)
+		}
+		if p.secretFile == "" && isConsumerSecretRequired() {
+			return nil, fmt.Errorf("%s and %s are required for credentials provider %s",
+				configConsumerKeyFile, configConsumerSecretFile, provider)
+		}
+		return p, nil
+	case credentialsProviderEncryptedFile:
+		p := &encryptedFileCredentialProvider{
+			file:    config.GetString(configCredentialsFile),
+			keyFile: config.GetString(configCredentialsKeyFile),
+		}
+		if p.file == "" || p.keyFile == "" {
+			return nil, fmt.Errorf("%s and %s are required for credentials provider %s",
+				configCredentialsFile, configCredentialsKeyFile, provider)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("illegal value for %s: %s", configCredentialsProvider, provider)
+	}
+}
+
+// reads apigeesync_consumer_key and apigeesync_consumer_secret from config
+type configCredentialProvider struct{}
+
+func (p *configCredentialProvider) getCredentials() (consumerCredentials, error) {
+	return consumerCredentials{
+		Key:    config.GetString(configConsumerKey),
+		Secret: config.GetString(configConsumerSecret),
+	}, nil
+}
+
+type envCredentialProvider struct {
+	keyVar    string
+	secretVar string
+}
+
+func (p *envCredentialProvider) getCredentials() (consumerCredentials, error) {
+	creds := consumerCredentials{
+		Key:    os.Getenv(p.keyVar),
+		Secret: os.Getenv(p.secretVar),
+	}
+	if creds.Key == "" {
+		return creds, fmt.Errorf("environment variable %s must be set", p.keyVar)
+	}
+	if creds.Secret == "" && isConsumerSecretRequired() {
+		return creds, fmt.Errorf("environment variables %s and %s must be set", p.keyVar, p.secretVar)
+	}
+	return creds, nil
+}
+
+// one file each for key and secret, e.g. a mounted Kubernetes secret
+type fileCredentialProvider struct {
+	keyFile    string
+	secretFile string
+}
+
+func (p *fileCredentialProvider) getCredentials() (creds consumerCredentials, err error) {
+	if creds.Key, err = readSecretFile(p.keyFile); err != nil || !isConsumerSecretRequired() {
+		return
+	}
+	creds.Secret, err = readSecretFile(p.secretFile)
+	return
+}
+
+func readSecretFile(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", file)
+	}
+	return value, nil
+}
+
+/*
+ * The file holds the JSON encoded consumerCredentials, encrypted with encryptWithKey().
+ * The key file holds a base64 encoded 256 bit AES key.
+ */
+type encryptedFileCredentialProvider struct {
+	file    string
+	keyFile string
+}
+
+func (p *encryptedFileCredentialProvider) getCredentials() (creds consumerCredentials, err error) {
+	key, err := readEncryptionKey(p.keyFile)
+	if err != nil {
+		return
+	}
+	encrypted, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return
+	}
+	plain, err := decryptWithKey(key, bytes.TrimSpace(encrypted))
+	if err != nil {
+		return creds, fmt.Errorf("unable to decrypt %s: %v", p.file, err)
+	}
+	if err = json.Unmarshal(plain, &creds); err != nil {
+		return
+	}
+	if creds.Key == "" {
+		return creds, fmt.Errorf("key missing in %s", p.file)
+	}
+	if creds.Secret == "" && isConsumerSecretRequired() {
+		return creds, fmt.Errorf("secret missing in %s", p.file)
+	}
+	return
+}
+
+func readEncryptionKey(keyFile string) ([]byte, error) {
+	encoded, err := readSecretFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key in %s is not base64 encoded: %v", keyFile, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key in %s must be 32 bytes, is %d", keyFile, len(key))
+	}
+	return key, nil
+}
+
+// AES-GCM, returns base64(nonce | ciphertext)
+func encryptWithKey(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+func decryptWithKey(key, encoded []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(sealed, encoded)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[:n]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
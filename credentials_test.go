@@ -0,0 +1,213 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ = Describe("credential providers", func() {
+	var testDir string
+
+	BeforeEach(func() {
+		var err error
+		testDir, err = ioutil.TempDir(tmpDir, "credentials_test")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(configCredentialsProvider, credentialsProviderConfig)
+		for _, key := range []string{configConsumerKeyFile, configConsumerSecretFile, configCredentialsFile, configCredentialsKeyFile} {
+			config.Set(key, "")
+		}
+		Expect(os.RemoveAll(testDir)).Should(Succeed())
+	})
+
+	writeFile := func(name, content string) string {
+		f := filepath.Join(testDir, name)
+		Expect(ioutil.WriteFile(f, []byte(content), 0600)).Should(Succeed())
+		return f
+	}
+
+	createEncryptionKey := func() []byte {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		Expect(err).Should(Succeed())
+		return key
+	}
+
+	writeEncryptedCredentials := func(name string, key []byte, creds consumerCredentials) string {
+		plain, err := json.Marshal(creds)
+		Expect(err).Should(Succeed())
+		encrypted, err := encryptWithKey(key, plain)
+		Expect(err).Should(Succeed())
+		return writeFile(name, string(encrypted))
+	}
+
+	It("should read credentials from config", func() {
+		config.Set(configCredentialsProvider, credentialsProviderConfig)
+		p, err := createCredentialProvider()
+		Expect(err).Should(Succeed())
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{
+			Key:    config.GetString(configConsumerKey),
+			Secret: config.GetString(configConsumerSecret),
+		}))
+	})
+
+	It("should read credentials from environment", func() {
+		config.Set(configCredentialsProvider, credentialsProviderEnv)
+		p, err := createCredentialProvider()
+		Expect(err).Should(Succeed())
+		keyVar := config.GetString(configConsumerKeyEnv)
+		secretVar := config.GetString(configConsumerSecretEnv)
+		defer os.Unsetenv(keyVar)
+		defer os.Unsetenv(secretVar)
+
+		os.Setenv(keyVar, "env-key")
+		_, err = p.getCredentials()
+		Expect(err).ShouldNot(Succeed())
+
+		os.Setenv(secretVar, "env-secret")
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{Key: "env-key", Secret: "env-secret"}))
+	})
+
+	It("should read credentials from mounted files", func() {
+		config.Set(configCredentialsProvider, credentialsProviderFile)
+		_, err := createCredentialProvider()
+		Expect(err).ShouldNot(Succeed())
+
+		config.Set(configConsumerKeyFile, writeFile("key", "file-key\n"))
+		config.Set(configConsumerSecretFile, writeFile("secret", "file-secret\n"))
+		p, err := createCredentialProvider()
+		Expect(err).Should(Succeed())
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{Key: "file-key", Secret: "file-secret"}))
+
+		writeFile("secret", "")
+		_, err = p.getCredentials()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should read credentials from an encrypted file", func() {
+		key := createEncryptionKey()
+		creds := consumerCredentials{Key: "enc-key", Secret: "enc-secret"}
+		config.Set(configCredentialsProvider, credentialsProviderEncryptedFile)
+		config.Set(configCredentialsFile, writeEncryptedCredentials("credentials", key, creds))
+		config.Set(configCredentialsKeyFile, writeFile("aes.key", base64.StdEncoding.EncodeToString(key)))
+		p, err := createCredentialProvider()
+		Expect(err).Should(Succeed())
+		Expect(p.getCredentials()).Should(Equal(creds))
+
+		// wrong key
+		writeFile("aes.key", base64.StdEncoding.EncodeToString(createEncryptionKey()))
+		_, err = p.getCredentials()
+		Expect(err).ShouldNot(Succeed())
+
+		// key of wrong size
+		writeFile("aes.key", base64.StdEncoding.EncodeToString(key[:16]))
+		_, err = p.getCredentials()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should only require the key with the jwt_bearer grant type", func() {
+		config.Set(configTokenGrantType, grantTypeJwtBearer)
+		defer config.Set(configTokenGrantType, grantTypeClientCredentials)
+
+		config.Set(configCredentialsProvider, credentialsProviderEnv)
+		p, err := createCredentialProvider()
+		Expect(err).Should(Succeed())
+		keyVar := config.GetString(configConsumerKeyEnv)
+		defer os.Unsetenv(keyVar)
+		os.Unsetenv(config.GetString(configConsumerSecretEnv))
+		_, err = p.getCredentials()
+		Expect(err).ShouldNot(Succeed())
+		os.Setenv(keyVar, "env-key")
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{Key: "env-key"}))
+
+		config.Set(configCredentialsProvider, credentialsProviderFile)
+		config.Set(configConsumerKeyFile, writeFile("key", "file-key\n"))
+		p, err = createCredentialProvider()
+		Expect(err).Should(Succeed())
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{Key: "file-key"}))
+
+		key := createEncryptionKey()
+		config.Set(configCredentialsProvider, credentialsProviderEncryptedFile)
+		config.Set(configCredentialsFile, writeEncryptedCredentials("credentials", key, consumerCredentials{Key: "enc-key"}))
+		config.Set(configCredentialsKeyFile, writeFile("aes.key", base64.StdEncoding.EncodeToString(key)))
+		p, err = createCredentialProvider()
+		Expect(err).Should(Succeed())
+		Expect(p.getCredentials()).Should(Equal(consumerCredentials{Key: "enc-key"}))
+	})
+
+	It("should reject unknown providers", func() {
+		config.Set(configCredentialsProvider, "vault")
+		_, err := createCredentialProvider()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("token manager should get a new token when credentials are rotated", func() {
+		var mux sync.Mutex
+		clientIds := make([]string, 0)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.ParseForm()).Should(Succeed())
+			mux.Lock()
+			clientIds = append(clientIds, r.PostFormValue("client_id"))
+			mux.Unlock()
+			body, err := json.Marshal(OauthToken{
+				AccessToken: "token-" + r.PostFormValue("client_id"),
+				ExpiresIn:   200,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			w.Write(body)
+		}))
+		defer ts.Close()
+		config.Set(configProxyServerBaseURI, ts.URL)
+		interval := config.GetDuration(configCredentialsPollInterval)
+		defer config.Set(configCredentialsPollInterval, interval)
+		config.Set(configCredentialsPollInterval, 50*time.Millisecond)
+
+		p := &fileCredentialProvider{
+			keyFile:    writeFile("key", "key-1"),
+			secretFile: writeFile("secret", "secret-1"),
+		}
+		testedTokenManager := createApidTokenManager(false, &http.Client{}, p, nil)
+		testedTokenManager.start()
+		defer testedTokenManager.close()
+		Expect(testedTokenManager.getBearerToken()).Should(Equal("token-key-1"))
+
+		// a rotation in progress is ignored
+		Expect(os.Remove(p.secretFile)).Should(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		Expect(testedTokenManager.getBearerToken()).Should(Equal("token-key-1"))
+
+		writeFile("key", "key-2")
+		writeFile("secret", "secret-2")
+		Eventually(testedTokenManager.getBearerToken).Should(Equal("token-key-2"))
+		mux.Lock()
+		defer mux.Unlock()
+		Expect(clientIds).Should(Equal([]string{"key-1", "key-2"}))
+	}, 3)
+})
@@ -16,21 +16,27 @@ package apidApigeeSync
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/apid/apid-core/util"
 	"sync"
+	"time"
 
 	"github.com/apid/apid-core"
 	"github.com/apigee-labs/transicator/common"
 	"sort"
 	"strings"
+	"sync/atomic"
 )
 
 var (
 	dbMux sync.RWMutex
 )
 
+// SQLITE_MAX_VARIABLE_NUMBER of SQLite before 3.32, the limit of values in a statement
+const sqliteMaxVariables = 999
+
 /*
 This plugin uses 2 databases:
 1. The default DB is used for APID table.
@@ -39,9 +45,15 @@ This plugin uses 2 databases:
 */
 
 func creatDbManager() *dbManager {
+	replacedInserts := int64(0)
+	missingDeletes := int64(0)
 	return &dbManager{
-		DbMux:       &sync.RWMutex{},
-		knownTables: make(map[string]bool),
+		DbMux:           &sync.RWMutex{},
+		knownTables:     make(map[string]bool),
+		replacedInserts: &replacedInserts,
+		missingDeletes:  &missingDeletes,
+		upsertMux:       &sync.RWMutex{},
+		upsertTables:    make(map[string]bool),
 	}
 }
 
@@ -50,6 +62,29 @@ type dbManager struct {
 	DbMux       *sync.RWMutex
 	dbVersion   string
 	knownTables map[string]bool
+	// changes made idempotent by configIdempotentApply
+	replacedInserts *int64
+	missingDeletes  *int64
+	// tables merged by mergeSnapshot(), always applied idempotently
+	upsertMux    *sync.RWMutex
+	upsertTables map[string]bool
+	// set by the crash recovery tests, see afterStep()
+	stepHook func(step string)
+}
+
+// how often replayed changes were made idempotent
+type applyMetrics struct {
+	// inserts that replaced an existing row with the same primary key
+	ReplacedInserts int64 `json:"replacedInserts"`
+	// deletes of rows that didn't exist
+	MissingDeletes int64 `json:"missingDeletes"`
+}
+
+func (dbMan *dbManager) getApplyMetrics() applyMetrics {
+	return applyMetrics{
+		ReplacedInserts: atomic.LoadInt64(dbMan.replacedInserts),
+		MissingDeletes:  atomic.LoadInt64(dbMan.missingDeletes),
+	}
 }
 
 // idempotent call to initialize default DB
@@ -71,6 +106,11 @@ func (dbMan *dbManager) initDB() error {
 	    last_snapshot_info text,
 	    PRIMARY KEY (instance_id)
 	);
+	CREATE TABLE IF NOT EXISTS APID_TOKEN (
+	    instance_id text,
+	    token text,
+	    PRIMARY KEY (instance_id)
+	);
 	`)
 	if err != nil {
 		log.Errorf("initDB(): Unable to tx exec err: {%v}", err)
@@ -96,11 +136,18 @@ func (dbMan *dbManager) setDB(db apid.DB) {
 	dbMan.Db = db
 }
 
-//TODO if len(rows) > 1000, chunk it up and exec multiple inserts in the txn
+/*
+ * Inserts rows with the columns of the first row, in multi-row inserts of as many rows
+ * as fit in sqliteMaxVariables. The statement is prepared once for all full chunks.
+ */
 func (dbMan *dbManager) insert(tableName string, rows []common.Row, txn apid.Tx) error {
 	if len(rows) == 0 {
 		return fmt.Errorf("no rows")
 	}
+	rows, err := dbMan.convertRows(tableName, rows, txn)
+	if err != nil {
+		return err
+	}
 
 	var orderedColumns []string
 	for column := range rows[0] {
@@ -108,36 +155,116 @@ func (dbMan *dbManager) insert(tableName string, rows []common.Row, txn apid.Tx)
 	}
 	sort.Strings(orderedColumns)
 
-	sql := dbMan.buildInsertSql(tableName, orderedColumns, rows)
+	idempotent := dbMan.isIdempotent(tableName)
+	if idempotent {
+		if err := dbMan.deleteExisting(tableName, rows, txn); err != nil {
+			return err
+		}
+	}
 
-	prep, err := txn.Prepare(sql)
-	if err != nil {
-		log.Errorf("INSERT Fail to prepare statement %s error=%v", sql, err)
-		return err
+	chunkSize := len(rows)
+	if len(orderedColumns) > 0 && chunkSize*len(orderedColumns) > sqliteMaxVariables {
+		chunkSize = sqliteMaxVariables / len(orderedColumns)
 	}
-	defer prep.Close()
+	var prep *sql.Stmt
+	var insertSql string
+	preparedRows := 0
+	defer func() {
+		if prep != nil {
+			prep.Close()
+		}
+	}()
+	for start := 0; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunk := rows[start:end]
+		if len(chunk) != preparedRows {
+			if prep != nil {
+				prep.Close()
+			}
+			insertSql = dbMan.buildInsertSql(tableName, orderedColumns, chunk)
+			if idempotent {
+				insertSql = strings.Replace(insertSql, "INSERT INTO", "INSERT OR REPLACE INTO", 1)
+			}
+			if prep, err = txn.Prepare(insertSql); err != nil {
+				log.Errorf("INSERT Fail to prepare statement %s error=%v", insertSql, err)
+				return err
+			}
+			preparedRows = len(chunk)
+		}
 
-	var values []interface{}
+		values := make([]interface{}, 0, len(chunk)*len(orderedColumns))
+		for _, row := range chunk {
+			for _, columnName := range orderedColumns {
+				//use Value so that stmt exec does not complain about common.ColumnVal being a struct
+				if row[columnName] == nil {
+					values = append(values, nil)
+				} else {
+					values = append(values, row[columnName].Value)
+				}
+			}
+		}
 
-	for _, row := range rows {
-		for _, columnName := range orderedColumns {
-			//use Value so that stmt exec does not complain about common.ColumnVal being a struct
-			values = append(values, row[columnName].Value)
+		//create prepared statement from existing template statement
+		if _, err = prep.Exec(values...); err != nil {
+			log.Errorf("INSERT Fail %s values=%v error=%v", insertSql, values, err)
+			return err
 		}
+		log.Debugf("INSERT Success %s values=%v", insertSql, values)
 	}
 
-	//create prepared statement from existing template statement
-	_, err = prep.Exec(values...)
+	return nil
+}
 
+/*
+ * Makes inserts upserts, keyed on the primary keys from _transicator_tables,
+ * so that a replayed change list doesn't fail on rows it inserted before.
+ * INSERT OR REPLACE covers tables without primary keys in _transicator_tables.
+ */
+func (dbMan *dbManager) deleteExisting(tableName string, rows []common.Row, txn apid.Tx) error {
+	pkeys, err := dbMan.getPkeysForTable(tableName)
 	if err != nil {
-		log.Errorf("INSERT Fail %s values=%v error=%v", sql, values, err)
 		return err
 	}
-	log.Debugf("INSERT Success %s values=%v", sql, values)
-
+	if len(pkeys) == 0 {
+		return nil
+	}
+	sort.Strings(pkeys)
+	sql := dbMan.buildDeleteSql(tableName, rows[0], pkeys)
+	prep, err := txn.Prepare(sql)
+	if err != nil {
+		return fmt.Errorf("DELETE Fail to prep statement %s error=%v", sql, err)
+	}
+	defer prep.Close()
+	for _, row := range rows {
+		values := dbMan.getValueListFromKeys(row, pkeys)
+		res, err := prep.Exec(values...)
+		if err != nil {
+			return fmt.Errorf("DELETE Fail %s values=%v error=%v", sql, values, err)
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected != 0 {
+			atomic.AddInt64(dbMan.replacedInserts, 1)
+			log.Infof("INSERT replaces existing row of %s values=%v", tableName, values)
+		}
+	}
 	return nil
 }
 
+/*
+ * A table snapshot may already contain changes of the change lists that follow it,
+ * so imported tables are applied idempotently, until the next data snapshot.
+ */
+func (dbMan *dbManager) isIdempotent(tableName string) bool {
+	if config.GetBool(configIdempotentApply) {
+		return true
+	}
+	dbMan.upsertMux.RLock()
+	defer dbMan.upsertMux.RUnlock()
+	return dbMan.upsertTables[normalizeTableName(tableName)]
+}
+
 func (dbMan *dbManager) getValueListFromKeys(row common.Row, pkeys []string) []interface{} {
 	var values = make([]interface{}, len(pkeys))
 	for i, pkey := range pkeys {
@@ -153,13 +280,24 @@ func (dbMan *dbManager) getValueListFromKeys(row common.Row, pkeys []string) []i
 func (dbMan *dbManager) delete(tableName string, rows []common.Row, txn apid.Tx) error {
 	pkeys, err := dbMan.getPkeysForTable(tableName)
 	sort.Strings(pkeys)
-	if len(pkeys) == 0 || err != nil {
+	if err != nil {
 		return fmt.Errorf("DELETE No primary keys found for table. %s", tableName)
 	}
 
 	if len(rows) == 0 {
 		return fmt.Errorf("no rows found for table %s", tableName)
 	}
+	if rows, err = dbMan.convertRows(tableName, rows, txn); err != nil {
+		return err
+	}
+	if len(pkeys) == 0 {
+		for _, row := range rows {
+			if err = dbMan.deleteMatchingRow(tableName, row, txn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	sql := dbMan.buildDeleteSql(tableName, rows[0], pkeys)
 	prep, err := txn.Prepare(sql)
@@ -178,6 +316,11 @@ func (dbMan *dbManager) delete(tableName string, rows []common.Row, txn apid.Tx)
 		if err == nil && affected != 0 {
 			log.Debugf("DELETE Success %s values=%v", sql, values)
 		} else if err == nil && affected == 0 {
+			if dbMan.isIdempotent(tableName) {
+				atomic.AddInt64(dbMan.missingDeletes, 1)
+				log.Infof("entry not found %s values=%v, already deleted", sql, values)
+				continue
+			}
 			return fmt.Errorf("entry not found %s values=%v, nothing to delete", sql, values)
 		} else {
 			return fmt.Errorf("DELETE Failed %s values=%v error=%v", sql, values, err)
@@ -213,12 +356,18 @@ func (dbMan *dbManager) buildDeleteSql(tableName string, row common.Row, pkeys [
 
 func (dbMan *dbManager) update(tableName string, oldRows, newRows []common.Row, txn apid.Tx) error {
 	pkeys, err := dbMan.getPkeysForTable(tableName)
-	if len(pkeys) == 0 || err != nil {
+	if err != nil {
 		return fmt.Errorf("UPDATE No primary keys found for table: %v, %v", tableName, err)
 	}
 	if len(oldRows) == 0 || len(newRows) == 0 {
 		return fmt.Errorf("UPDATE No old or new rows, table: %v, %v, %v", tableName, oldRows, newRows)
 	}
+	if oldRows, err = dbMan.convertRows(tableName, oldRows, txn); err != nil {
+		return err
+	}
+	if newRows, err = dbMan.convertRows(tableName, newRows, txn); err != nil {
+		return err
+	}
 
 	var orderedColumns []string
 
@@ -228,6 +377,15 @@ func (dbMan *dbManager) update(tableName string, oldRows, newRows []common.Row,
 	}
 	sort.Strings(orderedColumns)
 
+	if len(pkeys) == 0 {
+		for i := range newRows {
+			if err = dbMan.updateMatchingRow(tableName, orderedColumns, oldRows[i], newRows[i], txn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	//build update statement, use arbitrary row as template
 	sql := dbMan.buildUpdateSql(tableName, orderedColumns, newRows[0], pkeys)
 	prep, err := txn.Prepare(sql)
@@ -241,8 +399,7 @@ func (dbMan *dbManager) update(tableName string, oldRows, newRows []common.Row,
 
 		for _, columnName := range orderedColumns {
 			//use Value so that stmt exec does not complain about common.ColumnVal being a struct
-			//TODO will need to convert the Value (which is a string) to the appropriate field, using type for mapping
-			//TODO right now this will only work when the column type is a string
+			//the Value is converted by convertRows(), if configConvertColumnTypes is set
 			if row[columnName] != nil {
 				values = append(values, row[columnName].Value)
 			} else {
@@ -280,6 +437,73 @@ func (dbMan *dbManager) update(tableName string, oldRows, newRows []common.Row,
 
 }
 
+/*
+ * Tables without primary keys, as materialized from JSON or protobuf snapshots without
+ * a current DB version, have their rows matched on all columns of the old row, which
+ * transicator sends in full. A single matching row is deleted or updated.
+ */
+func buildMatchingRowSql(tableName string, oldRow common.Row, first int) (string, []interface{}) {
+	var columns, conditions []string
+	for columnName := range oldRow {
+		columns = append(columns, columnName)
+	}
+	sort.Strings(columns)
+	var values []interface{}
+	for _, columnName := range columns {
+		if oldRow[columnName] == nil || oldRow[columnName].Value == nil {
+			conditions = append(conditions, columnName+" IS NULL")
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("%s=$%d", columnName, first+len(values)))
+		values = append(values, oldRow[columnName].Value)
+	}
+	return "rowid=(SELECT rowid FROM " + normalizeTableName(tableName) + " WHERE " +
+		strings.Join(conditions, " AND ") + " LIMIT 1)", values
+}
+
+func (dbMan *dbManager) deleteMatchingRow(tableName string, oldRow common.Row, txn apid.Tx) error {
+	if len(oldRow) == 0 {
+		return fmt.Errorf("DELETE No primary keys found for table. %s", tableName)
+	}
+	where, values := buildMatchingRowSql(tableName, oldRow, 1)
+	sql := "DELETE FROM " + normalizeTableName(tableName) + " WHERE " + where
+	res, err := txn.Exec(sql, values...)
+	if err != nil {
+		return fmt.Errorf("DELETE Fail %s values=%v error=%v", sql, values, err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		if dbMan.isIdempotent(tableName) {
+			atomic.AddInt64(dbMan.missingDeletes, 1)
+			log.Infof("entry not found %s values=%v, already deleted", sql, values)
+			return nil
+		}
+		return fmt.Errorf("entry not found %s values=%v, nothing to delete", sql, values)
+	}
+	return nil
+}
+
+func (dbMan *dbManager) updateMatchingRow(tableName string, orderedColumns []string, oldRow, newRow common.Row, txn apid.Tx) error {
+	if len(oldRow) == 0 {
+		return fmt.Errorf("UPDATE No primary keys found for table: %v", tableName)
+	}
+	var values []interface{}
+	for _, columnName := range orderedColumns {
+		if newRow[columnName] != nil {
+			values = append(values, newRow[columnName].Value)
+		} else {
+			values = append(values, nil)
+		}
+	}
+	where, whereValues := buildMatchingRowSql(tableName, oldRow, len(values)+1)
+	sql := dbMan.buildUpdateSql(tableName, orderedColumns, newRow, nil) + where
+	values = append(values, whereValues...)
+	if _, err := txn.Exec(sql, values...); err != nil {
+		return fmt.Errorf("UPDATE Fail %s values=%v error=%v", sql, values, err)
+	}
+	log.Debugf("UPDATE Success %s values=%v", sql, values)
+	return nil
+}
+
 func (dbMan *dbManager) buildUpdateSql(tableName string, orderedColumns []string, row common.Row, pkeys []string) string {
 	if row == nil {
 		return ""
@@ -307,7 +531,7 @@ func (dbMan *dbManager) buildUpdateSql(tableName string, orderedColumns []string
 	return sql
 }
 
-//precondition: rows.length > 1000, max number of entities for sqlite
+// builds a multi-row insert, the values of all rows must fit in sqliteMaxVariables, see insert()
 func (dbMan *dbManager) buildInsertSql(tableName string, orderedColumns []string, rows []common.Row) string {
 	if len(rows) == 0 {
 		return ""
@@ -368,6 +592,210 @@ func (dbMan *dbManager) getPkeysForTable(tableName string) ([]string, error) {
 	return columnNames, nil
 }
 
+// returns the typid of each column of the table
+func getColumnTypids(txn apid.Tx, tableName string) (map[string]int64, error) {
+	rows, err := txn.Query("SELECT columnName, typid FROM _transicator_tables WHERE tableName=$1", normalizeTableName(tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	typids := make(map[string]int64)
+	for rows.Next() {
+		var columnName string
+		var typid sql.NullInt64
+		if err = rows.Scan(&columnName, &typid); err != nil {
+			return nil, err
+		}
+		if typid.Valid {
+			typids[columnName] = typid.Int64
+		}
+	}
+	return typids, rows.Err()
+}
+
+/*
+ * With configConvertColumnTypes set, returns copies of the rows with their values converted
+ * by the typid of their columns, see convertColumnValue(). Values that don't convert are kept.
+ */
+func (dbMan *dbManager) convertRows(tableName string, rows []common.Row, txn apid.Tx) ([]common.Row, error) {
+	if !config.GetBool(configConvertColumnTypes) {
+		return rows, nil
+	}
+	typids, err := getColumnTypids(txn, tableName)
+	if err != nil {
+		return nil, err
+	}
+	converted := make([]common.Row, len(rows))
+	for i, row := range rows {
+		if row == nil {
+			continue
+		}
+		converted[i] = make(common.Row, len(row))
+		for columnName, val := range row {
+			if val == nil {
+				converted[i][columnName] = nil
+				continue
+			}
+			cv := *val
+			if typid, ok := typids[columnName]; ok && isConvertedTypid(typid) {
+				if cv.Value, err = convertColumnValue(typid, val.Value); err != nil {
+					log.Warnf("Unable to convert %s.%s, keeping %v: %v", tableName, columnName, val.Value, err)
+					cv.Value = val.Value
+				}
+			}
+			converted[i][columnName] = &cv
+		}
+	}
+	return converted, nil
+}
+
+// the key in _transicator_metadata recording that the values of a data snapshot were converted
+const metadataValuesConverted = "values_converted"
+
+/*
+ * Converts the values of all tables of a data snapshot, see convertRows(), once per DB version.
+ * processSnapshot() runs again for the same DB version on each restart.
+ */
+func convertSnapshotValues(tx apid.Tx) error {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS _transicator_metadata (key varchar primary key, value varchar)"); err != nil {
+		return err
+	}
+	var converted string
+	err := tx.QueryRow("SELECT value FROM _transicator_metadata WHERE key=?", metadataValuesConverted).Scan(&converted)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if err = convertTableValuesOfSnapshot(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO _transicator_metadata (key, value) VALUES (?, ?)", metadataValuesConverted, "true")
+	return err
+}
+
+func convertTableValuesOfSnapshot(tx apid.Tx) error {
+	rows, err := tx.Query("SELECT tableName, columnName, typid FROM _transicator_tables")
+	if err != nil {
+		return err
+	}
+	tables := make(map[string]map[string]int64)
+	for rows.Next() {
+		var tableName, columnName string
+		var typid sql.NullInt64
+		if err = rows.Scan(&tableName, &columnName, &typid); err != nil {
+			rows.Close()
+			return err
+		}
+		if typid.Valid && isConvertedTypid(typid.Int64) {
+			if tables[tableName] == nil {
+				tables[tableName] = make(map[string]int64)
+			}
+			tables[tableName][columnName] = typid.Int64
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// snapshots list tables and columns in _transicator_tables that they don't create
+	for tableName, typids := range tables {
+		tableColumns, err := queryTableColumns(tx, tableName)
+		if err != nil {
+			return err
+		}
+		for columnName := range typids {
+			if !tableColumns[columnName] {
+				log.Debugf("Not converting %s.%s, missing from the snapshot", tableName, columnName)
+				delete(typids, columnName)
+			}
+		}
+		if len(typids) == 0 {
+			continue
+		}
+		if err = convertTableValues(tx, tableName, typids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the columns of the table, none if it doesn't exist
+func queryTableColumns(db queryer, tableName string) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + tableName + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue interface{}
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func convertTableValues(tx apid.Tx, tableName string, typids map[string]int64) error {
+	var columns []string
+	for columnName := range typids {
+		columns = append(columns, columnName)
+	}
+	sort.Strings(columns)
+
+	rows, err := tx.Query("SELECT rowid, " + strings.Join(columns, ",") + " FROM " + tableName)
+	if err != nil {
+		return err
+	}
+	// updates are executed once the rows are read
+	var updates [][]interface{}
+	for rows.Next() {
+		var rowid int64
+		values := make([]interface{}, len(columns))
+		pointers := []interface{}{&rowid}
+		for i := range values {
+			pointers = append(pointers, &values[i])
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			rows.Close()
+			return err
+		}
+		for i, columnName := range columns {
+			converted, err := convertColumnValue(typids[columnName], values[i])
+			if err != nil {
+				log.Warnf("Unable to convert %s.%s, keeping %v: %v", tableName, columnName, values[i], err)
+				continue
+			}
+			values[i] = converted
+		}
+		updates = append(updates, append(values, rowid))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	sql := "UPDATE " + tableName + " SET " + strings.Join(columns, "=?, ") + "=? WHERE rowid=?"
+	prep, err := tx.Prepare(sql)
+	if err != nil {
+		return fmt.Errorf("UPDATE Fail to prep statement %s error=%v", sql, err)
+	}
+	defer prep.Close()
+	for _, values := range updates {
+		if _, err = prep.Exec(values...); err != nil {
+			return fmt.Errorf("UPDATE Fail %s values=%v error=%v", sql, values, err)
+		}
+	}
+	log.Debugf("Converted %d rows of %s", len(updates), tableName)
+	return nil
+}
+
 func normalizeTableName(tableName string) string {
 	return strings.Replace(tableName, ".", "_", 1)
 }
@@ -379,8 +807,16 @@ func normalizeTableName(tableName string) string {
 func (dbMan *dbManager) findScopesForId(configId string) (scopes []string, err error) {
 
 	log.Debugf("findScopesForId: %s", configId)
+	return queryScopes(dbMan.getDB(), configId)
+}
+
+// the Query of apid.DB and apid.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryScopes(db queryer, configId string) (scopes []string, err error) {
 	var scope sql.NullString
-	db := dbMan.getDB()
 	query := `
 		SELECT scope FROM edgex_data_scope WHERE apid_cluster_id = $1
 		UNION
@@ -491,6 +927,9 @@ func (dbMan *dbManager) getApidInstanceInfo() (info apidInstanceInfo, err error)
 		info.InstanceID = util.GenerateUUID()
 
 		_, err = tx.Exec("DELETE FROM APID;")
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM APID_TOKEN;")
+		}
 
 		info.LastSnapshot = ""
 	}
@@ -533,6 +972,33 @@ func (dbMan *dbManager) updateApidInstanceInfo(instanceId, clusterId, lastSnap s
 	return err
 }
 
+// returns "" if no token has been saved for the instance
+func (dbMan *dbManager) getSavedToken(instanceId string) (token string, err error) {
+	// always use default database for this
+	db, err := dataService.DB()
+	if err != nil {
+		return
+	}
+	err = db.QueryRow("SELECT token FROM APID_TOKEN WHERE instance_id=?", instanceId).Scan(&token)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (dbMan *dbManager) saveToken(instanceId, token string) error {
+	// always use default database for this
+	db, err := dataService.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("REPLACE INTO APID_TOKEN (instance_id, token) VALUES (?,?)", instanceId, token)
+	if err != nil {
+		log.Errorf("saveToken: Exec Err: {%v}", err)
+	}
+	return err
+}
+
 func (dbMan *dbManager) extractTables() (map[string]bool, error) {
 	tables := make(map[string]bool)
 	db := dbMan.getDB()
@@ -560,41 +1026,308 @@ func (dbMan *dbManager) getKnowTables() map[string]bool {
 	return dbMan.knownTables
 }
 
+/*
+ * Called after each step of processChangeList: "change" after every applied batch of changes,
+ * "merge" after the data of changed scopes is merged, "sequence" after last_sequence is moved
+ * and "commit" after the commit.
+ * Lets tests stop the process in between, see the crash recovery tests.
+ */
+func (dbMan *dbManager) afterStep(step string) {
+	if dbMan.stepHook != nil {
+		dbMan.stepHook(step)
+	}
+}
+
+/*
+ * Applies the rows of a change list and moves last_sequence to changes.LastSequence
+ * in a single transaction. A crash at any point either keeps the old rows and sequence,
+ * so the change list is fetched and applied again, or commits both.
+ */
 func (dbMan *dbManager) processChangeList(changes *common.ChangeList) error {
+	_, err := dbMan.applyChangeList(changes, false, nil)
+	return err
+}
+
+/*
+ * Like processChangeList, but a change that fails is rolled back on its own and
+ * quarantined in the dead-letter table, in the same transaction.
+ * Returns a copy of the change list with only the applied changes.
+ */
+func (dbMan *dbManager) processChangeListQuarantining(changes *common.ChangeList) (*common.ChangeList, error) {
+	applied, err := dbMan.applyChangeList(changes, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	appliedChanges := *changes
+	appliedChanges.Changes = applied
+	return &appliedChanges, nil
+}
+
+// merge is called after the changes are applied, in the same transaction. Returns the applied changes.
+func (dbMan *dbManager) applyChangeList(changes *common.ChangeList, quarantine bool, merge func(tx apid.Tx) error) (applied []common.Change, err error) {
 
 	tx, err := dbMan.getDB().Begin()
 	if err != nil {
-		return err
+		return
 	}
 	defer tx.Rollback()
 
 	log.Debugf("apigeeSyncEvent: %d changes", len(changes.Changes))
 
-	for _, change := range changes.Changes {
-		if change.Table == LISTENER_TABLE_APID_CLUSTER {
-			return fmt.Errorf("illegal operation: %s for %s", change.Operation, change.Table)
-		}
-		switch change.Operation {
-		case common.Insert:
-			err = dbMan.insert(change.Table, []common.Row{change.NewRow}, tx)
-		case common.Update:
-			if change.Table == LISTENER_TABLE_DATA_SCOPE {
-				return fmt.Errorf("illegal operation: %s for %s", change.Operation, change.Table)
+	if !quarantine {
+		// large change lists, e.g. after an outage, are applied in batches
+		for _, batch := range batchChanges(changes.Changes) {
+			if err = dbMan.applyBatch(batch, tx); err != nil {
+				return
 			}
-			err = dbMan.update(change.Table, []common.Row{change.OldRow}, []common.Row{change.NewRow}, tx)
-		case common.Delete:
-			err = dbMan.delete(change.Table, []common.Row{change.OldRow}, tx)
+			dbMan.afterStep("change")
 		}
-		if err != nil {
-			return err
+		applied = changes.Changes
+	} else {
+		// changes are quarantined one by one
+		for _, change := range changes.Changes {
+			var ok bool
+			if ok, err = dbMan.applyOrQuarantine(changes.LastSequence, change, tx); err != nil {
+				return
+			}
+			if ok {
+				applied = append(applied, change)
+			}
+			dbMan.afterStep("change")
 		}
+	}
 
+	if merge != nil {
+		if err = merge(tx); err != nil {
+			return
+		}
+		dbMan.afterStep("merge")
+	}
+
+	if changes.LastSequence != "" {
+		if _, err = tx.Exec("UPDATE EDGEX_APID_CLUSTER SET last_sequence=?;", changes.LastSequence); err != nil {
+			log.Errorf("UPDATE EDGEX_APID_CLUSTER Failed: %v", err)
+			return
+		}
+		dbMan.afterStep("sequence")
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("Commit error in processChangeList: %v", err)
+		err = fmt.Errorf("Commit error in processChangeList: %v", err)
+		return
 	}
-	return nil
+	dbMan.afterStep("commit")
+	return
+}
+
+func (dbMan *dbManager) applyChange(change common.Change, tx apid.Tx) error {
+	return dbMan.applyBatch([]common.Change{change}, tx)
+}
+
+// applies changes of the same table and operation, and with the same columns, see batchChanges()
+func (dbMan *dbManager) applyBatch(batch []common.Change, tx apid.Tx) (err error) {
+	change := batch[0]
+	if change.Table == LISTENER_TABLE_APID_CLUSTER {
+		return fmt.Errorf("illegal operation: %s for %s", change.Operation, change.Table)
+	}
+	oldRows := make([]common.Row, len(batch))
+	newRows := make([]common.Row, len(batch))
+	for i := range batch {
+		oldRows[i] = batch[i].OldRow
+		newRows[i] = batch[i].NewRow
+	}
+	switch change.Operation {
+	case common.Insert:
+		err = dbMan.insert(change.Table, newRows, tx)
+	case common.Update:
+		if change.Table == LISTENER_TABLE_DATA_SCOPE {
+			return fmt.Errorf("illegal operation: %s for %s", change.Operation, change.Table)
+		}
+		err = dbMan.update(change.Table, oldRows, newRows, tx)
+	case common.Delete:
+		err = dbMan.delete(change.Table, oldRows, tx)
+	}
+	return
+}
+
+/*
+ * Splits the changes into runs of consecutive changes of the same table and operation,
+ * that can be applied together by applyBatch(). Inserts and updates are only batched if
+ * their new rows have the same columns, as the statements are built from the first row.
+ */
+func batchChanges(changes []common.Change) [][]common.Change {
+	var batches [][]common.Change
+	start := 0
+	for i := 1; i <= len(changes); i++ {
+		if i < len(changes) && sameBatch(changes[start], changes[i]) {
+			continue
+		}
+		batches = append(batches, changes[start:i])
+		start = i
+	}
+	return batches
+}
+
+func sameBatch(a, b common.Change) bool {
+	if a.Table != b.Table || a.Operation != b.Operation {
+		return false
+	}
+	if a.Operation == common.Delete {
+		return true
+	}
+	if len(a.NewRow) != len(b.NewRow) {
+		return false
+	}
+	for columnName := range a.NewRow {
+		if _, ok := b.NewRow[columnName]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// returns false if the change failed and was quarantined
+func (dbMan *dbManager) applyOrQuarantine(sequence string, change common.Change, tx apid.Tx) (bool, error) {
+	if _, err := tx.Exec("SAVEPOINT apply_change"); err != nil {
+		return false, err
+	}
+	applyErr := dbMan.applyChange(change, tx)
+	if applyErr == nil {
+		_, err := tx.Exec("RELEASE apply_change")
+		return true, err
+	}
+	log.Warnf("Quarantining change of %s in change list %s: %v", change.Table, sequence, applyErr)
+	if _, err := tx.Exec("ROLLBACK TO apply_change"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("RELEASE apply_change"); err != nil {
+		return false, err
+	}
+	return false, dbMan.insertDeadLetter(sequence, change, applyErr, tx)
+}
+
+/*
+ * The dead-letter table lives in the DB version of the data,
+ * a new snapshot replaces the data and drops the quarantined changes with it.
+ */
+func createDeadLetterTable(tx apid.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CHANGE_DEAD_LETTER (
+	    id integer PRIMARY KEY AUTOINCREMENT,
+	    sequence text,
+	    change text,
+	    error text,
+	    quarantined_at text
+	);
+	`)
+	if err != nil {
+		log.Errorf("Unable to create dead-letter table: %v", err)
+	}
+	return err
+}
+
+func (dbMan *dbManager) insertDeadLetter(sequence string, change common.Change, applyErr error, tx apid.Tx) error {
+	if err := createDeadLetterTable(tx); err != nil {
+		return err
+	}
+	b, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO APID_CHANGE_DEAD_LETTER (sequence, change, error, quarantined_at) VALUES (?,?,?,?)",
+		sequence, string(b), applyErr.Error(), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Errorf("insertDeadLetter: Exec Err: {%v}", err)
+	}
+	return err
+}
+
+func (dbMan *dbManager) getDeadLetters() ([]deadLetter, error) {
+	tx, err := dbMan.getDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err = createDeadLetterTable(tx); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT id, sequence, change, error, quarantined_at FROM APID_CHANGE_DEAD_LETTER ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []deadLetter{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *dl)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return letters, tx.Commit()
+}
+
+func scanDeadLetter(row interface {
+	Scan(dest ...interface{}) error
+}) (*deadLetter, error) {
+	dl := &deadLetter{}
+	var change, quarantinedAt string
+	if err := row.Scan(&dl.Id, &dl.Sequence, &change, &dl.Error, &quarantinedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(change), &dl.Change); err != nil {
+		return nil, fmt.Errorf("corrupt dead letter %d: %v", dl.Id, err)
+	}
+	dl.QuarantinedAt, _ = time.Parse(time.RFC3339, quarantinedAt)
+	return dl, nil
+}
+
+/*
+ * Applies a quarantined change again, and removes it from the dead-letter table on success.
+ * Returns nil, nil if there's no such dead letter. If the change fails again,
+ * the dead letter is returned along with the error, and keeps the new error message.
+ */
+func (dbMan *dbManager) reapplyDeadLetter(id int64) (*deadLetter, error) {
+	db := dbMan.getDB()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err = createDeadLetterTable(tx); err != nil {
+		return nil, err
+	}
+
+	dl, err := scanDeadLetter(tx.QueryRow(
+		"SELECT id, sequence, change, error, quarantined_at FROM APID_CHANGE_DEAD_LETTER WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if applyErr := dbMan.applyChange(dl.Change, tx); applyErr != nil {
+		tx.Rollback()
+		dl.Error = applyErr.Error()
+		if _, err = db.Exec("UPDATE APID_CHANGE_DEAD_LETTER SET error=? WHERE id=?", dl.Error, id); err != nil {
+			log.Errorf("reapplyDeadLetter: Exec Err: {%v}", err)
+		}
+		return dl, applyErr
+	}
+	if _, err = tx.Exec("DELETE FROM APID_CHANGE_DEAD_LETTER WHERE id=?", id); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Errorf("Commit error in reapplyDeadLetter: %v", err)
+		return nil, err
+	}
+	return dl, nil
 }
 
 func (dbMan *dbManager) processSnapshot(snapshot *common.Snapshot, isDataSnapshot bool) error {
@@ -633,6 +1366,12 @@ func (dbMan *dbManager) processSnapshot(snapshot *common.Snapshot, isDataSnapsho
 		return fmt.Errorf("Unable to create last_sequence column on DB.  Error {%v}", err.Error())
 	}
 
+	if isDataSnapshot && config.GetBool(configConvertColumnTypes) {
+		if err = convertSnapshotValues(tx); err != nil {
+			return fmt.Errorf("unable to convert snapshot values: %v", err)
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("error when commit in processSqliteSnapshot: %v", err)
 	}
@@ -651,12 +1390,316 @@ func (dbMan *dbManager) processSnapshot(snapshot *common.Snapshot, isDataSnapsho
 		if err != nil {
 			return fmt.Errorf("unable to extract tables: %v", err)
 		}
+		dbMan.upsertMux.Lock()
+		dbMan.upsertTables = make(map[string]bool)
+		dbMan.upsertMux.Unlock()
 	}
 	log.Debugf("Snapshot processed: %s", snapshot.SnapshotInfo)
 
+	snapshotGc.activate(snapshot.SnapshotInfo)
 	// Releases the DB, when the Connection reference count reaches 0.
 	if prevDb != "" {
 		dataService.ReleaseDB(prevDb)
+		snapshotGc.release(prevDb)
 	}
 	return nil
 }
+
+/*
+ * Adds a table to the current DB version, from a snapshot holding just this table
+ * downloaded as DB version snapshotDbId. Copies its definition, its _transicator_tables
+ * entries and its rows, then releases and removes the table snapshot.
+ */
+func (dbMan *dbManager) processTableSnapshot(snapshotDbId, tableName string) error {
+	return dbMan.mergeSnapshot(snapshotDbId, []string{normalizeTableName(tableName)}, nil)
+}
+
+/*
+ * Returns the data scopes of configId once the changes of the change list to edgex_data_scope
+ * are applied, without applying them.
+ */
+func (dbMan *dbManager) findScopesAfterChangeList(changes *common.ChangeList, configId string) ([]string, error) {
+	var scopeChanges []common.Change
+	for _, change := range changes.Changes {
+		if isDataScopeTable(change.Table) {
+			scopeChanges = append(scopeChanges, change)
+		}
+	}
+	tx, err := dbMan.getDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, batch := range batchChanges(scopeChanges) {
+		if err = dbMan.applyBatch(batch, tx); err != nil {
+			return nil, err
+		}
+	}
+	return queryScopes(tx, configId)
+}
+
+/*
+ * Applies a change list that changed the data scopes. In the same transaction, merges a snapshot
+ * of the added data scopes, downloaded as DB version snapshotDbId, and deletes the rows of the
+ * removed data scopes. snapshotDbId is empty if no scopes were added.
+ * A crash either keeps the old scopes, rows and sequence, or commits all of them.
+ */
+func (dbMan *dbManager) processScopeChangeList(changes *common.ChangeList, snapshotDbId string, removedScopes []string) error {
+	tables, err := readMergedTables(snapshotDbId, nil)
+	if err != nil {
+		return err
+	}
+	_, err = dbMan.applyChangeList(changes, false, func(tx apid.Tx) error {
+		return dbMan.mergeTables(tx, tables, removedScopes)
+	})
+	if err != nil {
+		return err
+	}
+	dbMan.addKnownTables(tables)
+	return nil
+}
+
+// a table read from a partial snapshot
+type snapshotTable struct {
+	name      string
+	createSql string
+	columns   []snapshotColumn
+	rows      []common.Row
+}
+
+type snapshotColumn struct {
+	name       string
+	typid      sql.NullInt64
+	primaryKey sql.NullBool
+}
+
+/*
+ * Copies the tables of the snapshot, all of them if tableNames is nil, into the current
+ * DB version, and deletes the rows of removedScopes, in one transaction. Merged tables are
+ * applied idempotently until the next data snapshot, as changes may overlap the snapshot.
+ */
+func (dbMan *dbManager) mergeSnapshot(snapshotDbId string, tableNames []string, removedScopes []string) error {
+	tables, err := readMergedTables(snapshotDbId, tableNames)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbMan.getDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = dbMan.mergeTables(tx, tables, removedScopes); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Commit error in mergeSnapshot: %v", err)
+	}
+	dbMan.addKnownTables(tables)
+	return nil
+}
+
+// reads the tables of the snapshot, then releases and removes it
+func readMergedTables(snapshotDbId string, tableNames []string) ([]snapshotTable, error) {
+	if snapshotDbId == "" {
+		return nil, nil
+	}
+	defer releaseTableSnapshot(snapshotDbId)
+	snapDb, err := dataService.DBVersion(snapshotDbId)
+	if err != nil {
+		return nil, err
+	}
+	if tableNames == nil {
+		if tableNames, err = readSnapshotTableNames(snapDb); err != nil {
+			return nil, err
+		}
+	}
+	var tables []snapshotTable
+	for _, tableName := range tableNames {
+		table, err := readSnapshotTable(snapDb, tableName)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (dbMan *dbManager) mergeTables(tx apid.Tx, tables []snapshotTable, removedScopes []string) error {
+	if err := deleteScopeRows(tx, removedScopes); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if err := dbMan.copySnapshotTable(tx, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// must be called once the merged tables are committed
+func (dbMan *dbManager) addKnownTables(tables []snapshotTable) {
+	for _, table := range tables {
+		dbMan.knownTables[table.name] = true
+		log.Infof("Merged table %s with %d rows", table.name, len(table.rows))
+	}
+}
+
+// _transicator_tables may list tables the snapshot doesn't have, they are left out
+func readSnapshotTableNames(db apid.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT tableName FROM _transicator_tables
+	WHERE tableName IN (SELECT name FROM sqlite_master WHERE type='table')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tableNames []string
+	for rows.Next() {
+		var tableName string
+		if err = rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+	return tableNames, rows.Err()
+}
+
+func readSnapshotTable(db apid.DB, tableName string) (table snapshotTable, err error) {
+	table.name = tableName
+	err = db.QueryRow("SELECT sql FROM sqlite_master WHERE type='table' AND name=?", tableName).Scan(&table.createSql)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("table %s not found in snapshot", tableName)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	colRows, err := db.Query("SELECT columnName, typid, primaryKey FROM _transicator_tables WHERE tableName=?", tableName)
+	if err != nil {
+		return
+	}
+	defer colRows.Close()
+	for colRows.Next() {
+		var c snapshotColumn
+		if err = colRows.Scan(&c.name, &c.typid, &c.primaryKey); err != nil {
+			return
+		}
+		table.columns = append(table.columns, c)
+	}
+	if err = colRows.Err(); err != nil {
+		return
+	}
+
+	table.rows, err = readTableRows(db, tableName)
+	return
+}
+
+// creates the table if missing, replaces its _transicator_tables entries and upserts its rows
+func (dbMan *dbManager) copySnapshotTable(tx apid.Tx, table snapshotTable) error {
+	var exists int
+	err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table.name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		if _, err = tx.Exec(table.createSql); err != nil {
+			log.Errorf("Unable to create table %s: %v", table.name, err)
+			return err
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM _transicator_tables WHERE tableName=?", table.name); err != nil {
+		return err
+	}
+	for _, c := range table.columns {
+		_, err = tx.Exec("INSERT INTO _transicator_tables (tableName, columnName, typid, primaryKey) VALUES (?,?,?,?)",
+			table.name, c.name, c.typid, c.primaryKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbMan.upsertMux.Lock()
+	dbMan.upsertTables[table.name] = true
+	dbMan.upsertMux.Unlock()
+	for _, row := range table.rows {
+		if err = dbMan.insert(table.name, []common.Row{row}, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes the rows of the data scopes from all tables with a scope column
+func deleteScopeRows(tx apid.Tx, scopes []string) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+	rows, err := tx.Query("SELECT DISTINCT tableName FROM _transicator_tables WHERE columnName='_change_selector'")
+	if err != nil {
+		return err
+	}
+	var tableNames []string
+	for rows.Next() {
+		var tableName string
+		if err = rows.Scan(&tableName); err != nil {
+			rows.Close()
+			return err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(scopes)), ",")
+	args := make([]interface{}, len(scopes))
+	for i, scope := range scopes {
+		args[i] = scope
+	}
+	for _, tableName := range tableNames {
+		res, err := tx.Exec("DELETE FROM "+tableName+" WHERE _change_selector IN ("+placeholders+")", args...)
+		if err != nil {
+			log.Errorf("Unable to delete scopes %v from %s: %v", scopes, tableName, err)
+			return err
+		}
+		n, _ := res.RowsAffected()
+		log.Infof("Deleted %d rows of scopes %v from %s", n, scopes, tableName)
+	}
+	return nil
+}
+
+func readTableRows(db apid.DB, tableName string) ([]common.Row, error) {
+	rows, err := db.Query("SELECT * FROM " + tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result []common.Row
+	for rows.Next() {
+		values := make([]interface{}, len(columnNames))
+		pointers := make([]interface{}, len(columnNames))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := common.Row{}
+		for i, name := range columnNames {
+			row[name] = &common.ColumnVal{Value: values[i]}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func releaseTableSnapshot(snapshotDbId string) {
+	dataService.ReleaseDB(snapshotDbId)
+	removeSnapshotFile(snapshotDbId)
+}
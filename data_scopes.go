@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"github.com/apigee-labs/transicator/common"
+	"sort"
+)
+
+/*
+ * Emitted on ApigeeSyncEventSelector after the change list that added or removed data scopes,
+ * with the data of the added scopes merged and the data of the removed scopes deleted.
+ */
+type ScopeChange struct {
+	// LastSequence of the change list that changed the data scopes
+	Sequence      string   `json:"sequence"`
+	AddedScopes   []string `json:"addedScopes"`
+	RemovedScopes []string `json:"removedScopes"`
+}
+
+// returns the scopes in newScopes but not in scopes, and the other way round
+func diffScopes(newScopes, scopes []string) (added, removed []string) {
+	old := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		old[scope] = true
+	}
+	current := make(map[string]bool, len(newScopes))
+	for _, scope := range newScopes {
+		current[scope] = true
+		if !old[scope] {
+			added = append(added, scope)
+		}
+	}
+	for _, scope := range scopes {
+		if !current[scope] {
+			removed = append(removed, scope)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+func changesDataScopes(cl *common.ChangeList) bool {
+	for _, change := range cl.Changes {
+		if isDataScopeTable(change.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDataScopeTable(tableName string) bool {
+	return normalizeTableName(tableName) == normalizeTableName(LISTENER_TABLE_DATA_SCOPE)
+}
+
+/*
+ * Applies the change list. If it changes the data scopes, brings the data in line in the same
+ * transaction: merges a snapshot of the added scopes and deletes the rows of the removed ones.
+ * Returns nil for the ScopeChange if the scopes didn't change. Falls back to a new data snapshot
+ * if incremental scopes are disabled, or the partial snapshot can't be downloaded.
+ */
+func (c *pollChangeManager) processChangeList(scopes []string, cl *common.ChangeList) (*ScopeChange, error) {
+	if !changesDataScopes(cl) {
+		return nil, c.dbMan.processChangeList(cl)
+	}
+	newScopes, err := c.dbMan.findScopesAfterChangeList(cl, apidInfo.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	added, removed := diffScopes(newScopes, scopes)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil, c.dbMan.processChangeList(cl)
+	}
+	if !config.GetBool(configIncrementalScopes) {
+		return nil, scopeChanged(newScopes, scopes)
+	}
+	log.Infof("Data scopes changed, added: %v, removed: %v", added, removed)
+
+	snapshotDbId := ""
+	if len(added) > 0 {
+		if snapshotDbId, err = c.snapMan.downloadScopeSnapshot(added); err != nil {
+			log.Errorf("Unable to download snapshot of scopes %v: %v", added, err)
+			return nil, scopeChanged(newScopes, scopes)
+		}
+	}
+	if err = c.dbMan.processScopeChangeList(cl, snapshotDbId, removed); err != nil {
+		log.Errorf("Unable to change scopes: %v", err)
+		return nil, err
+	}
+	return &ScopeChange{
+		Sequence:      cl.LastSequence,
+		AddedScopes:   added,
+		RemovedScopes: removed,
+	}, nil
+}
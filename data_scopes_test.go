@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"fmt"
+	"github.com/apid/apid-core"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("data scope changes", func() {
+	var dummyDbMan *dummyDbManager
+	var dummySnapMan *dummySnapshotManager
+	var testChangeMan *pollChangeManager
+
+	changeList := &common.ChangeList{
+		LastSequence: "3.3.3",
+		Changes: []common.Change{{
+			Table:     "edgex.data_scope",
+			Operation: common.Insert,
+		}},
+	}
+
+	BeforeEach(func() {
+		dummyDbMan = &dummyDbManager{
+			knownTables:    map[string]bool{"edgex_data_scope": true},
+			scopes:         []string{"s1", "s3"},
+			lastSeqUpdated: make(chan string, 1),
+		}
+		dummySnapMan = &dummySnapshotManager{}
+		dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+		client := &http.Client{}
+		testChangeMan = createChangeManager(dummyDbMan, dummySnapMan, dummyTokenMan, createStatusReporter(dummyTokenMan, client), client)
+	})
+
+	AfterEach(func() {
+		config.Set(configIncrementalScopes, true)
+	})
+
+	It("should diff scopes", func() {
+		added, removed := diffScopes([]string{"s3", "s1", "s4"}, []string{"s2", "s1"})
+		Expect(added).Should(Equal([]string{"s3", "s4"}))
+		Expect(removed).Should(Equal([]string{"s2"}))
+		added, removed = diffScopes([]string{"s1"}, []string{"s1"})
+		Expect(added).Should(BeEmpty())
+		Expect(removed).Should(BeEmpty())
+	})
+
+	It("should merge added scopes and delete removed ones", func() {
+		scopeChanges := make(chan *ScopeChange, 1)
+		handler := func(event apid.Event) {
+			if sc, ok := event.(*ScopeChange); ok {
+				// the handler stays registered for the other specs
+				select {
+				case scopeChanges <- sc:
+				default:
+				}
+			}
+		}
+		eventService.ListenFunc(ApigeeSyncEventSelector, handler)
+
+		Expect(testChangeMan.emitChangeList([]string{"s1", "s2"}, changeList)).Should(Succeed())
+		Expect(dummySnapMan.scopeSnapshots).Should(Equal([][]string{{"s3"}}))
+		Expect(dummyDbMan.removedScopes).Should(Equal([]string{"s2"}))
+		Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+		Eventually(scopeChanges).Should(Receive(Equal(&ScopeChange{
+			Sequence:      "3.3.3",
+			AddedScopes:   []string{"s3"},
+			RemovedScopes: []string{"s2"},
+		})))
+	})
+
+	It("should only delete removed scopes", func() {
+		Expect(testChangeMan.emitChangeList([]string{"s1", "s2", "s3"}, changeList)).Should(Succeed())
+		Expect(dummySnapMan.scopeSnapshots).Should(BeEmpty())
+		Expect(dummyDbMan.removedScopes).Should(Equal([]string{"s2"}))
+	})
+
+	It("should apply the change list alone if the scopes didn't change", func() {
+		Expect(testChangeMan.emitChangeList([]string{"s1", "s3"}, changeList)).Should(Succeed())
+		Expect(dummySnapMan.scopeSnapshots).Should(BeEmpty())
+		Expect(dummyDbMan.removedScopes).Should(BeEmpty())
+		Expect(dummyDbMan.lastSeqUpdated).Should(Receive(Equal("3.3.3")))
+	})
+
+	It("should get a new snapshot if the scope snapshot fails", func() {
+		dummySnapMan.scopeSnapshotErr = fmt.Errorf("comm error")
+		err := testChangeMan.emitChangeList([]string{"s1"}, changeList)
+		Expect(err).Should(Equal(changeServerError{Code: "Scope changes detected; must get new snapshot"}))
+		Expect(dummyDbMan.removedScopes).Should(BeEmpty())
+		Expect(dummyDbMan.lastSeqUpdated).ShouldNot(Receive())
+	})
+
+	It("should get a new snapshot if incremental scopes are disabled", func() {
+		config.Set(configIncrementalScopes, false)
+		err := testChangeMan.emitChangeList([]string{"s1"}, changeList)
+		Expect(err).Should(Equal(changeServerError{Code: "Scope changes detected; must get new snapshot"}))
+		Expect(dummySnapMan.scopeSnapshots).Should(BeEmpty())
+		Expect(dummyDbMan.lastSeqUpdated).ShouldNot(Receive())
+	})
+
+	It("should get a new snapshot for failing scope changes whatever the policy", func() {
+		config.Set(configChangeFailureRetries, 1)
+		defer config.Set(configChangeFailurePolicy, changeFailurePolicyRetry)
+		defer config.Set(configChangeFailureRetries, 3)
+		dummyDbMan.processErr = fmt.Errorf("failed")
+		for _, policy := range []string{changeFailurePolicyRetry, changeFailurePolicyDeadLetter} {
+			config.Set(configChangeFailurePolicy, policy)
+			Expect(testChangeMan.emitChangeList([]string{"s1"}, changeList)).Should(MatchError("failed"))
+			err := testChangeMan.emitChangeList([]string{"s1"}, changeList)
+			Expect(err).Should(Equal(changeServerError{Code: "Unable to apply changes; must get new snapshot"}))
+		}
+		Expect(dummyDbMan.quarantined).Should(BeEmpty())
+	})
+})
@@ -17,10 +17,14 @@ package apidApigeeSync
 import (
 	"database/sql"
 	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
 	"github.com/apigee-labs/transicator/common"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
 	"sort"
 	"strconv"
 )
@@ -1362,6 +1366,710 @@ var _ = Describe("data access tests", func() {
 
 	})
 
+	Context("crash recovery", func() {
+		const (
+			crashStepEnv    = "APIGEESYNC_TEST_CRASH_STEP"
+			crashDirEnv     = "APIGEESYNC_TEST_CRASH_DIR"
+			crashVersionEnv = "APIGEESYNC_TEST_CRASH_DB_VERSION"
+			crashExitCode   = 17
+		)
+
+		changeList := func() *common.ChangeList {
+			row := func(id string) common.Row {
+				return common.Row{
+					"id":               &common.ColumnVal{Value: id},
+					"tenant_id":        &common.ColumnVal{Value: "t"},
+					"created_at":       &common.ColumnVal{Value: "c"},
+					"updated_at":       &common.ColumnVal{Value: "u"},
+					"_change_selector": &common.ColumnVal{Value: "cs"},
+				}
+			}
+			return &common.ChangeList{
+				FirstSequence: "1.1.1",
+				LastSequence:  "2.2.2",
+				Changes: []common.Change{
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a")},
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b")},
+				},
+			}
+		}
+
+		countRows := func() (n int) {
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM kms_api_product").Scan(&n)).Should(Succeed())
+			return
+		}
+
+		// runs in a child process started by the specs below, and exits in the middle of processChangeList()
+		It("child process applying a change list", func() {
+			step := os.Getenv(crashStepEnv)
+			if step == "" {
+				Skip("only run by the crash recovery specs")
+			}
+			config.Set(configLocalStoragePath, os.Getenv(crashDirEnv))
+			db, err := dataService.DBVersion(os.Getenv(crashVersionEnv))
+			Expect(err).Should(Succeed())
+			testDbMan.setDB(db)
+			testDbMan.stepHook = func(s string) {
+				if s == step {
+					os.Exit(crashExitCode)
+				}
+			}
+			if step == "merge" {
+				Expect(testDbMan.processScopeChangeList(changeList(), "", []string{"s9"})).Should(Succeed())
+			} else {
+				Expect(testDbMan.processChangeList(changeList())).Should(Succeed())
+			}
+			Fail("child process didn't exit at step " + step)
+		})
+
+		for _, testCase := range []struct {
+			step      string
+			committed bool
+		}{
+			{"change", false},
+			{"merge", false},
+			{"sequence", false},
+			{"commit", true},
+		} {
+			testCase := testCase
+			It("should keep rows and last_sequence consistent if killed after step "+testCase.step, func() {
+				createBootstrapTables(testDbMan.getDB())
+				Expect(testDbMan.updateLastSequence("1.1.1")).Should(Succeed())
+
+				testDir := config.GetString(configLocalStoragePath)
+				cmd := exec.Command(os.Args[0], "-ginkgo.focus="+regexp.QuoteMeta("crash recovery child process applying a change list"))
+				cmd.Env = append(os.Environ(),
+					crashStepEnv+"="+testCase.step,
+					crashDirEnv+"="+testDir,
+					crashVersionEnv+"="+dbVersion,
+					// the child can't clean up its temp dir
+					"TMPDIR="+testDir,
+				)
+				out, err := cmd.CombinedOutput()
+				Expect(err).Should(MatchError("exit status "+strconv.Itoa(crashExitCode)), string(out))
+
+				if testCase.committed {
+					Expect(testDbMan.getLastSequence()).Should(Equal("2.2.2"))
+					Expect(countRows()).Should(Equal(2))
+					// the change manager won't apply it again
+					Expect(getChangeStatus(testDbMan.getLastSequence(), changeList().LastSequence)).ShouldNot(Equal(1))
+					return
+				}
+
+				Expect(testDbMan.getLastSequence()).Should(Equal("1.1.1"))
+				Expect(countRows()).Should(BeZero())
+				// after a restart the change list is fetched and applied again
+				Expect(testDbMan.processChangeList(changeList())).Should(Succeed())
+				Expect(testDbMan.getLastSequence()).Should(Equal("2.2.2"))
+				Expect(countRows()).Should(Equal(2))
+			}, 10)
+		}
+
+		It("should not move last_sequence if the change list fails", func() {
+			createBootstrapTables(testDbMan.getDB())
+			Expect(testDbMan.updateLastSequence("1.1.1")).Should(Succeed())
+			cl := changeList()
+			cl.Changes = append(cl.Changes, common.Change{
+				Table:     "kms.api_product",
+				Operation: common.Insert,
+				NewRow:    cl.Changes[0].NewRow,
+			})
+			Expect(testDbMan.processChangeList(cl)).ShouldNot(Succeed())
+			Expect(testDbMan.getLastSequence()).Should(Equal("1.1.1"))
+			Expect(countRows()).Should(BeZero())
+		})
+	})
+
+	Context("idempotent apply", func() {
+		row := func(id, description string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: id},
+				"tenant_id":        &common.ColumnVal{Value: "t"},
+				"description":      &common.ColumnVal{Value: description},
+				"created_at":       &common.ColumnVal{Value: "c"},
+				"updated_at":       &common.ColumnVal{Value: "u"},
+				"_change_selector": &common.ColumnVal{Value: "cs"},
+			}
+		}
+
+		changeList := &common.ChangeList{
+			LastSequence: "2.2.2",
+			Changes: []common.Change{
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", "first")},
+				{Table: "kms.api_product", Operation: common.Delete, OldRow: row("b", "first")},
+			},
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b", "first")}},
+			})).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			config.Set(configIdempotentApply, false)
+		})
+
+		It("should fail to replay a change list by default", func() {
+			Expect(testDbMan.processChangeList(changeList)).Should(Succeed())
+			Expect(testDbMan.processChangeList(changeList)).ShouldNot(Succeed())
+			Expect(testDbMan.getApplyMetrics()).Should(BeZero())
+		})
+
+		It("should replay a change list", func() {
+			config.Set(configIdempotentApply, true)
+			Expect(testDbMan.processChangeList(changeList)).Should(Succeed())
+			Expect(testDbMan.getApplyMetrics()).Should(BeZero())
+
+			Expect(testDbMan.processChangeList(changeList)).Should(Succeed())
+			Expect(testDbMan.getLastSequence()).Should(Equal("2.2.2"))
+			var ids []string
+			rows, err := testDbMan.getDB().Query("SELECT id FROM kms_api_product")
+			Expect(err).Should(Succeed())
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				Expect(rows.Scan(&id)).Should(Succeed())
+				ids = append(ids, id)
+			}
+			Expect(ids).Should(Equal([]string{"a"}))
+			Expect(testDbMan.getApplyMetrics()).Should(Equal(applyMetrics{ReplacedInserts: 1, MissingDeletes: 1}))
+		})
+
+		It("should replace rows with the same primary keys", func() {
+			config.Set(configIdempotentApply, true)
+			for _, description := range []string{"first", "second"} {
+				Expect(testDbMan.processChangeList(&common.ChangeList{
+					Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", description)}},
+				})).Should(Succeed())
+			}
+			var description string
+			Expect(testDbMan.getDB().QueryRow("SELECT description FROM kms_api_product WHERE id='a'").
+				Scan(&description)).Should(Succeed())
+			Expect(description).Should(Equal("second"))
+			Expect(testDbMan.getApplyMetrics().ReplacedInserts).Should(Equal(int64(1)))
+		})
+	})
+
+	Context("tables without primary keys", func() {
+		row := func(id, name interface{}) common.Row {
+			return common.Row{
+				"id":   &common.ColumnVal{Value: id},
+				"name": &common.ColumnVal{Value: name},
+			}
+		}
+
+		rowsOf := func() []string {
+			var result []string
+			rows, err := testDbMan.getDB().Query("SELECT id, ifnull(name, 'NULL') FROM kms_keyless ORDER BY id, name")
+			Expect(err).Should(Succeed())
+			defer rows.Close()
+			for rows.Next() {
+				var id, name string
+				Expect(rows.Scan(&id, &name)).Should(Succeed())
+				result = append(result, id+"="+name)
+			}
+			return result
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			// as materialized from a JSON snapshot without a current DB version
+			_, err := testDbMan.getDB().Exec(`
+			CREATE TABLE kms_keyless (id text, name text);
+			INSERT INTO "_transicator_tables" VALUES('kms_keyless','id',1043,0);
+			INSERT INTO "_transicator_tables" VALUES('kms_keyless','name',1043,0);
+			`)
+			Expect(err).Should(Succeed())
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{
+					{Table: "kms.keyless", Operation: common.Insert, NewRow: row("a", "x")},
+					{Table: "kms.keyless", Operation: common.Insert, NewRow: row("a", "x")},
+					{Table: "kms.keyless", Operation: common.Insert, NewRow: row("b", nil)},
+				},
+			})).Should(Succeed())
+		})
+
+		It("should update and delete a row matching all columns of the old row", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{
+					{Table: "kms.keyless", Operation: common.Update, OldRow: row("a", "x"), NewRow: row("a", "y")},
+					{Table: "kms.keyless", Operation: common.Update, OldRow: row("b", nil), NewRow: row("b", "z")},
+					{Table: "kms.keyless", Operation: common.Delete, OldRow: row("a", "x")},
+				},
+			})).Should(Succeed())
+			Expect(rowsOf()).Should(Equal([]string{"a=y", "b=z"}))
+		})
+
+		It("should fail to delete a row that doesn't exist", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.keyless", Operation: common.Delete, OldRow: row("a", "y")}},
+			})).ShouldNot(Succeed())
+			Expect(rowsOf()).Should(Equal([]string{"a=x", "a=x", "b=NULL"}))
+		})
+	})
+
+	Context("dead letters", func() {
+		row := func(id string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: id},
+				"tenant_id":        &common.ColumnVal{Value: "t"},
+				"created_at":       &common.ColumnVal{Value: "c"},
+				"updated_at":       &common.ColumnVal{Value: "u"},
+				"_change_selector": &common.ColumnVal{Value: "cs"},
+			}
+		}
+
+		countRows := func() (n int) {
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM kms_api_product").Scan(&n)).Should(Succeed())
+			return
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			Expect(testDbMan.updateLastSequence("1.1.1")).Should(Succeed())
+			// the row deleted below doesn't exist yet
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a")}},
+			})).Should(Succeed())
+		})
+
+		changeList := &common.ChangeList{
+			LastSequence: "2.2.2",
+			Changes: []common.Change{
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a")},
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b")},
+				{Table: LISTENER_TABLE_DATA_SCOPE, Operation: common.Update},
+			},
+		}
+
+		It("should quarantine failing changes and apply the rest", func() {
+			Expect(testDbMan.processChangeList(changeList)).ShouldNot(Succeed())
+			Expect(testDbMan.getLastSequence()).Should(Equal("1.1.1"))
+
+			applied, err := testDbMan.processChangeListQuarantining(changeList)
+			Expect(err).Should(Succeed())
+			Expect(applied.LastSequence).Should(Equal("2.2.2"))
+			Expect(applied.Changes).Should(Equal(changeList.Changes[1:2]))
+			Expect(testDbMan.getLastSequence()).Should(Equal("2.2.2"))
+			Expect(countRows()).Should(Equal(2))
+
+			letters, err := testDbMan.getDeadLetters()
+			Expect(err).Should(Succeed())
+			Expect(letters).Should(HaveLen(2))
+			Expect(letters[0].Sequence).Should(Equal("2.2.2"))
+			Expect(letters[0].Change.Operation).Should(Equal(common.Insert))
+			Expect(letters[0].Change.NewRow["id"].Value).Should(Equal("a"))
+			Expect(letters[0].Error).ShouldNot(BeEmpty())
+			Expect(letters[0].QuarantinedAt).ShouldNot(BeZero())
+			Expect(letters[1].Change.Operation).Should(Equal(common.Update))
+		})
+
+		It("should list no dead letters for a new DB", func() {
+			letters, err := testDbMan.getDeadLetters()
+			Expect(err).Should(Succeed())
+			Expect(letters).Should(BeEmpty())
+		})
+
+		It("should reapply dead letters", func() {
+			_, err := testDbMan.processChangeListQuarantining(changeList)
+			Expect(err).Should(Succeed())
+			letters, err := testDbMan.getDeadLetters()
+			Expect(err).Should(Succeed())
+
+			// still failing
+			dl, err := testDbMan.reapplyDeadLetter(letters[0].Id)
+			Expect(err).ShouldNot(Succeed())
+			Expect(dl.Id).Should(Equal(letters[0].Id))
+			Expect(dl.Error).Should(Equal(err.Error()))
+
+			// fixed by deleting the conflicting row
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Delete, OldRow: row("a")}},
+			})).Should(Succeed())
+			dl, err = testDbMan.reapplyDeadLetter(letters[0].Id)
+			Expect(err).Should(Succeed())
+			Expect(dl.Change.NewRow["id"].Value).Should(Equal("a"))
+			Expect(countRows()).Should(Equal(2))
+
+			remaining, err := testDbMan.getDeadLetters()
+			Expect(err).Should(Succeed())
+			Expect(remaining).Should(Equal(letters[1:]))
+
+			dl, err = testDbMan.reapplyDeadLetter(letters[0].Id)
+			Expect(err).Should(Succeed())
+			Expect(dl).Should(BeNil())
+		})
+	})
+
+	Context("table snapshots", func() {
+		var snapshotDbId string
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			snapshotDbId = tableSnapshotPrefix + "kms_widget_" + strconv.Itoa(testCount)
+			snapDb, err := dataService.DBVersion(snapshotDbId)
+			Expect(err).Should(Succeed())
+			_, err = snapDb.Exec(`
+			CREATE TABLE _transicator_tables
+			(tableName varchar not null, columnName varchar not null, typid integer, primaryKey bool);
+			INSERT INTO "_transicator_tables" VALUES('kms_widget','id',1043,1);
+			INSERT INTO "_transicator_tables" VALUES('kms_widget','name',1043,0);
+			INSERT INTO "_transicator_tables" VALUES('kms_widget','_change_selector',1043,0);
+			CREATE TABLE "kms_widget" (id text,name text,_change_selector text, primary key (id));
+			INSERT INTO "kms_widget" VALUES('w1','first','cs');
+			INSERT INTO "kms_widget" VALUES('w2','second','cs');
+			`)
+			Expect(err).Should(Succeed())
+		})
+
+		It("should add a table from its snapshot", func() {
+			Expect(testDbMan.processTableSnapshot(snapshotDbId, "kms.widget")).Should(Succeed())
+			Expect(testDbMan.getKnowTables()["kms_widget"]).Should(BeTrue())
+
+			var count int
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM _transicator_tables WHERE tableName='kms_widget'").
+				Scan(&count)).Should(Succeed())
+			Expect(count).Should(Equal(3))
+			var name string
+			Expect(testDbMan.getDB().QueryRow("SELECT name FROM kms_widget WHERE id='w2'").
+				Scan(&name)).Should(Succeed())
+			Expect(name).Should(Equal("second"))
+
+			// the table snapshot is removed
+			dbPath := data.DBPath("common/" + snapshotDbId)
+			_, err := os.Stat(dbPath)
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("should apply changes overlapping the table snapshot", func() {
+			Expect(testDbMan.processTableSnapshot(snapshotDbId, "kms.widget")).Should(Succeed())
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{
+					Table:     "kms.widget",
+					Operation: common.Insert,
+					NewRow: common.Row{
+						"id":               &common.ColumnVal{Value: "w1"},
+						"name":             &common.ColumnVal{Value: "changed"},
+						"_change_selector": &common.ColumnVal{Value: "cs"},
+					},
+				}},
+			})).Should(Succeed())
+			var name string
+			Expect(testDbMan.getDB().QueryRow("SELECT name FROM kms_widget WHERE id='w1'").
+				Scan(&name)).Should(Succeed())
+			Expect(name).Should(Equal("changed"))
+		})
+
+		It("should fail if the table isn't in the snapshot", func() {
+			Expect(testDbMan.processTableSnapshot(snapshotDbId, "kms.gadget")).ShouldNot(Succeed())
+			Expect(testDbMan.getKnowTables()["kms_gadget"]).Should(BeFalse())
+		})
+	})
+
+	Context("bulk apply", func() {
+		row := func(id, description string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: id},
+				"tenant_id":        &common.ColumnVal{Value: "t"},
+				"description":      &common.ColumnVal{Value: description},
+				"created_at":       &common.ColumnVal{Value: "c"},
+				"updated_at":       &common.ColumnVal{Value: "u"},
+				"_change_selector": &common.ColumnVal{Value: "cs"},
+			}
+		}
+
+		// a change list after an outage
+		largeChangeList := func(n int) *common.ChangeList {
+			cl := &common.ChangeList{LastSequence: "9.9.9"}
+			for i := 0; i < n; i++ {
+				cl.Changes = append(cl.Changes, common.Change{
+					Table:     "kms.api_product",
+					Operation: common.Insert,
+					NewRow:    row(strconv.Itoa(i), "d"),
+				})
+			}
+			return cl
+		}
+
+		countProducts := func() (count int) {
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM kms_api_product").Scan(&count)).Should(Succeed())
+			return
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+		})
+
+		It("should batch consecutive changes of the same table, operation and columns", func() {
+			withoutDescription := row("c", "")
+			delete(withoutDescription, "description")
+			changes := []common.Change{
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", "")},
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b", "")},
+				{Table: "kms.api_product", Operation: common.Insert, NewRow: withoutDescription},
+				{Table: "kms.api_product", Operation: common.Update, OldRow: row("a", ""), NewRow: row("a", "x")},
+				{Table: "kms.api_product", Operation: common.Delete, OldRow: row("a", "")},
+				{Table: "kms.api_product", Operation: common.Delete, OldRow: withoutDescription},
+				{Table: "edgex.data_scope", Operation: common.Delete, OldRow: row("a", "")},
+			}
+			var sizes []int
+			for _, batch := range batchChanges(changes) {
+				sizes = append(sizes, len(batch))
+			}
+			Expect(sizes).Should(Equal([]int{2, 1, 1, 2, 1}))
+			Expect(batchChanges(nil)).Should(BeEmpty())
+		})
+
+		It("should apply inserts exceeding the SQLite variable limit", func() {
+			Expect(testDbMan.processChangeList(largeChangeList(2500))).Should(Succeed())
+			Expect(countProducts()).Should(Equal(2500))
+			Expect(testDbMan.getLastSequence()).Should(Equal("9.9.9"))
+		})
+
+		It("should apply batches in order", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", "first")},
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b", "first")},
+					{Table: "kms.api_product", Operation: common.Delete, OldRow: row("a", "first")},
+					{Table: "kms.api_product", Operation: common.Delete, OldRow: row("b", "first")},
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", "second")},
+					{Table: "kms.api_product", Operation: common.Update, OldRow: row("a", "second"), NewRow: row("a", "third")},
+				},
+			})).Should(Succeed())
+			var description string
+			Expect(testDbMan.getDB().QueryRow("SELECT description FROM kms_api_product").Scan(&description)).Should(Succeed())
+			Expect(description).Should(Equal("third"))
+			Expect(countProducts()).Should(Equal(1))
+		})
+
+		It("should roll back all batches if one fails", func() {
+			cl := largeChangeList(1500)
+			cl.Changes = append(cl.Changes, common.Change{
+				Table: "kms.api_product", Operation: common.Delete, OldRow: row("missing", ""),
+			})
+			Expect(testDbMan.processChangeList(cl)).ShouldNot(Succeed())
+			Expect(countProducts()).Should(BeZero())
+		})
+
+		Measure("applying a large change list", func(b Benchmarker) {
+			cl := largeChangeList(10000)
+			b.Time("in batches", func() {
+				Expect(testDbMan.processChangeList(cl)).Should(Succeed())
+			})
+			_, err := testDbMan.getDB().Exec("DELETE FROM kms_api_product")
+			Expect(err).Should(Succeed())
+
+			// a statement per change, as before changes were batched
+			b.Time("one by one", func() {
+				tx, err := testDbMan.getDB().Begin()
+				Expect(err).Should(Succeed())
+				defer tx.Rollback()
+				for _, change := range cl.Changes {
+					switch change.Operation {
+					case common.Insert:
+						err = testDbMan.insert(change.Table, []common.Row{change.NewRow}, tx)
+					case common.Update:
+						err = testDbMan.update(change.Table, []common.Row{change.OldRow}, []common.Row{change.NewRow}, tx)
+					case common.Delete:
+						err = testDbMan.delete(change.Table, []common.Row{change.OldRow}, tx)
+					}
+					Expect(err).Should(Succeed())
+				}
+				Expect(tx.Commit()).Should(Succeed())
+			})
+			Expect(countProducts()).Should(Equal(10000))
+		}, 3)
+	})
+
+	Context("column type conversion", func() {
+		row := func(createdAt string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: "a"},
+				"tenant_id":        &common.ColumnVal{Value: "t"},
+				"quota_interval":   &common.ColumnVal{Value: "5"},
+				"api_resources":    &common.ColumnVal{Value: "{/a,/b}"},
+				"created_at":       &common.ColumnVal{Value: createdAt},
+				"updated_at":       &common.ColumnVal{Value: "2017-08-23 17:23:00"},
+				"_change_selector": &common.ColumnVal{Value: "cs"},
+			}
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			config.Set(configConvertColumnTypes, true)
+		})
+
+		AfterEach(func() {
+			config.Set(configConvertColumnTypes, false)
+		})
+
+		It("should convert values of changes", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("2017-08-23 19:23:00+02")}},
+			})).Should(Succeed())
+			var quotaType, apiResources, createdAt string
+			var quotaInterval int64
+			Expect(testDbMan.getDB().QueryRow("SELECT typeof(quota_interval), quota_interval, api_resources, created_at FROM kms_api_product").
+				Scan(&quotaType, &quotaInterval, &apiResources, &createdAt)).Should(Succeed())
+			Expect(quotaType).Should(Equal("integer"))
+			Expect(quotaInterval).Should(Equal(int64(5)))
+			Expect(apiResources).Should(Equal(`["/a","/b"]`))
+			Expect(createdAt).Should(Equal("2017-08-23T17:23:00Z"))
+
+			// primary keys match whatever format they are sent in
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Delete, OldRow: row("2017-08-23T17:23:00Z")}},
+			})).Should(Succeed())
+			var count int
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM kms_api_product").Scan(&count)).Should(Succeed())
+			Expect(count).Should(BeZero())
+		})
+
+		It("should keep values that don't convert", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("c")}},
+			})).Should(Succeed())
+			var createdAt string
+			Expect(testDbMan.getDB().QueryRow("SELECT created_at FROM kms_api_product").Scan(&createdAt)).Should(Succeed())
+			Expect(createdAt).Should(Equal("c"))
+		})
+
+	})
+
+	Context("scope snapshots", func() {
+		row := func(id, scope string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: id},
+				"tenant_id":        &common.ColumnVal{Value: "t"},
+				"created_at":       &common.ColumnVal{Value: "c"},
+				"updated_at":       &common.ColumnVal{Value: "u"},
+				"_change_selector": &common.ColumnVal{Value: scope},
+			}
+		}
+
+		productIds := func() []string {
+			var ids []string
+			rows, err := testDbMan.getDB().Query("SELECT id FROM kms_api_product ORDER BY id")
+			Expect(err).Should(Succeed())
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				Expect(rows.Scan(&id)).Should(Succeed())
+				ids = append(ids, id)
+			}
+			return ids
+		}
+
+		BeforeEach(func() {
+			createBootstrapTables(testDbMan.getDB())
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("a", "s1")},
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("b", "s2")},
+				},
+			})).Should(Succeed())
+		})
+
+		It("should delete the rows of removed scopes", func() {
+			Expect(testDbMan.processScopeChangeList(&common.ChangeList{}, "", []string{"s2", "s9"})).Should(Succeed())
+			Expect(productIds()).Should(Equal([]string{"a"}))
+			var count int
+			Expect(testDbMan.getDB().QueryRow("SELECT count(*) FROM edgex_apid_cluster").Scan(&count)).Should(Succeed())
+			Expect(count).Should(Equal(1))
+		})
+
+		It("should merge the snapshot of added scopes", func() {
+			snapshotDbId := scopeSnapshotName
+			snapDb, err := dataService.DBVersion(snapshotDbId)
+			Expect(err).Should(Succeed())
+			createBootstrapTables(snapDb)
+			_, err = snapDb.Exec(`
+			DELETE FROM edgex_apid_cluster;
+			INSERT INTO "_transicator_tables" VALUES('kms_widget','id',1043,1);
+			INSERT INTO "_transicator_tables" VALUES('kms_widget','_change_selector',1043,0);
+			INSERT INTO "_transicator_tables" VALUES('kms_gadget','id',1043,1);
+			CREATE TABLE "kms_widget" (id text,_change_selector text, primary key (id));
+			INSERT INTO "kms_widget" VALUES('w1','s3');
+			INSERT INTO "kms_api_product" (id,tenant_id,created_at,updated_at,_change_selector) VALUES('c','t','c','u','s3');
+			`)
+			Expect(err).Should(Succeed())
+
+			Expect(testDbMan.processScopeChangeList(&common.ChangeList{}, snapshotDbId, []string{"s2"})).Should(Succeed())
+			Expect(productIds()).Should(Equal([]string{"a", "c"}))
+			Expect(testDbMan.getKnowTables()["kms_widget"]).Should(BeTrue())
+			// listed in _transicator_tables only
+			Expect(testDbMan.getKnowTables()["kms_gadget"]).Should(BeFalse())
+			var scope string
+			Expect(testDbMan.getDB().QueryRow("SELECT _change_selector FROM kms_widget WHERE id='w1'").
+				Scan(&scope)).Should(Succeed())
+			Expect(scope).Should(Equal("s3"))
+
+			// changes overlapping the snapshot still apply
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "kms.api_product", Operation: common.Insert, NewRow: row("c", "s3")}},
+			})).Should(Succeed())
+		})
+
+		scopeRow := func(id, scope string) common.Row {
+			return common.Row{
+				"id":               &common.ColumnVal{Value: id},
+				"apid_cluster_id":  &common.ColumnVal{Value: "i"},
+				"scope":            &common.ColumnVal{Value: scope},
+				"org":              &common.ColumnVal{Value: "o"},
+				"env":              &common.ColumnVal{Value: "e"},
+				"_change_selector": &common.ColumnVal{Value: "i"},
+			}
+		}
+
+		It("should find the scopes after a change list without applying it", func() {
+			Expect(testDbMan.processChangeList(&common.ChangeList{
+				Changes: []common.Change{{Table: "edgex.data_scope", Operation: common.Insert, NewRow: scopeRow("d1", "s1")}},
+			})).Should(Succeed())
+			scopes, err := testDbMan.findScopesAfterChangeList(&common.ChangeList{
+				Changes: []common.Change{
+					{Table: "kms.api_product", Operation: common.Insert, NewRow: row("c", "s3")},
+					{Table: "edgex.data_scope", Operation: common.Insert, NewRow: scopeRow("d3", "s3")},
+					{Table: "edgex.data_scope", Operation: common.Delete, OldRow: scopeRow("d1", "s1")},
+				},
+			}, "i")
+			Expect(err).Should(Succeed())
+			Expect(scopes).Should(ConsistOf("s3"))
+			Expect(testDbMan.findScopesForId("i")).Should(ConsistOf("s1"))
+			Expect(productIds()).Should(Equal([]string{"a", "b"}))
+		})
+
+		It("should apply the change list and merge the scopes in one transaction", func() {
+			Expect(testDbMan.updateLastSequence("1.1.1")).Should(Succeed())
+			changeList := &common.ChangeList{
+				LastSequence: "2.2.2",
+				Changes:      []common.Change{{Table: "edgex.data_scope", Operation: common.Insert, NewRow: scopeRow("d3", "s3")}},
+			}
+			snapDb, err := dataService.DBVersion(scopeSnapshotName)
+			Expect(err).Should(Succeed())
+			createBootstrapTables(snapDb)
+			// the column is unknown to the current DB version, so the merge fails
+			_, err = snapDb.Exec(`
+			ALTER TABLE kms_api_product ADD COLUMN extra text;
+			INSERT INTO "_transicator_tables" VALUES('kms_api_product','extra',25,0);
+			INSERT INTO "kms_api_product" (id,tenant_id,created_at,updated_at,_change_selector,extra) VALUES('c','t','c','u','s3','x');
+			`)
+			Expect(err).Should(Succeed())
+
+			Expect(testDbMan.processScopeChangeList(changeList, scopeSnapshotName, []string{"s2"})).ShouldNot(Succeed())
+			Expect(testDbMan.getLastSequence()).Should(Equal("1.1.1"))
+			Expect(testDbMan.findScopesForId("i")).Should(BeEmpty())
+			Expect(productIds()).Should(Equal([]string{"a", "b"}))
+
+			Expect(testDbMan.processScopeChangeList(changeList, "", []string{"s2"})).Should(Succeed())
+			Expect(testDbMan.getLastSequence()).Should(Equal("2.2.2"))
+			Expect(testDbMan.findScopesForId("i")).Should(ConsistOf("s3"))
+			Expect(productIds()).Should(Equal([]string{"a"}))
+		})
+	})
+
 	Context("Process Snapshot", func() {
 		initTestDb := func(sqlFile string, dbMan *dbManager) common.Snapshot {
 			stmts, err := ioutil.ReadFile(sqlFile)
@@ -1425,6 +2133,47 @@ var _ = Describe("data access tests", func() {
 			Expect(scopes).Should(Equal(expectedScopes))
 		})
 
+		It("should convert values of data snapshots", func() {
+			config.Set(configApidClusterId, "a")
+			apidInfo.ClusterID = "a"
+			config.Set(configConvertColumnTypes, true)
+			defer config.Set(configConvertColumnTypes, false)
+			event := initTestDb("./sql/init_listener_test_valid_snapshot.sql", testDbMan)
+			_, err := testDbMan.getDB().Exec("UPDATE edgex_data_scope SET created='2017-08-23 17:23:00.5' WHERE env='e1'")
+			Expect(err).Should(Succeed())
+			Expect(testDbMan.processSnapshot(&event, true)).Should(Succeed())
+
+			var created string
+			Expect(testDbMan.getDB().QueryRow("SELECT created FROM edgex_data_scope WHERE env='e1'").
+				Scan(&created)).Should(Succeed())
+			Expect(created).Should(Equal("2017-08-23T17:23:00.5Z"))
+
+			// only once, processing the snapshot again on restart keeps the values
+			_, err = testDbMan.getDB().Exec("UPDATE edgex_data_scope SET created='2017-08-23 17:23:00.5' WHERE env='e1'")
+			Expect(err).Should(Succeed())
+			Expect(testDbMan.processSnapshot(&event, true)).Should(Succeed())
+			Expect(testDbMan.getDB().QueryRow("SELECT created FROM edgex_data_scope WHERE env='e1'").
+				Scan(&created)).Should(Succeed())
+			Expect(created).Should(Equal("2017-08-23 17:23:00.5"))
+		})
+
+		It("should skip tables and columns missing from data snapshots when converting values", func() {
+			config.Set(configApidClusterId, "bootstrap")
+			apidInfo.ClusterID = "bootstrap"
+			config.Set(configConvertColumnTypes, true)
+			defer config.Set(configConvertColumnTypes, false)
+			// init_mock_db.sql lists kms_bundle_config, configuration and the history tables without creating them
+			event := initTestDb("./sql/init_mock_db.sql", testDbMan)
+			_, err := testDbMan.getDB().Exec(`INSERT INTO "_transicator_tables" VALUES('edgex_apid_cluster','dropped_at',1114,0)`)
+			Expect(err).Should(Succeed())
+			Expect(testDbMan.processSnapshot(&event, true)).Should(Succeed())
+
+			var created string
+			Expect(testDbMan.getDB().QueryRow("SELECT created FROM edgex_apid_cluster").
+				Scan(&created)).Should(Succeed())
+			Expect(created).Should(Equal("2017-02-27T07:39:22.179Z"))
+		})
+
 		It("should detect clusterid change", func() {
 			Expect(testDbMan.initDB()).Should(Succeed())
 			testDbMan.updateApidInstanceInfo("a", "b", "c")
@@ -1484,6 +2233,14 @@ func createBootstrapTables(db apid.DB) {
 	primary key (id,apid_cluster_id,apid_cluster_id,org,env,_change_selector));
 	`)
 	Expect(err).To(Succeed())
+	// processChangeList() moves last_sequence
+	_, err = tx.Exec(`
+	CREATE TABLE "edgex_apid_cluster" (id text,name text,description text,umbrella_org_app_name text,created blob,
+	created_by text,updated blob,updated_by text,_change_selector text,last_sequence text DEFAULT '',
+	primary key (id,created_by,_change_selector));
+	INSERT INTO "edgex_apid_cluster" (id,created_by,_change_selector) VALUES('i','c','cs');
+	`)
+	Expect(err).To(Succeed())
 
 	Expect(tx.Commit()).To(Succeed())
 }
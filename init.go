@@ -21,7 +21,6 @@ import (
 	"time"
 
 	"github.com/apid/apid-core"
-	"github.com/apid/apid-core/util"
 )
 
 const (
@@ -35,6 +34,63 @@ const (
 	configSnapshotProtocol    = "apigeesync_snapshot_proto"
 	configName                = "apigeesync_instance_name"
 	configDiagnosticMode      = "apigeesync_diagnostic_mode"
+	// access control of the local token API
+	configTokenApiAllowedAddrs       = "apigeesync_token_api_allowed_addresses"
+	configTokenApiUnixSocketOnly     = "apigeesync_token_api_unix_socket_only"
+	configTokenApiSecret             = "apigeesync_token_api_secret"
+	configTokenApiClientCertRequired = "apigeesync_token_api_client_cert_required"
+	configTokenApiClientNames        = "apigeesync_token_api_client_names"
+	// TLS of the connections to proxy, snapshot and change servers
+	configTlsCertFile   = "apigeesync_tls_cert_file"
+	configTlsKeyFile    = "apigeesync_tls_key_file"
+	configTlsCaFile     = "apigeesync_tls_ca_file"
+	configTlsMinVersion = "apigeesync_tls_min_version"
+	configTlsPinnedKeys = "apigeesync_tls_pinned_spki"
+	// source of the consumer key and secret
+	configCredentialsProvider     = "apigeesync_credentials_provider"
+	configCredentialsPollInterval = "apigeesync_credentials_poll_interval"
+	configConsumerKeyEnv          = "apigeesync_consumer_key_env"
+	configConsumerSecretEnv       = "apigeesync_consumer_secret_env"
+	configConsumerKeyFile         = "apigeesync_consumer_key_file"
+	configConsumerSecretFile      = "apigeesync_consumer_secret_file"
+	configCredentialsFile         = "apigeesync_credentials_file"
+	configCredentialsKeyFile      = "apigeesync_credentials_key_file"
+	// how the token is requested from the proxy server
+	configTokenGrantType = "apigeesync_token_grant_type"
+	configJwtKeyFile     = "apigeesync_jwt_private_key_file"
+	configJwtKeyId       = "apigeesync_jwt_key_id"
+	configJwtLifetime    = "apigeesync_jwt_lifetime"
+	// keeping the token across restarts
+	configPersistToken      = "apigeesync_persist_token"
+	configTokenStoreKeyFile = "apigeesync_token_store_key_file"
+	// lifecycle and health reporting to the proxy server
+	configHeartbeatInterval     = "apigeesync_heartbeat_interval"
+	configDegradedAfterFailures = "apigeesync_degraded_after_failures"
+	// "poll" or "sse"
+	configChangeTransport         = "apigeesync_change_transport"
+	configChangeStreamIdleTimeout = "apigeesync_change_stream_idle_timeout"
+	// encoding of change lists, "json" or "protobuf"
+	configChangeFormat = "apigeesync_change_format"
+	configChangeGzip   = "apigeesync_change_gzip"
+	// "retry", "dead_letter" or "snapshot"
+	configChangeFailurePolicy  = "apigeesync_change_failure_policy"
+	configChangeFailureRetries = "apigeesync_change_failure_retries"
+	// upsert inserts and ignore deletes of missing rows, so change lists can be replayed
+	configIdempotentApply = "apigeesync_idempotent_apply"
+	// "log", "resync" or "snapshot"
+	configSequenceGapPolicy = "apigeesync_sequence_gap_policy"
+	// resyncs of the same gap before the resync policy requests a new snapshot
+	configSequenceResyncAttempts = "apigeesync_sequence_resync_attempts"
+	// add new tables from table snapshots instead of downloading a new data snapshot
+	configIncrementalDdl = "apigeesync_incremental_ddl"
+	// merge added data scopes and delete removed ones instead of downloading a new data snapshot
+	configIncrementalScopes = "apigeesync_incremental_scopes"
+	// convert column values by the Postgres type of their column
+	configConvertColumnTypes = "apigeesync_convert_column_types"
+	// SQLite integrity check of downloaded snapshots: full, quick or none
+	configSnapshotIntegrityCheck = "apigeesync_snapshot_integrity_check"
+	// previous DB versions of snapshots kept on disk
+	configSnapshotRetention = "apigeesync_snapshot_retention"
 	// special value - set by ApigeeSync, not taken from configuration
 	configApidInstanceID = "apigeesync_apid_instance_id"
 	// This will not be needed once we have plugin handling tokens.
@@ -77,8 +133,33 @@ func init() {
 
 func initConfigDefaults() {
 	config.SetDefault(configPollInterval, 120*time.Second)
-	config.SetDefault(configSnapshotProtocol, "sqlite")
+	config.SetDefault(configSnapshotProtocol, snapshotProtocolSqlite)
 	config.SetDefault(configDiagnosticMode, false)
+	config.SetDefault(configTokenApiUnixSocketOnly, false)
+	config.SetDefault(configTokenApiClientCertRequired, false)
+	config.SetDefault(configCredentialsProvider, credentialsProviderConfig)
+	config.SetDefault(configCredentialsPollInterval, 30*time.Second)
+	config.SetDefault(configConsumerKeyEnv, "APIGEESYNC_CONSUMER_KEY")
+	config.SetDefault(configConsumerSecretEnv, "APIGEESYNC_CONSUMER_SECRET")
+	config.SetDefault(configTokenGrantType, grantTypeClientCredentials)
+	config.SetDefault(configJwtLifetime, 5*time.Minute)
+	config.SetDefault(configPersistToken, true)
+	config.SetDefault(configHeartbeatInterval, time.Minute)
+	config.SetDefault(configDegradedAfterFailures, 3)
+	config.SetDefault(configChangeTransport, changeTransportPoll)
+	config.SetDefault(configChangeStreamIdleTimeout, 90*time.Second)
+	config.SetDefault(configChangeFormat, changeFormatJson)
+	config.SetDefault(configChangeGzip, true)
+	config.SetDefault(configChangeFailurePolicy, changeFailurePolicyRetry)
+	config.SetDefault(configChangeFailureRetries, 3)
+	config.SetDefault(configIdempotentApply, false)
+	config.SetDefault(configSequenceGapPolicy, sequenceGapPolicyLog)
+	config.SetDefault(configSequenceResyncAttempts, 3)
+	config.SetDefault(configIncrementalDdl, true)
+	config.SetDefault(configIncrementalScopes, true)
+	config.SetDefault(configConvertColumnTypes, false)
+	config.SetDefault(configSnapshotIntegrityCheck, snapshotIntegrityCheckFull)
+	config.SetDefault(configSnapshotRetention, 1)
 
 	name, errh := os.Hostname()
 	if (errh != nil) && (len(config.GetString(configName)) == 0) {
@@ -90,7 +171,23 @@ func initConfigDefaults() {
 }
 
 func checkForRequiredValues(isOfflineMode bool) error {
-	required := []string{configProxyServerBaseURI, configConsumerKey, configConsumerSecret}
+	required := []string{configProxyServerBaseURI}
+	// other credential providers are validated by createCredentialProvider()
+	if config.GetString(configCredentialsProvider) == credentialsProviderConfig {
+		required = append(required, configConsumerKey)
+		if isConsumerSecretRequired() {
+			required = append(required, configConsumerSecret)
+		}
+	}
+	switch grantType := config.GetString(configTokenGrantType); grantType {
+	case grantTypeClientCredentials:
+	case grantTypeJwtBearer:
+		if config.GetString(configJwtKeyFile) == "" {
+			return fmt.Errorf("%s is required for grant type %s", configJwtKeyFile, grantTypeJwtBearer)
+		}
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configTokenGrantType, grantType)
+	}
 	if !isOfflineMode {
 		required = append(required, configSnapServerBaseURI, configChangeServerBaseURI)
 	}
@@ -100,9 +197,41 @@ func checkForRequiredValues(isOfflineMode bool) error {
 			return fmt.Errorf("missing required config value: %s", key)
 		}
 	}
-	proto := config.GetString(configSnapshotProtocol)
-	if proto != "sqlite" {
-		return fmt.Errorf("illegal value for %s. Only currently supported snashot protocol is sqlite", configSnapshotProtocol)
+	switch transport := config.GetString(configChangeTransport); transport {
+	case changeTransportPoll, changeTransportSse:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configChangeTransport, transport)
+	}
+	switch format := config.GetString(configChangeFormat); format {
+	case changeFormatJson, changeFormatProtobuf:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configChangeFormat, format)
+	}
+	switch policy := config.GetString(configChangeFailurePolicy); policy {
+	case changeFailurePolicyRetry, changeFailurePolicyDeadLetter, changeFailurePolicySnapshot:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configChangeFailurePolicy, policy)
+	}
+	switch policy := config.GetString(configSequenceGapPolicy); policy {
+	case sequenceGapPolicyLog, sequenceGapPolicyResync, sequenceGapPolicySnapshot:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configSequenceGapPolicy, policy)
+	}
+	if attempts := config.GetInt(configSequenceResyncAttempts); attempts < 0 {
+		return fmt.Errorf("illegal value for %s: %d", configSequenceResyncAttempts, attempts)
+	}
+	switch check := config.GetString(configSnapshotIntegrityCheck); check {
+	case snapshotIntegrityCheckFull, snapshotIntegrityCheckQuick, snapshotIntegrityCheckNone:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configSnapshotIntegrityCheck, check)
+	}
+	if retention := config.GetInt(configSnapshotRetention); retention < 0 {
+		return fmt.Errorf("illegal value for %s: %d", configSnapshotRetention, retention)
+	}
+	switch proto := config.GetString(configSnapshotProtocol); proto {
+	case snapshotProtocolSqlite, snapshotProtocolJson, snapshotProtocolProtobuf:
+	default:
+		return fmt.Errorf("illegal value for %s: %s", configSnapshotProtocol, proto)
 	}
 
 	return nil
@@ -113,10 +242,20 @@ func SetLogger(logger apid.LogService) {
 }
 
 func initManagers(isOfflineMode bool) (*listenerManager, *ApiManager, error) {
-	// check for forward proxy
-	var tr *http.Transport
-	tr = util.Transport(config.GetString(util.ConfigfwdProxyPortURL))
-	tr.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	tr, err := createUpstreamTransport()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to configure TLS: %v", err)
+	}
+	credentials, err := createCredentialProvider()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to configure credentials: %v", err)
+	}
+	if config.GetString(configTokenGrantType) == grantTypeJwtBearer {
+		// fail early on a bad key, it is loaded again for every token request
+		if _, err := loadJwtSigner(config.GetString(configJwtKeyFile), config.GetString(configJwtKeyId)); err != nil {
+			return nil, nil, fmt.Errorf("unable to load JWT signing key: %v", err)
+		}
+	}
 
 	apidDbManager := creatDbManager()
 	db, err := dataService.DB()
@@ -139,9 +278,21 @@ func initManagers(isOfflineMode bool) (*listenerManager, *ApiManager, error) {
 	}
 	config.Set(configApidInstanceID, apidInfo.InstanceID)
 
-	apidTokenManager := createApidTokenManager(apidInfo.IsNewInstance)
+	tokenClient := &http.Client{
+		Transport: tr,
+		Timeout:   httpTimeout,
+	}
+	var store tokenStore
+	if config.GetBool(configPersistToken) {
+		store, err = createDbTokenStore(apidDbManager, apidInfo.InstanceID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create token store: %v", err)
+		}
+	}
+	apidTokenManager := createApidTokenManager(apidInfo.IsNewInstance, tokenClient, credentials, store)
 	var snapMan snapshotManager
 	var apidChangeManager changeManager
+	var reporter *statusReporter
 
 	if isOfflineMode {
 		snapMan = &offlineSnapshotManager{
@@ -157,20 +308,32 @@ func initManagers(isOfflineMode bool) (*listenerManager, *ApiManager, error) {
 				return nil
 			},
 		}
+		reporter = createStatusReporter(apidTokenManager, httpClient)
+		reporter.applyMetrics = apidDbManager.getApplyMetrics
+		apidTokenManager.status = reporter.getStatus
 		snapMan = createSnapShotManager(apidDbManager, apidTokenManager, httpClient)
-		apidChangeManager = createChangeManager(apidDbManager, snapMan, apidTokenManager, httpClient)
+		apidChangeManager = createChangeManager(apidDbManager, snapMan, apidTokenManager, reporter, httpClient)
 	}
 
 	listenerMan := &listenerManager{
 		changeMan:     apidChangeManager,
 		snapMan:       snapMan,
 		tokenMan:      apidTokenManager,
+		reporter:      reporter,
 		isOfflineMode: isOfflineMode,
 	}
 
+	tokenApiAuth, err := createTokenApiAuth()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	apiMan := &ApiManager{
-		endpoint: tokenEndpoint,
-		tokenMan: apidTokenManager,
+		endpoint:           tokenEndpoint,
+		tokenMan:           apidTokenManager,
+		auth:               tokenApiAuth,
+		dbMan:              apidDbManager,
+		deadLetterEndpoint: deadLetterEndpoint,
 	}
 	return listenerMan, apiMan, nil
 }
@@ -197,10 +360,15 @@ func initPlugin(services apid.Services) (apid.PluginData, error) {
 	if err != nil {
 		return PluginData, err
 	}
+	cleanupPartialSnapshots()
 	listenerMan, apiMan, err := initManagers(isOfflineMode)
 	if err != nil {
 		return PluginData, err
 	}
+	// in diagnostic mode, any DB version may be loaded
+	if !isOfflineMode {
+		snapshotGc.collectAtStartup(apidInfo.LastSnapshot)
+	}
 	listenerMan.init()
 	apiMan.InitAPI(apiService)
 
@@ -54,6 +54,8 @@ var _ = Describe("init", func() {
 			Expect(apidInfo.InstanceName).To(Equal(testname))
 			Expect(me.listenerMap[apid.SystemEventsSelector]).ToNot(BeNil())
 			Expect(ma.handleMap[tokenEndpoint]).ToNot(BeNil())
+			// not without access control
+			Expect(ma.handleMap[deadLetterEndpoint]).To(BeNil())
 			Expect(pd).Should(Equal(PluginData))
 			Expect(apidInfo.IsNewInstance).Should(BeTrue())
 		})
@@ -74,6 +76,8 @@ var _ = Describe("init", func() {
 			Expect(changeMan.snapMan).ToNot(BeNil())
 			Expect(apiMan).ToNot(BeNil())
 			Expect(apiMan.tokenMan).ToNot(BeNil())
+			Expect(apiMan.auth).ToNot(BeNil())
+			Expect(apiMan.dbMan).ToNot(BeNil())
 		})
 
 		It("create managers for diagnostic mode", func() {
@@ -0,0 +1,195 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/apid/apid-core/util"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeJwtBearer         = "jwt_bearer"
+	grantTypeRefreshToken      = "refresh_token"
+	// RFC 7523
+	jwtBearerGrantUrn = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Id        string `json:"jti"`
+}
+
+/*
+ * Signs JWT assertions with a locally held private key.
+ * RSA keys sign with RS256, ECDSA keys with ES256, ES384 or ES512 depending on the curve.
+ */
+type jwtSigner struct {
+	key   crypto.Signer
+	alg   string
+	hash  crypto.Hash
+	keyId string
+}
+
+func loadJwtSigner(keyFile, keyId string) (*jwtSigner, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %s: %v", keyFile, err)
+	}
+	return createJwtSigner(key, keyId)
+}
+
+// accepts PKCS#1 RSA, SEC 1 EC and PKCS#8 PEM blocks
+func parsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+	}
+}
+
+func createJwtSigner(key crypto.Signer, keyId string) (*jwtSigner, error) {
+	s := &jwtSigner{
+		key:   key,
+		keyId: keyId,
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.alg, s.hash = "RS256", crypto.SHA256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			s.alg, s.hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			s.alg, s.hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			s.alg, s.hash = "ES512", crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// assertion for the consumer key, valid for lifetime
+func (s *jwtSigner) createAssertion(consumerKey, audience string, lifetime time.Duration) (string, error) {
+	now := time.Now()
+	return s.sign(jwtClaims{
+		Issuer:    consumerKey,
+		Subject:   consumerKey,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		Id:        util.GenerateUUID(),
+	})
+}
+
+func (s *jwtSigner) sign(claims jwtClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: s.alg, Typ: "JWT", Kid: s.keyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := jwtDigest(s.hash, []byte(signingInput))
+	var sig []byte
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, s.hash, digest)
+	case *ecdsa.PrivateKey:
+		sig, err = signEcdsaJws(k, digest)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func jwtDigest(hash crypto.Hash, input []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(input)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(input)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(input)
+		return sum[:]
+	}
+}
+
+// JWS uses the fixed size r | s encoding instead of ASN.1
+func signEcdsaJws(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rBytes):size], rBytes)
+	copy(sig[2*size-len(sBytes):], sBytes)
+	return sig, nil
+}
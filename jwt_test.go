@@ -0,0 +1,190 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/apid/apid-core/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// verifies the signature and decodes a JWT created by jwtSigner
+func verifyJwtAssertion(assertion string, pub crypto.PublicKey) (header jwtHeader, claims jwtClaims, err error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return header, claims, fmt.Errorf("malformed JWT")
+	}
+	var b []byte
+	if b, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &header); err != nil {
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	hash := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}[header.Alg]
+	digest := jwtDigest(hash, []byte(parts[0]+"."+parts[1]))
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return
+		}
+	case *ecdsa.PublicKey:
+		size := len(sig) / 2
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return header, claims, fmt.Errorf("invalid ECDSA signature")
+		}
+	default:
+		return header, claims, fmt.Errorf("unsupported key type %T", pub)
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &claims)
+	return
+}
+
+var _ = Describe("JWT bearer grant", func() {
+	var testDir string
+
+	BeforeEach(func() {
+		var err error
+		testDir, err = ioutil.TempDir(tmpDir, "jwt_test")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(configTokenGrantType, grantTypeClientCredentials)
+		config.Set(configJwtKeyFile, "")
+		config.Set(configJwtKeyId, "")
+		config.Set(configProxyServerBaseURI, dummyConfigValue)
+		Expect(os.RemoveAll(testDir)).Should(Succeed())
+	})
+
+	writeKey := func(blockType string, der []byte) string {
+		f := filepath.Join(testDir, "jwt.key")
+		Expect(ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)).Should(Succeed())
+		return f
+	}
+
+	It("should sign with RSA and ECDSA keys", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).Should(Succeed())
+		p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).Should(Succeed())
+		p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		ecDer, err := x509.MarshalECPrivateKey(p384Key)
+		Expect(err).Should(Succeed())
+		pkcs8Der, err := x509.MarshalPKCS8PrivateKey(p256Key)
+		Expect(err).Should(Succeed())
+
+		for _, testCase := range []struct {
+			blockType string
+			der       []byte
+			pub       crypto.PublicKey
+			alg       string
+		}{
+			{"RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), &rsaKey.PublicKey, "RS256"},
+			{"EC PRIVATE KEY", ecDer, &p384Key.PublicKey, "ES384"},
+			{"PRIVATE KEY", pkcs8Der, &p256Key.PublicKey, "ES256"},
+		} {
+			signer, err := loadJwtSigner(writeKey(testCase.blockType, testCase.der), "key-1")
+			Expect(err).Should(Succeed())
+			assertion, err := signer.createAssertion("consumer", "http://proxy/accesstoken", time.Minute)
+			Expect(err).Should(Succeed())
+
+			header, claims, err := verifyJwtAssertion(assertion, testCase.pub)
+			Expect(err).Should(Succeed())
+			Expect(header).Should(Equal(jwtHeader{Alg: testCase.alg, Typ: "JWT", Kid: "key-1"}))
+			Expect(claims.Issuer).Should(Equal("consumer"))
+			Expect(claims.Subject).Should(Equal("consumer"))
+			Expect(claims.Audience).Should(Equal("http://proxy/accesstoken"))
+			Expect(claims.ExpiresAt - claims.IssuedAt).Should(BeEquivalentTo(60))
+			Expect(claims.Id).ShouldNot(BeEmpty())
+		}
+	})
+
+	It("should reject bad keys", func() {
+		_, err := loadJwtSigner(filepath.Join(testDir, "missing.key"), "")
+		Expect(err).ShouldNot(Succeed())
+		_, err = loadJwtSigner(writeKey("CERTIFICATE", []byte("junk")), "")
+		Expect(err).ShouldNot(Succeed())
+		_, err = loadJwtSigner(writeKey("RSA PRIVATE KEY", []byte("junk")), "")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should require a key file for the jwt_bearer grant", func() {
+		config.Set(configTokenGrantType, grantTypeJwtBearer)
+		Expect(checkForRequiredValues(true)).ShouldNot(Succeed())
+		config.Set(configJwtKeyFile, filepath.Join(testDir, "jwt.key"))
+		Expect(checkForRequiredValues(true)).Should(Succeed())
+		config.Set(configTokenGrantType, "password")
+		Expect(checkForRequiredValues(true)).ShouldNot(Succeed())
+	})
+
+	It("token manager should get a token with a signed assertion", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		der, err := x509.MarshalECPrivateKey(key)
+		Expect(err).Should(Succeed())
+		config.Set(configTokenGrantType, grantTypeJwtBearer)
+		config.Set(configJwtKeyFile, writeKey("EC PRIVATE KEY", der))
+		config.Set(configJwtKeyId, "key-2")
+
+		testRouter := api.CreateService().Router()
+		testServer := httptest.NewServer(testRouter)
+		defer testServer.Close()
+		testMock := Mock(MockParms{
+			ReliableAPI:  true,
+			ClusterID:    config.GetString(configApidClusterId),
+			TokenKey:     config.GetString(configConsumerKey),
+			JwtPublicKey: &key.PublicKey,
+			JwtKeyId:     "key-2",
+		}, testRouter)
+		config.Set(configProxyServerBaseURI, testServer.URL)
+		apidInfo.InstanceName = config.GetString(configName)
+
+		testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
+		testedTokenManager.start()
+		defer testedTokenManager.close()
+		Expect(testedTokenManager.getBearerToken()).Should(Equal(testMock.oauthToken))
+	}, 3)
+})
@@ -25,9 +25,11 @@ const (
 )
 
 type listenerManager struct {
-	changeMan     changeManager
-	snapMan       snapshotManager
-	tokenMan      tokenManager
+	changeMan changeManager
+	snapMan   snapshotManager
+	tokenMan  tokenManager
+	// nil in offline mode
+	reporter      *statusReporter
 	isOfflineMode bool
 }
 
@@ -72,6 +74,9 @@ func (l *listenerManager) postInitPlugins(event apid.Event) {
 		log.Debug("start post plugin init")
 
 		l.tokenMan.start()
+		if l.reporter != nil {
+			l.reporter.start()
+		}
 		go l.bootstrap(apidInfo.LastSnapshot)
 
 		log.Debug("Done post plugin init")
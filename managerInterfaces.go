@@ -21,6 +21,7 @@ import (
 
 type tokenManager interface {
 	getBearerToken() string
+	getToken() *OauthToken
 	invalidateToken()
 	close()
 	start()
@@ -32,6 +33,8 @@ type snapshotManager interface {
 	downloadBootSnapshot()
 	downloadDataSnapshot() error
 	startOnDataSnapshot(snapshot string) error
+	downloadTableSnapshot(tableName string) (string, error)
+	downloadScopeSnapshot(scopes []string) (string, error)
 }
 
 type changeManager interface {
@@ -47,6 +50,12 @@ type DbManager interface {
 	updateLastSequence(lastSequence string) error
 	getApidInstanceInfo() (info apidInstanceInfo, err error)
 	processChangeList(changes *common.ChangeList) error
+	processChangeListQuarantining(changes *common.ChangeList) (*common.ChangeList, error)
+	getDeadLetters() ([]deadLetter, error)
+	reapplyDeadLetter(id int64) (*deadLetter, error)
+	processTableSnapshot(snapshotDbId, tableName string) error
+	findScopesAfterChangeList(changes *common.ChangeList, configId string) ([]string, error)
+	processScopeChangeList(changes *common.ChangeList, snapshotDbId string, removedScopes []string) error
 	processSnapshot(snapshot *common.Snapshot, isDataSnapshot bool) error
 	getKnowTables() map[string]bool
 }
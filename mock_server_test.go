@@ -15,6 +15,8 @@
 package apidApigeeSync
 
 import (
+	"compress/gzip"
+	"crypto"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -36,7 +38,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -69,6 +74,15 @@ type MockParms struct {
 	NumDevelopers  int
 	NumDeployments int
 	BundleURI      string
+	// if set, jwt bearer assertions are accepted instead of the secret
+	JwtPublicKey crypto.PublicKey
+	JwtKeyId     string
+	// if set, /changes/stream is not offered
+	NoChangeStream bool
+	// change lists pushed on each stream connection, then only heartbeats
+	StreamChangeLists int
+	// if set, the stream sends no heartbeats
+	NoStreamHeartbeats bool
 }
 
 func Mock(params MockParms, router apid.Router) *MockServer {
@@ -95,6 +109,13 @@ type MockServer struct {
 	maxDeploymentID *int64
 	newSnap         *int32
 	authFail        *int32
+	heartbeatMutex  *sync.Mutex
+	heartbeats      []syncHealth
+	streamMutex     *sync.Mutex
+	// Last-Event-ID of each stream connection
+	streamResumedFrom []string
+	// incremented to drop open streams
+	streamGeneration *int32
 }
 
 func (m *MockServer) forceAuthFailOnce() {
@@ -166,6 +187,16 @@ func initDb(statements, path string) {
 
 }
 
+// returns the file of a snapshot created from the statements, as served by the snapshot server
+func mockSnapshotData(statements string) []byte {
+	path := filepath.Join(tmpDir, strings.TrimSuffix(filepath.Base(statements), ".sql")+".sqlite3")
+	initDb(statements, path)
+	snapshotData, err := ioutil.ReadFile(path)
+	Expect(err).Should(Succeed())
+	Expect(os.Remove(path)).Should(Succeed())
+	return snapshotData
+}
+
 func (m *MockServer) init() {
 	defer GinkgoRecover()
 	RegisterFailHandler(func(message string, callerSkip ...int) {
@@ -183,6 +214,9 @@ func (m *MockServer) init() {
 	m.authFail = new(int32)
 	*m.authFail = 0
 	m.deployIDMutex = &sync.RWMutex{}
+	m.heartbeatMutex = &sync.Mutex{}
+	m.streamMutex = &sync.Mutex{}
+	m.streamGeneration = new(int32)
 	initDb("./sql/init_mock_db.sql", "./mockdb.sqlite3")
 	initDb("./sql/init_mock_boot_db.sql", "./mockdb_boot.sqlite3")
 
@@ -205,6 +239,11 @@ func (m *MockServer) registerRoutes(router apid.Router) {
 	router.HandleFunc("/accesstoken", m.unreliable(m.gomega(m.sendToken))).Methods("POST")
 	router.HandleFunc("/snapshots", m.unreliable(m.gomega(m.auth(m.sendSnapshot)))).Methods("GET")
 	router.HandleFunc("/changes", m.unreliable(m.gomega(m.auth(m.sendChanges)))).Methods("GET")
+	if !m.params.NoChangeStream {
+		// not wrapped by gomega(), it would intercept the failures of the test while streaming
+		router.HandleFunc("/changes/stream", m.auth(m.streamChanges)).Methods("GET")
+	}
+	router.HandleFunc("/heartbeat", m.gomega(m.auth(m.receiveHeartbeat))).Methods("POST")
 	router.HandleFunc("/bundles/{id}", m.sendDeploymentBundle).Methods("GET")
 	router.HandleFunc("/analytics", m.sendAnalyticsURL).Methods("GET")
 	router.HandleFunc("/analytics", m.putAnalyticsData).Methods("PUT")
@@ -232,8 +271,7 @@ func (m *MockServer) sendToken(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	Expect(err).NotTo(HaveOccurred())
 
-	Expect(req.Form.Get("grant_type")).To(Equal("client_credentials"))
-	Expect(req.Header.Get("status")).To(Equal("ONLINE"))
+	Expect([]string{statusOnline, statusDegraded}).To(ContainElement(req.Header.Get("status")))
 	Expect(req.Header.Get("apid_cluster_Id")).To(Equal(m.params.ClusterID))
 	Expect(req.Header.Get("display_name")).ToNot(BeEmpty())
 
@@ -244,7 +282,19 @@ func (m *MockServer) sendToken(w http.ResponseWriter, req *http.Request) {
 	}
 
 	Expect(req.Form.Get("client_id")).To(Equal(m.params.TokenKey))
-	Expect(req.Form.Get("client_secret")).To(Equal(m.params.TokenSecret))
+	if m.params.JwtPublicKey != nil {
+		Expect(req.Form.Get("grant_type")).To(Equal(jwtBearerGrantUrn))
+		Expect(req.Form.Get("client_secret")).To(BeEmpty())
+		header, claims, err := verifyJwtAssertion(req.Form.Get("assertion"), m.params.JwtPublicKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(header.Kid).To(Equal(m.params.JwtKeyId))
+		Expect(claims.Issuer).To(Equal(m.params.TokenKey))
+		Expect(claims.Audience).To(Equal("http://" + req.Host + req.URL.Path))
+		Expect(claims.ExpiresAt).To(BeNumerically(">", time.Now().Unix()))
+	} else {
+		Expect(req.Form.Get("grant_type")).To(Equal("client_credentials"))
+		Expect(req.Form.Get("client_secret")).To(Equal(m.params.TokenSecret))
+	}
 
 	var plugInfo []pluginDetail
 	plInfo := []byte(req.Header.Get("plugin_details"))
@@ -261,6 +311,27 @@ func (m *MockServer) sendToken(w http.ResponseWriter, req *http.Request) {
 	w.Write(body)
 }
 
+func (m *MockServer) receiveHeartbeat(w http.ResponseWriter, req *http.Request) {
+	defer GinkgoRecover()
+
+	Expect(req.Header.Get("apid_cluster_Id")).To(Equal(m.params.ClusterID))
+	var health syncHealth
+	Expect(json.NewDecoder(req.Body).Decode(&health)).To(Succeed())
+	Expect(req.Header.Get("status")).To(Equal(health.Status))
+
+	m.heartbeatMutex.Lock()
+	m.heartbeats = append(m.heartbeats, health)
+	m.heartbeatMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// heartbeats received so far
+func (m *MockServer) receivedHeartbeats() []syncHealth {
+	m.heartbeatMutex.Lock()
+	defer m.heartbeatMutex.Unlock()
+	return append([]syncHealth(nil), m.heartbeats...)
+}
+
 func (m *MockServer) sendSnapshot(w http.ResponseWriter, req *http.Request) {
 	defer GinkgoRecover()
 
@@ -323,13 +394,98 @@ func (m *MockServer) sendChanges(w http.ResponseWriter, req *http.Request) {
 	// todo: the following is just legacy for the existing test in apigeeSync_suite_test
 	developer := m.createDeveloperWithProductAndApp()
 	changeList := m.createInsertChange(developer)
-	body, err := json.Marshal(changeList)
-	if err != nil {
-		log.Errorf("Error generating developer: %v", err)
+	m.writeChangeList(w, req, &changeList)
+}
+
+// encodes as negotiated by the Accept and Accept-Encoding headers
+func (m *MockServer) writeChangeList(w http.ResponseWriter, req *http.Request, changeList *common.ChangeList) {
+	var body []byte
+	if strings.Contains(req.Header.Get("Accept"), protobufContentType) {
+		w.Header().Set("Content-Type", protobufContentType)
+		body = changeList.MarshalProto()
+	} else {
+		var err error
+		if body, err = json.Marshal(changeList); err != nil {
+			log.Errorf("Error generating developer: %v", err)
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+	}
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		gz.Write(body)
+		return
 	}
 	w.Write(body)
 }
 
+// pushes change lists as Server-Sent Events
+func (m *MockServer) streamChanges(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if req.Header.Get("Accept") != "text/event-stream" ||
+		req.Header.Get("apid_cluster_Id") != m.params.ClusterID ||
+		q.Get("since") != req.Header.Get("Last-Event-ID") {
+		log.Errorf("bad change stream request %s, headers: %v", req.URL, req.Header)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.streamMutex.Lock()
+	m.streamResumedFrom = append(m.streamResumedFrom, req.Header.Get("Last-Event-ID"))
+	m.streamMutex.Unlock()
+	generation := atomic.LoadInt32(m.streamGeneration)
+
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if atomic.LoadInt32(m.newSnap) > 0 {
+		log.Debug("MockServer: force new snapshot")
+		fmt.Fprint(w, "event: error\ndata: {\"code\":\"SNAPSHOT_TOO_OLD\"}\n\n")
+		return
+	}
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for sent := 0; ; {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(m.streamGeneration) != generation {
+			return
+		}
+		if sent < m.params.StreamChangeLists {
+			changeList := m.createInsertChange(m.createDeveloperWithProductAndApp())
+			body, err := json.Marshal(changeList)
+			if err != nil {
+				log.Errorf("Error generating developer: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: changes\ndata: %s\n\n", changeList.LastSequence, body)
+			sent++
+		} else if !m.params.NoStreamHeartbeats {
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// ends the open change streams
+func (m *MockServer) dropChangeStreams() {
+	atomic.AddInt32(m.streamGeneration, 1)
+}
+
+// Last-Event-ID of each stream connection so far
+func (m *MockServer) changeStreamConnections() []string {
+	m.streamMutex.Lock()
+	defer m.streamMutex.Unlock()
+	return append([]string(nil), m.streamResumedFrom...)
+}
+
 // enables GoMega handling
 func (m *MockServer) gomega(target http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
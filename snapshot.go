@@ -20,17 +20,32 @@ import (
 	"net/http"
 	"os"
 
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 const bootstrapSnapshotName = "bootstrap"
-const lengthSqliteFileName = 7 // len("/sqlite")
+const tableSnapshotPrefix = "table_"
+const scopeSnapshotName = "scopes"
+
+// suffix of snapshot files being downloaded, next to the DB version directories
+const partialSnapshotSuffix = ".partial"
+
+// directories of a snapshot being installed, and of the DB version it replaces, see installSnapshotFile()
+const (
+	installingSnapshotSuffix = ".installing"
+	replacedSnapshotSuffix   = ".replaced"
+)
+
+const sqliteFileHeader = "SQLite format 3\x00"
 const (
 	headerSnapshotNumber = "Transicator-Snapshot-TXID"
 )
@@ -162,7 +177,36 @@ func (s *apidSnapshotManager) downloadSnapshot(isBoot bool, scopes []string, sna
 	pollWithBackoff(s.quitChan, attemptDownload, handleSnapshotServerError)
 }
 
+// a snapshot download, kept between attempts so that an interrupted download can be resumed
+type snapshotDownload struct {
+	// Transicator-Snapshot-TXID of the partial file
+	txid string
+	// DB version the file is downloaded to
+	dbId string
+	// bytes in the partial file
+	size int64
+	// checksum header of the snapshot, if sent
+	checksum string
+	// format of the partial file, see snapshotResponseFormat()
+	format string
+}
+
+func (d *snapshotDownload) reset() {
+	*d = snapshotDownload{}
+}
+
+// whether a 206 response continues the partial file
+func (d *snapshotDownload) isContinuedBy(r *http.Response) bool {
+	if txid := r.Header.Get(headerSnapshotNumber); txid != "" && txid != d.txid {
+		return false
+	}
+	var start, end, total int64
+	_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	return err == nil && start == d.size
+}
+
 func (s *apidSnapshotManager) getAttemptDownloadClosure(isBoot bool, snapshot *common.Snapshot, uri string) func(chan bool) error {
+	download := &snapshotDownload{}
 	return func(_ chan bool) error {
 
 		var tid string
@@ -173,11 +217,14 @@ func (s *apidSnapshotManager) getAttemptDownloadClosure(isBoot bool, snapshot *c
 		}
 		addHeaders(req, s.tokenMan.getBearerToken())
 
-		if config.GetString(configSnapshotProtocol) != "sqlite" {
-			log.Panic("Only currently supported snashot protocol is sqlite")
+		req.Header.Set("Accept", snapshotAcceptHeader())
 
+		// resume the previous attempt, as long as the snapshot is the same
+		if download.size > 0 {
+			log.Infof("Resuming download of snapshot %s at byte %d", download.txid, download.size)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", download.size))
+			req.Header.Set("If-Range", `"`+download.txid+`"`)
 		}
-		req.Header.Set("Accept", "application/transicator+sqlite")
 
 		// Issue the request to the snapshot server
 		r, err := s.client.Do(req)
@@ -191,74 +238,388 @@ func (s *apidSnapshotManager) getAttemptDownloadClosure(isBoot bool, snapshot *c
 		switch r.StatusCode {
 		case http.StatusOK:
 			break
+		case http.StatusPartialContent:
+			if download.size > 0 && download.isContinuedBy(r) {
+				break
+			}
+			log.Errorf("Snapshot server sent unexpected range %s of snapshot %s",
+				r.Header.Get("Content-Range"), r.Header.Get(headerSnapshotNumber))
+			download.reset()
+			return expected200Error
 		case http.StatusUnauthorized:
 			s.tokenMan.invalidateToken()
 			fallthrough
 		default:
 			body, _ := ioutil.ReadAll(r.Body)
 			log.Errorf("Snapshot server conn failed with resp code %d, body: %s", r.StatusCode, string(body))
+			if r.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				download.reset()
+			}
 			return expected200Error
 		}
 
-		// Bootstrap scope is a special case, that can occur only once. The tid is
-		// hardcoded to "bootstrap" to ensure there can be no clash of tid between
-		// bootstrap and subsequent data scopes.
-		if isBoot {
-			tid = bootstrapSnapshotName
-		} else {
-			tid = r.Header.Get(headerSnapshotNumber)
+		if r.StatusCode == http.StatusOK {
+			// Bootstrap scope is a special case, that can occur only once. The tid is
+			// hardcoded to "bootstrap" to ensure there can be no clash of tid between
+			// bootstrap and subsequent data scopes.
+			if isBoot {
+				tid = bootstrapSnapshotName
+			} else {
+				tid = r.Header.Get(headerSnapshotNumber)
+			}
+			if download.size > 0 {
+				log.Infof("Snapshot server doesn't resume snapshot %s, downloading it again", download.txid)
+				if download.dbId != tid {
+					removeSnapshotFile(download.dbId)
+				}
+			}
+			download.txid, download.dbId, download.size = r.Header.Get(headerSnapshotNumber), tid, 0
+			download.checksum, download.format = "", snapshotResponseFormat(r)
+		}
+		if checksum := r.Header.Get(headerSnapshotChecksum); checksum != "" {
+			download.checksum = checksum
 		}
-		// Decode the Snapshot server response
-		err = processSnapshotServerFileResponse(tid, r.Body, snapshot)
+
+		// Stream the Snapshot server response
+		n, err := writeSnapshotFile(download.dbId, r.Body, download.size)
+		download.size += n
 		if err != nil {
 			log.Errorf("Snapshot server response Data not parsable: %v", err)
+			if download.txid == "" {
+				// without a TXID the download can't be resumed
+				download.reset()
+			}
+			return err
+		}
+		if download.checksum != "" {
+			if err = verifySnapshotChecksum(snapshotStagingPath(download.dbId), download.checksum); err != nil {
+				quarantineSnapshot(download.dbId, err)
+				download.reset()
+				return err
+			}
+		}
+		if download.format != snapshotProtocolSqlite {
+			if err = materializeSnapshot(download.dbId, download.format); err != nil {
+				quarantineSnapshot(download.dbId, err)
+				download.reset()
+				return err
+			}
+		}
+		// never install a broken snapshot, download it again instead
+		if err = verifySnapshotDb(snapshotStagingPath(download.dbId)); err != nil {
+			quarantineSnapshot(download.dbId, err)
+			download.reset()
+			return err
+		}
+		if err = installSnapshotFile(download.dbId); err != nil {
+			log.Errorf("Unable to install snapshot %s: %v", download.dbId, err)
+			download.reset()
 			return err
 		}
+		snapshot.SnapshotInfo = download.dbId
+		download.reset()
 
 		return nil
 	}
 }
 
 func processSnapshotServerFileResponse(dbId string, body io.Reader, snapshot *common.Snapshot) error {
-	dbPath := data.DBPath("common/" + dbId)
-	dbDir := dbPath[0 : len(dbPath)-lengthSqliteFileName]
-	log.Infof("Attempting to stream the sqlite snapshot to %s", dbPath)
-
-	// if other bootstrap snapshot exists, delete the old file
-	if dbId == bootstrapSnapshotName {
-		if _, err := os.Stat(dbDir); !os.IsNotExist(err) {
-			if err = os.RemoveAll(dbDir); err != nil {
-				log.Errorf("Failed to delete old bootstrap snapshot; %v", err)
-				return err
-			}
+	return processSnapshotServerResponse(dbId, snapshotProtocolSqlite, body, snapshot)
+}
+
+// installs a snapshot of any format as DB version dbId
+func processSnapshotServerResponse(dbId, format string, body io.Reader, snapshot *common.Snapshot) error {
+	if _, err := writeSnapshotFile(dbId, body, 0); err != nil {
+		removeSnapshotFile(dbId)
+		return err
+	}
+	if format != snapshotProtocolSqlite {
+		if err := materializeSnapshot(dbId, format); err != nil {
+			removeSnapshotFile(dbId)
+			return err
 		}
 	}
+	if err := installSnapshotFile(dbId); err != nil {
+		return err
+	}
+	snapshot.SnapshotInfo = dbId
+	//TODO get timestamp from transicator.  Not currently in response
 
-	//this path includes the sqlite3 file name.  why does mkdir all stop at parent??
-	log.Infof("Creating directory with mkdirall %s", dbPath)
-	err := os.MkdirAll(dbDir, 0700)
-	if err != nil {
+	return nil
+}
+
+/*
+ * Streams the body to the staging file of DB version dbId, starting at offset, so that a download
+ * can be resumed. Returns the number of bytes written, also if streaming fails.
+ * installSnapshotFile() moves the file into place once it is complete.
+ */
+func writeSnapshotFile(dbId string, body io.Reader, offset int64) (int64, error) {
+	stagingPath := snapshotStagingPath(dbId)
+	log.Infof("Attempting to stream the sqlite snapshot to %s", stagingPath)
+
+	if err := os.MkdirAll(filepath.Dir(stagingPath), 0700); err != nil {
 		log.Errorf("Error creating db path %s", err)
+		return 0, err
 	}
-	out, err := os.Create(dbPath)
+	out, err := os.OpenFile(stagingPath, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer out.Close()
+	// drop anything after the offset, e.g. of an earlier download
+	if err = out.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err = out.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
 
 	//stream respose to DB
-	_, err = io.Copy(out, body)
+	return io.Copy(out, body)
+}
 
-	if err != nil {
+/*
+ * Verifies the downloaded snapshot file of DB version dbId, syncs it to disk and renames it into
+ * a fresh directory, which then replaces the directory of the DB version. An older bootstrap,
+ * scope or table snapshot is only deleted once the new one is in place, cleanupPartialSnapshots()
+ * recovers from a crash in between. A file failing verification is removed.
+ */
+func installSnapshotFile(dbId string) error {
+	stagingPath := snapshotStagingPath(dbId)
+	if err := verifySqliteFile(stagingPath); err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+	if err := syncFile(stagingPath); err != nil {
 		return err
 	}
 
-	snapshot.SnapshotInfo = dbId
-	//TODO get timestamp from transicator.  Not currently in response
+	// recorded first, so that a crash can't leave a version that is never collected
+	if err := recordSnapshotVersion(dbId); err != nil {
+		return fmt.Errorf("unable to record snapshot %s: %v", dbId, err)
+	}
 
+	dbPath := data.DBPath("common/" + dbId)
+	dbDir := filepath.Dir(dbPath)
+	installingDir := dbDir + installingSnapshotSuffix
+	if err := os.RemoveAll(installingDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(installingDir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(stagingPath, filepath.Join(installingDir, filepath.Base(dbPath))); err != nil {
+		return err
+	}
+	if err := syncFile(installingDir); err != nil {
+		return err
+	}
+
+	replacedDir := dbDir + replacedSnapshotSuffix
+	replaced := false
+	if _, err := os.Stat(dbDir); err == nil {
+		if err = os.RemoveAll(replacedDir); err != nil {
+			return err
+		}
+		if err = os.Rename(dbDir, replacedDir); err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if err := os.Rename(installingDir, dbDir); err != nil {
+		if replaced {
+			os.Rename(replacedDir, dbDir)
+		}
+		return err
+	}
+	// make the renames durable
+	if err := syncFile(filepath.Dir(dbDir)); err != nil {
+		return err
+	}
+	if replaced {
+		if err := os.RemoveAll(replacedDir); err != nil {
+			log.Warnf("Failed to delete old snapshot %s: %v", dbId, err)
+		}
+	}
+	log.Infof("Installed snapshot %s at %s", dbId, dbPath)
 	return nil
 }
 
+// the file a snapshot is downloaded to, next to the directory of its DB version
+func snapshotStagingPath(dbId string) string {
+	return filepath.Dir(data.DBPath("common/"+dbId)) + partialSnapshotSuffix
+}
+
+/*
+ * Checks the file is a complete SQLite DB: the header is present, and the size
+ * matches the page count of the header, if that is valid.
+ */
+func verifySqliteFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 100)
+	if _, err = io.ReadFull(f, header); err != nil || string(header[:16]) != sqliteFileHeader {
+		return fmt.Errorf("snapshot %s is not a SQLite DB", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	pageSize := int64(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	changeCounter := binary.BigEndian.Uint32(header[24:28])
+	pageCount := int64(binary.BigEndian.Uint32(header[28:32]))
+	// the page count is only valid if written by the same change
+	if pageCount > 0 && binary.BigEndian.Uint32(header[92:96]) == changeCounter {
+		if info.Size() != pageSize*pageCount {
+			return fmt.Errorf("snapshot %s is truncated: %d of %d bytes", path, info.Size(), pageSize*pageCount)
+		}
+	} else if pageSize < 512 || info.Size()%pageSize != 0 {
+		return fmt.Errorf("snapshot %s is truncated: %d bytes", path, info.Size())
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// removes the directory of a snapshot and any download of it, e.g. of a download that won't be resumed
+func removeSnapshotFile(dbId string) {
+	dbPath := data.DBPath("common/" + dbId)
+	if err := os.RemoveAll(filepath.Dir(dbPath)); err != nil {
+		log.Warnf("Unable to remove snapshot %s: %v", dbId, err)
+	}
+	if err := os.RemoveAll(snapshotStagingPath(dbId)); err != nil {
+		log.Warnf("Unable to remove snapshot download %s: %v", dbId, err)
+	}
+}
+
+/*
+ * Removes the snapshot downloads left by a crash or restart. They are never used, as the
+ * download state is lost, so this runs at startup. A crash while installing a snapshot
+ * may also leave the directory it replaced, which is restored if the new one isn't in place.
+ */
+func cleanupPartialSnapshots() {
+	replaced, err := filepath.Glob(filepath.Join(commonDbDir(), "*"+replacedSnapshotSuffix))
+	if err != nil {
+		log.Warnf("Unable to find replaced snapshots: %v", err)
+		return
+	}
+	for _, dir := range replaced {
+		dbDir := strings.TrimSuffix(dir, replacedSnapshotSuffix)
+		if _, err = os.Stat(dbDir); os.IsNotExist(err) {
+			log.Infof("Restoring snapshot %s", dbDir)
+			if err = os.Rename(dir, dbDir); err != nil {
+				log.Warnf("Unable to restore snapshot %s: %v", dbDir, err)
+			}
+			continue
+		}
+		log.Infof("Removing replaced snapshot %s", dir)
+		if err = os.RemoveAll(dir); err != nil {
+			log.Warnf("Unable to remove replaced snapshot %s: %v", dir, err)
+		}
+	}
+
+	for _, suffix := range []string{partialSnapshotSuffix, installingSnapshotSuffix} {
+		orphans, err := filepath.Glob(filepath.Join(commonDbDir(), "*"+suffix))
+		if err != nil {
+			log.Warnf("Unable to find partial snapshots: %v", err)
+			return
+		}
+		for _, orphan := range orphans {
+			log.Infof("Removing partial snapshot %s", orphan)
+			if err = os.RemoveAll(orphan); err != nil {
+				log.Warnf("Unable to remove partial snapshot %s: %v", orphan, err)
+			}
+		}
+	}
+}
+
+/*
+ * Downloads a snapshot of a single table, for the data scopes of the cluster.
+ * Returns the DB version holding it, for dbMan.processTableSnapshot().
+ * Unlike the data snapshot this is a single attempt, and partialSnapshotUnavailableError
+ * tells the snapshot server can't provide one.
+ */
+func (s *apidSnapshotManager) downloadTableSnapshot(tableName string) (string, error) {
+	scopes, err := s.dbMan.findScopesForId(apidInfo.ClusterID)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	for _, scope := range append(scopes, apidInfo.ClusterID) {
+		v.Add("scope", scope)
+	}
+	v.Add("table", tableName)
+	return s.downloadPartialSnapshot(tableSnapshotPrefix+normalizeTableName(tableName), v)
+}
+
+/*
+ * Downloads a snapshot of just the given data scopes.
+ * Returns the DB version holding it, for dbMan.processScopeChangeList().
+ */
+func (s *apidSnapshotManager) downloadScopeSnapshot(scopes []string) (string, error) {
+	v := url.Values{}
+	for _, scope := range scopes {
+		v.Add("scope", scope)
+	}
+	return s.downloadPartialSnapshot(scopeSnapshotName, v)
+}
+
+// a single attempt to download a snapshot of part of the data into DB version dbId
+func (s *apidSnapshotManager) downloadPartialSnapshot(dbId string, v url.Values) (string, error) {
+	snapshotUri, err := url.Parse(config.GetString(configSnapServerBaseURI))
+	if err != nil {
+		return "", err
+	}
+	snapshotUri.Path = path.Join(snapshotUri.Path, "snapshots")
+	snapshotUri.RawQuery = v.Encode()
+	uri := snapshotUri.String()
+	log.Infof("Partial Snapshot Download: %s", uri)
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	addHeaders(req, s.tokenMan.getBearerToken())
+	req.Header.Set("Accept", snapshotAcceptHeader())
+	r, err := s.client.Do(req)
+	if err != nil {
+		log.Errorf("Snapshotserver comm error: %v", err)
+		return "", err
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		s.tokenMan.invalidateToken()
+		return "", authFailError
+	default:
+		body, _ := ioutil.ReadAll(r.Body)
+		log.Errorf("Partial snapshot %s failed with resp code %d, body: %s", uri, r.StatusCode, string(body))
+		return "", partialSnapshotUnavailableError
+	}
+
+	if err = processSnapshotServerResponse(dbId, snapshotResponseFormat(r), r.Body, &common.Snapshot{}); err != nil {
+		log.Errorf("Partial snapshot %s not parsable: %v", uri, err)
+		return "", err
+	}
+	return dbId, nil
+}
+
 func handleSnapshotServerError(err error) {
 	log.Errorf("Error connecting to snapshot server: %v", err)
 }
@@ -281,6 +642,14 @@ func (o *offlineSnapshotManager) downloadDataSnapshot() error {
 	return fmt.Errorf("downloadDataSnapshot called for offlineSnapshotManager")
 }
 
+func (o *offlineSnapshotManager) downloadTableSnapshot(tableName string) (string, error) {
+	return "", fmt.Errorf("downloadTableSnapshot called for offlineSnapshotManager")
+}
+
+func (o *offlineSnapshotManager) downloadScopeSnapshot(scopes []string) (string, error) {
+	return "", fmt.Errorf("downloadScopeSnapshot called for offlineSnapshotManager")
+}
+
 func (o *offlineSnapshotManager) startOnDataSnapshot(snapshotName string) error {
 	log.Infof("Processing snapshot: %s", snapshotName)
 	snapshot := &common.Snapshot{
@@ -295,6 +664,7 @@ func (o *offlineSnapshotManager) startOnDataSnapshot(snapshotName string) error
 		return fmt.Errorf("timeout, plugins failed to respond to snapshot")
 	case <-eventService.Emit(ApigeeSyncEventSelector, snapshot):
 		// the new snapshot has been processed
+		snapshotGc.deliver(snapshot.SnapshotInfo)
 	}
 	return nil
 }
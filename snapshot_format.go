@@ -0,0 +1,510 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/apid/apid-core/data"
+	"github.com/apigee-labs/transicator/common"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// values of configSnapshotProtocol
+const (
+	snapshotProtocolSqlite   = "sqlite"
+	snapshotProtocolJson     = "json"
+	snapshotProtocolProtobuf = "protobuf"
+)
+
+const sqliteContentType = "application/transicator+sqlite"
+
+// the Accept header of snapshot requests, for the configured protocol
+func snapshotAcceptHeader() string {
+	switch config.GetString(configSnapshotProtocol) {
+	case snapshotProtocolJson:
+		return jsonContentType
+	case snapshotProtocolProtobuf:
+		return protobufContentType
+	}
+	return sqliteContentType
+}
+
+// the format of a snapshot response, by its Content-Type, or the configured protocol if it has none
+func snapshotResponseFormat(r *http.Response) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case sqliteContentType:
+		return snapshotProtocolSqlite
+	case jsonContentType:
+		return snapshotProtocolJson
+	case protobufContentType:
+		return snapshotProtocolProtobuf
+	}
+	return config.GetString(configSnapshotProtocol)
+}
+
+// the SQLite DB built from a JSON or protobuf snapshot, before it replaces the staging file
+func materializedSnapshotPath(dbId string) string {
+	return filepath.Dir(data.DBPath("common/"+dbId)) + ".sqlite" + partialSnapshotSuffix
+}
+
+/*
+ * Replaces the staging file of DB version dbId, a complete JSON or protobuf snapshot,
+ * by a SQLite DB of the same tables, with their _transicator_tables entries, as a
+ * SQLite snapshot would have. The snapshot is decoded as it is read, table by table.
+ */
+func materializeSnapshot(dbId, format string) error {
+	in, err := os.Open(snapshotStagingPath(dbId))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	outPath := materializedSnapshotPath(dbId)
+	os.Remove(outPath)
+	b, err := createSnapshotBuilder(outPath)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case snapshotProtocolJson:
+		err = decodeJsonSnapshot(in, b)
+	case snapshotProtocolProtobuf:
+		err = decodeProtobufSnapshot(in, b)
+	default:
+		err = fmt.Errorf("unsupported snapshot format %s", format)
+	}
+	if err == nil {
+		err = b.commit()
+	}
+	b.close()
+	if err != nil {
+		os.Remove(outPath)
+		return fmt.Errorf("unable to decode %s snapshot: %v", format, err)
+	}
+	log.Infof("Materialized %s snapshot %s with %d tables", format, dbId, b.numTables)
+	return os.Rename(outPath, snapshotStagingPath(dbId))
+}
+
+/*
+ * Decodes the JSON of a common.Snapshot, one row at a time, so the whole
+ * snapshot is never in memory. Columns come from the rows of each table.
+ */
+func decodeJsonSnapshot(r io.Reader, b *snapshotBuilder) error {
+	dec := json.NewDecoder(r)
+	if err := expectJsonDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := jsonKey(dec)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "snapshotInfo":
+			var snapshotInfo string
+			if err = dec.Decode(&snapshotInfo); err != nil {
+				return err
+			}
+			if err = b.setSnapshotInfo(snapshotInfo); err != nil {
+				return err
+			}
+		case "tables":
+			isArray, err := startJsonArray(dec)
+			if err != nil {
+				return err
+			}
+			for isArray && dec.More() {
+				if err = decodeJsonTable(dec, b); err != nil {
+					return err
+				}
+			}
+			if isArray {
+				if err = expectJsonDelim(dec, ']'); err != nil {
+					return err
+				}
+			}
+		default:
+			var skipped json.RawMessage
+			if err = dec.Decode(&skipped); err != nil {
+				return err
+			}
+		}
+	}
+	return expectJsonDelim(dec, '}')
+}
+
+func decodeJsonTable(dec *json.Decoder, b *snapshotBuilder) error {
+	if err := expectJsonDelim(dec, '{'); err != nil {
+		return err
+	}
+	var name string
+	// rows before the name of the table
+	var pending []common.Row
+	started := false
+	for dec.More() {
+		key, err := jsonKey(dec)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "name":
+			if err = dec.Decode(&name); err != nil {
+				return err
+			}
+		case "rows":
+			isArray, err := startJsonArray(dec)
+			if err != nil {
+				return err
+			}
+			for isArray && dec.More() {
+				var row common.Row
+				if err = dec.Decode(&row); err != nil {
+					return err
+				}
+				if name == "" {
+					pending = append(pending, row)
+					continue
+				}
+				if !started {
+					if err = b.startTable(name, rowColumns(row)); err != nil {
+						return err
+					}
+					started = true
+				}
+				if err = b.insertRow(row); err != nil {
+					return err
+				}
+			}
+			if isArray {
+				if err = expectJsonDelim(dec, ']'); err != nil {
+					return err
+				}
+			}
+		default:
+			var skipped json.RawMessage
+			if err = dec.Decode(&skipped); err != nil {
+				return err
+			}
+		}
+	}
+	if err := expectJsonDelim(dec, '}'); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("snapshot table without a name")
+	}
+	if started {
+		return nil
+	}
+	var columns []common.ColumnInfo
+	if len(pending) > 0 {
+		columns = rowColumns(pending[0])
+	}
+	if err := b.startTable(name, columns); err != nil {
+		return err
+	}
+	for _, row := range pending {
+		if err := b.insertRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the columns of a JSON row, by name
+func rowColumns(row common.Row) []common.ColumnInfo {
+	var columns []common.ColumnInfo
+	for name, cv := range row {
+		var typid int32
+		if cv != nil {
+			typid = cv.Type
+		}
+		columns = append(columns, common.ColumnInfo{Name: name, Type: typid})
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].Name < columns[j].Name
+	})
+	return columns
+}
+
+func jsonKey(dec *json.Decoder) (string, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, found %v", t)
+	}
+	return key, nil
+}
+
+// reads the start of an array, or null
+func startJsonArray(dec *json.Decoder) (bool, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	switch t {
+	case nil:
+		return false, nil
+	case json.Delim('['):
+		return true, nil
+	}
+	return false, fmt.Errorf("expected an array, found %v", t)
+}
+
+func expectJsonDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("expected %v, found %v", delim, t)
+	}
+	return nil
+}
+
+// decodes a protobuf snapshot, streamed by transicator's SnapshotReader
+func decodeProtobufSnapshot(r io.Reader, b *snapshotBuilder) error {
+	reader, err := common.CreateSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+	if err = b.setSnapshotInfo(reader.SnapshotInfo()); err != nil {
+		return err
+	}
+	for {
+		switch next := reader.Next().(type) {
+		case nil:
+			return nil
+		case error:
+			return next
+		case common.TableInfo:
+			if err = b.startTable(next.Name, next.Columns); err != nil {
+				return err
+			}
+		case common.Row:
+			if err = b.insertRow(next); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected snapshot content %T", next)
+		}
+	}
+}
+
+/*
+ * Builds a SQLite snapshot file in a single transaction. JSON and protobuf snapshots
+ * don't tell the primary keys, they are taken from the current DB version if it has the table.
+ */
+type snapshotBuilder struct {
+	db *sql.DB
+	tx *sql.Tx
+	// columns of the tables of the current DB version
+	current   map[string][]snapshotColumn
+	table     string
+	columns   map[string]bool
+	insertSql map[string]*sql.Stmt
+	numTables int
+}
+
+func createSnapshotBuilder(path string) (*snapshotBuilder, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	b := &snapshotBuilder{db: db, current: readCurrentSchema()}
+	// the file is only installed once complete, it needs no journal
+	for _, pragma := range []string{"PRAGMA journal_mode=OFF", "PRAGMA synchronous=OFF"} {
+		if _, err = db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if b.tx, err = db.Begin(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE _transicator_metadata (key varchar primary key, value varchar)",
+		"CREATE TABLE _transicator_tables (tableName varchar not null, columnName varchar not null, typid integer, primaryKey bool)",
+	} {
+		if _, err = b.tx.Exec(stmt); err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *snapshotBuilder) setSnapshotInfo(snapshotInfo string) error {
+	_, err := b.tx.Exec("INSERT OR REPLACE INTO _transicator_metadata (key, value) VALUES ('snapshot', ?)", snapshotInfo)
+	return err
+}
+
+/*
+ * Creates the table. Without columns, as for an empty table in JSON, the columns of the
+ * table in the current DB version are used, and the table is left out if it has none.
+ */
+func (b *snapshotBuilder) startTable(name string, columns []common.ColumnInfo) error {
+	b.table = normalizeTableName(name)
+	b.columns = make(map[string]bool)
+	b.insertSql = make(map[string]*sql.Stmt)
+
+	primaryKeys := make(map[string]bool)
+	for _, c := range b.current[b.table] {
+		if c.primaryKey.Valid && c.primaryKey.Bool {
+			primaryKeys[c.name] = true
+		}
+	}
+	if len(columns) == 0 {
+		for _, c := range b.current[b.table] {
+			columns = append(columns, common.ColumnInfo{Name: c.name, Type: int32(c.typid.Int64)})
+		}
+		if len(columns) == 0 {
+			log.Warnf("Leaving out empty table %s of the snapshot, its columns are unknown", b.table)
+			b.table = ""
+			return nil
+		}
+	}
+
+	var defs, pkeys []string
+	for _, c := range columns {
+		defs = append(defs, c.Name+" "+sqliteColumnType(int64(c.Type)))
+		if primaryKeys[c.Name] {
+			pkeys = append(pkeys, c.Name)
+		}
+		if err := b.addTransicatorColumn(c, primaryKeys[c.Name]); err != nil {
+			return err
+		}
+	}
+	if len(pkeys) > 0 {
+		defs = append(defs, "primary key ("+strings.Join(pkeys, ",")+")")
+	} else {
+		log.Infof("No primary keys known for table %s, changes match its rows on all columns", b.table)
+	}
+	if _, err := b.tx.Exec("CREATE TABLE " + b.table + " (" + strings.Join(defs, ",") + ")"); err != nil {
+		return fmt.Errorf("unable to create table %s: %v", b.table, err)
+	}
+	b.numTables++
+	return nil
+}
+
+func (b *snapshotBuilder) addTransicatorColumn(c common.ColumnInfo, primaryKey bool) error {
+	_, err := b.tx.Exec("INSERT INTO _transicator_tables (tableName, columnName, typid, primaryKey) VALUES (?,?,?,?)",
+		b.table, c.Name, c.Type, primaryKey)
+	b.columns[c.Name] = true
+	return err
+}
+
+// inserts a row in the current table, adding columns the table doesn't have yet
+func (b *snapshotBuilder) insertRow(row common.Row) error {
+	if b.table == "" {
+		return fmt.Errorf("snapshot row outside of a table")
+	}
+	var columns []string
+	for name, cv := range row {
+		if !b.columns[name] {
+			var typid int32
+			if cv != nil {
+				typid = cv.Type
+			}
+			_, err := b.tx.Exec("ALTER TABLE " + b.table + " ADD COLUMN " + name + " " + sqliteColumnType(int64(typid)))
+			if err != nil {
+				return fmt.Errorf("unable to add column %s to %s: %v", name, b.table, err)
+			}
+			if err = b.addTransicatorColumn(common.ColumnInfo{Name: name, Type: typid}, false); err != nil {
+				return err
+			}
+		}
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	// rows of a table mostly have the same columns
+	key := strings.Join(columns, ",")
+	stmt := b.insertSql[key]
+	if stmt == nil {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+		var err error
+		stmt, err = b.tx.Prepare("INSERT INTO " + b.table + " (" + key + ") VALUES (" + placeholders + ")")
+		if err != nil {
+			return err
+		}
+		b.insertSql[key] = stmt
+	}
+	values := make([]interface{}, len(columns))
+	for i, name := range columns {
+		if cv := row[name]; cv != nil {
+			values[i] = cv.Value
+		}
+	}
+	if _, err := stmt.Exec(values...); err != nil {
+		return fmt.Errorf("unable to insert row of %s: %v", b.table, err)
+	}
+	return nil
+}
+
+func (b *snapshotBuilder) commit() error {
+	return b.tx.Commit()
+}
+
+func (b *snapshotBuilder) close() {
+	b.tx.Rollback()
+	b.db.Close()
+}
+
+// the _transicator_tables entries of the current DB version, by table
+func readCurrentSchema() map[string][]snapshotColumn {
+	schema := make(map[string][]snapshotColumn)
+	if apidInfo.LastSnapshot == "" {
+		return schema
+	}
+	path := data.DBPath("common/" + apidInfo.LastSnapshot)
+	if _, err := os.Stat(path); err != nil {
+		return schema
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return schema
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT tableName, columnName, typid, primaryKey FROM _transicator_tables")
+	if err != nil {
+		log.Warnf("Unable to read the tables of snapshot %s: %v", apidInfo.LastSnapshot, err)
+		return schema
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tableName string
+		var c snapshotColumn
+		if err = rows.Scan(&tableName, &c.name, &c.typid, &c.primaryKey); err != nil {
+			log.Warnf("Unable to read the tables of snapshot %s: %v", apidInfo.LastSnapshot, err)
+			return schema
+		}
+		schema[tableName] = append(schema[tableName], c)
+	}
+	return schema
+}
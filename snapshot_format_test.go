@@ -0,0 +1,260 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"bytes"
+	"github.com/apid/apid-core/data"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Snapshot formats", func() {
+	testCount := 0
+	var source *common.Snapshot
+
+	// the tables of the mock data snapshot, with the typids of their columns
+	mockSnapshot := func() *common.Snapshot {
+		dbId := "format_source_" + strconv.Itoa(testCount)
+		Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(mockSnapshotData("./sql/init_mock_db.sql")),
+			&common.Snapshot{})).Should(Succeed())
+		defer removeSnapshotFile(dbId)
+		defer dataService.ReleaseDB(dbId)
+		db, err := dataService.DBVersion(dbId)
+		Expect(err).Should(Succeed())
+		tableNames, err := readSnapshotTableNames(db)
+		Expect(err).Should(Succeed())
+
+		snapshot := &common.Snapshot{SnapshotInfo: "1142790:1142790:", Timestamp: "2017-08-23T17:23:00Z"}
+		for _, tableName := range tableNames {
+			table, err := readSnapshotTable(db, tableName)
+			Expect(err).Should(Succeed())
+			for _, row := range table.rows {
+				for _, c := range table.columns {
+					row[c.name].Type = int32(c.typid.Int64)
+					// blobs would be base64 in JSON
+					if b, ok := row[c.name].Value.([]byte); ok {
+						row[c.name].Value = string(b)
+					}
+				}
+			}
+			snapshot.Tables = append(snapshot.Tables, common.Table{Name: tableName, Rows: table.rows})
+		}
+		return snapshot
+	}
+
+	encode := func(snapshot *common.Snapshot, format string) []byte {
+		if format == snapshotProtocolJson {
+			return snapshot.Marshal()
+		}
+		buf := &bytes.Buffer{}
+		Expect(snapshot.MarshalProto(buf)).Should(Succeed())
+		return buf.Bytes()
+	}
+
+	// materializes the encoded snapshot as DB version dbId
+	materialize := func(dbId, format string, encoded []byte) error {
+		_, err := writeSnapshotFile(dbId, bytes.NewReader(encoded), 0)
+		Expect(err).Should(Succeed())
+		if err = materializeSnapshot(dbId, format); err != nil {
+			return err
+		}
+		return installSnapshotFile(dbId)
+	}
+
+	query := func(dbId, sql string, args ...interface{}) []common.Row {
+		db, err := dataService.DBVersion(dbId)
+		Expect(err).Should(Succeed())
+		rows, err := db.Query(sql, args...)
+		Expect(err).Should(Succeed())
+		defer rows.Close()
+		columns, err := rows.Columns()
+		Expect(err).Should(Succeed())
+		var result []common.Row
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			Expect(rows.Scan(pointers...)).Should(Succeed())
+			row := common.Row{}
+			for i, name := range columns {
+				if b, ok := values[i].([]byte); ok {
+					values[i] = string(b)
+				}
+				row[name] = &common.ColumnVal{Value: values[i]}
+			}
+			result = append(result, row)
+		}
+		Expect(rows.Err()).Should(Succeed())
+		return result
+	}
+
+	BeforeEach(func() {
+		testCount++
+		source = mockSnapshot()
+	})
+
+	AfterEach(func() {
+		config.Set(configSnapshotProtocol, snapshotProtocolSqlite)
+		apidInfo.LastSnapshot = ""
+	})
+
+	for _, format := range []string{snapshotProtocolJson, snapshotProtocolProtobuf} {
+		format := format
+
+		It("should download and materialize a "+format+" snapshot", func() {
+			contentType := map[string]string{snapshotProtocolJson: jsonContentType, snapshotProtocolProtobuf: protobufContentType}[format]
+			var accept string
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accept = r.Header.Get("Accept")
+				w.Header().Set(headerSnapshotNumber, "format_"+format+"_"+strconv.Itoa(testCount))
+				w.Header().Set("Content-Type", contentType)
+				w.Write(encode(source, format))
+			}))
+			defer testServer.Close()
+			config.Set(configSnapServerBaseURI, testServer.URL)
+			defer config.Set(configSnapServerBaseURI, dummyConfigValue)
+			config.Set(configSnapshotProtocol, format)
+			initialBackoffInterval = time.Millisecond
+			testSnapMan := createSnapShotManager(&dummyDbManager{}, &dummyTokenManager{invalidateChan: make(chan bool, 1)}, &http.Client{})
+			defer func() { <-testSnapMan.close() }()
+
+			snapshot := &common.Snapshot{}
+			testSnapMan.downloadSnapshot(false, []string{"s1"}, snapshot)
+			Expect(accept).Should(Equal(contentType))
+			dbId := "format_" + format + "_" + strconv.Itoa(testCount)
+			Expect(snapshot.SnapshotInfo).Should(Equal(dbId))
+			defer dataService.ReleaseDB(dbId)
+
+			Expect(query(dbId, "SELECT value FROM _transicator_metadata WHERE key='snapshot'")[0]["value"].Value).
+				Should(Equal(source.SnapshotInfo))
+			for _, table := range source.Tables {
+				if len(table.Rows) == 0 {
+					// without a current DB version, the columns of empty tables are unknown
+					continue
+				}
+				Expect(query(dbId, "SELECT * FROM "+table.Name)).Should(HaveLen(len(table.Rows)), table.Name)
+				Expect(query(dbId, "SELECT columnName FROM _transicator_tables WHERE tableName=?", table.Name)).
+					Should(HaveLen(len(table.Rows[0])), table.Name)
+			}
+			for _, table := range source.Tables {
+				if table.Name == "edgex_apid_cluster" {
+					cluster := query(dbId, "SELECT * FROM edgex_apid_cluster")
+					Expect(cluster[0]["id"].Value).Should(Equal(table.Rows[0]["id"].Value))
+				}
+			}
+			typids := query(dbId, "SELECT typid FROM _transicator_tables WHERE tableName='edgex_apid_cluster' AND columnName='created'")
+			Expect(typids[0]["typid"].Value).Should(BeEquivalentTo(typidTimestamp))
+		})
+
+		It("should reject a corrupted "+format+" snapshot", func() {
+			dbId := "format_corrupted_" + strconv.Itoa(testCount)
+			encoded := encode(source, format)
+			Expect(materialize(dbId, format, encoded[:len(encoded)/2])).ShouldNot(Succeed())
+			Expect(snapshotStagingPath(dbId)).Should(BeAnExistingFile())
+			_, err := os.Stat(materializedSnapshotPath(dbId))
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+			removeSnapshotFile(dbId)
+		})
+	}
+
+	It("should take primary keys from the current DB version", func() {
+		current := "format_current_" + strconv.Itoa(testCount)
+		Expect(processSnapshotServerFileResponse(current, bytes.NewReader(mockSnapshotData("./sql/init_mock_db.sql")),
+			&common.Snapshot{})).Should(Succeed())
+		defer removeSnapshotFile(current)
+		pkeysQuery := "SELECT columnName FROM _transicator_tables WHERE tableName='kms_developer' AND primaryKey ORDER BY columnName"
+		expected := query(current, pkeysQuery)
+		dataService.ReleaseDB(current)
+		Expect(expected).ShouldNot(BeEmpty())
+
+		dbId := "format_pkeys_" + strconv.Itoa(testCount)
+		Expect(materialize(dbId, snapshotProtocolJson, source.Marshal())).Should(Succeed())
+		Expect(query(dbId, pkeysQuery)).Should(BeEmpty())
+		dataService.ReleaseDB(dbId)
+		removeSnapshotFile(dbId)
+
+		apidInfo.LastSnapshot = current
+		Expect(materialize(dbId, snapshotProtocolJson, source.Marshal())).Should(Succeed())
+		defer dataService.ReleaseDB(dbId)
+		Expect(query(dbId, pkeysQuery)).Should(Equal(expected))
+		Expect(verifySnapshotDb(data.DBPath("common/" + dbId))).Should(Succeed())
+	})
+
+	It("should stream JSON tables in any key order", func() {
+		current := "format_current_" + strconv.Itoa(testCount)
+		Expect(processSnapshotServerFileResponse(current, bytes.NewReader(mockSnapshotData("./sql/init_mock_db.sql")),
+			&common.Snapshot{})).Should(Succeed())
+		defer removeSnapshotFile(current)
+		dataService.ReleaseDB(current)
+		apidInfo.LastSnapshot = current
+
+		dbId := "format_order_" + strconv.Itoa(testCount)
+		Expect(materialize(dbId, snapshotProtocolJson, []byte(`{"tables": [
+			{"rows": [{"id": {"value": "c1", "type": 1043}}], "ignored": [1, {"a": 2}], "name": "edgex.apid_cluster"},
+			{"name": "kms_developer", "rows": []},
+			{"name": "unknown_empty", "rows": []},
+			{"name": "new_table", "rows": [
+				{"a": {"value": "a1", "type": 25}},
+				{"a": {"value": "a2", "type": 25}, "b": {"value": 2, "type": 23}}]}
+			], "snapshotInfo": "info", "timestamp": "2017-08-23T17:23:00Z"}`))).Should(Succeed())
+		defer dataService.ReleaseDB(dbId)
+
+		Expect(query(dbId, "SELECT value FROM _transicator_metadata")[0]["value"].Value).Should(Equal("info"))
+		Expect(query(dbId, "SELECT id FROM edgex_apid_cluster")[0]["id"].Value).Should(Equal("c1"))
+		// the empty table has the columns of the current DB version
+		Expect(query(dbId, "SELECT * FROM _transicator_tables WHERE tableName='kms_developer'")).
+			Should(HaveLen(len(query(current, "SELECT * FROM _transicator_tables WHERE tableName='kms_developer'"))))
+		dataService.ReleaseDB(current)
+		Expect(query(dbId, "SELECT name FROM sqlite_master WHERE name='unknown_empty'")).Should(BeEmpty())
+		rows := query(dbId, "SELECT a, b FROM new_table ORDER BY a")
+		Expect(rows).Should(HaveLen(2))
+		Expect(rows[0]["b"].Value).Should(BeNil())
+		Expect(rows[1]["b"].Value).Should(BeEquivalentTo(2))
+		Expect(query(dbId, "SELECT typid FROM _transicator_tables WHERE tableName='new_table' AND columnName='b'")[0]["typid"].Value).
+			Should(BeEquivalentTo(typidInt4))
+	})
+
+	It("should only accept known snapshot protocols", func() {
+		for _, proto := range []string{snapshotProtocolSqlite, snapshotProtocolJson, snapshotProtocolProtobuf} {
+			config.Set(configSnapshotProtocol, proto)
+			Expect(checkForRequiredValues(true)).Should(Succeed())
+		}
+		config.Set(configSnapshotProtocol, "xml")
+		Expect(checkForRequiredValues(true)).Should(MatchError(ContainSubstring(configSnapshotProtocol)))
+	})
+
+	It("should decode by the Content-Type of the response", func() {
+		config.Set(configSnapshotProtocol, snapshotProtocolProtobuf)
+		for contentType, format := range map[string]string{
+			sqliteContentType:                   snapshotProtocolSqlite,
+			jsonContentType + "; charset=utf-8": snapshotProtocolJson,
+			protobufContentType:                 snapshotProtocolProtobuf,
+			"":                                  snapshotProtocolProtobuf,
+		} {
+			r := &http.Response{Header: http.Header{}}
+			r.Header.Set("Content-Type", contentType)
+			Expect(snapshotResponseFormat(r)).Should(Equal(format))
+		}
+	})
+})
@@ -0,0 +1,252 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var snapshotGc = createSnapshotCollector()
+
+/*
+ * Deletes the DB versions of old snapshots. The current version and the configSnapshotRetention
+ * previous ones are kept. Older versions are deleted once nothing references them anymore:
+ * the dbManager references the version it applies changes to, and plugins the version of the
+ * last snapshot event they processed, until they have processed the next one.
+ */
+type snapshotCollector struct {
+	mux sync.Mutex
+	// oldest first, the last one is current
+	versions []string
+	refs     map[string]int
+	// version of the last snapshot event processed by plugins
+	delivered      string
+	reclaimedBytes int64
+	removed        int64
+}
+
+// disk space reclaimed from old snapshots
+type snapshotGcMetrics struct {
+	// DB versions kept on disk
+	Versions       int   `json:"versions"`
+	Removed        int64 `json:"removed"`
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+func createSnapshotCollector() *snapshotCollector {
+	return &snapshotCollector{
+		refs: make(map[string]int),
+	}
+}
+
+// makes version the current one, referenced until release()
+func (c *snapshotCollector) activate(version string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.versions) > 0 && c.versions[len(c.versions)-1] == version {
+		return
+	}
+	for i, v := range c.versions {
+		if v == version {
+			c.versions = append(c.versions[:i], c.versions[i+1:]...)
+			break
+		}
+	}
+	c.versions = append(c.versions, version)
+	c.refs[version]++
+	c.collect()
+}
+
+func (c *snapshotCollector) release(version string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.refs[version] > 0 {
+		c.refs[version]--
+	}
+	c.collect()
+}
+
+// plugins have processed the snapshot event of version, and no longer use the previous one
+func (c *snapshotCollector) deliver(version string) {
+	c.mux.Lock()
+	previous := c.delivered
+	c.delivered = version
+	c.refs[version]++
+	c.mux.Unlock()
+	if previous != "" {
+		c.release(previous)
+	}
+}
+
+// deletes the expired versions without references, must hold mux
+func (c *snapshotCollector) collect() {
+	expired := len(c.versions) - 1 - config.GetInt(configSnapshotRetention)
+	var kept []string
+	for i, version := range c.versions {
+		if i >= expired || c.refs[version] > 0 {
+			kept = append(kept, version)
+			continue
+		}
+		c.remove(version)
+		delete(c.refs, version)
+	}
+	c.versions = kept
+}
+
+func (c *snapshotCollector) remove(version string) {
+	dir := filepath.Dir(data.DBPath("common/" + version))
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warnf("Unable to remove old snapshot %s: %v", version, err)
+		return
+	}
+	forgetSnapshotVersion(version)
+	c.removed++
+	c.reclaimedBytes += size
+	log.Infof("Removed old snapshot %s, reclaimed %d bytes (%d bytes in total)", version, size, c.reclaimedBytes)
+}
+
+/*
+ * Finds the DB versions left on disk by earlier runs, at startup. Only the versions recorded
+ * by installSnapshotFile() are considered, in the order they were installed. Partial snapshots
+ * are removed, and the versions older than current are collected.
+ */
+func (c *snapshotCollector) collectAtStartup(current string) {
+	recorded, err := readSnapshotVersions()
+	if err != nil {
+		log.Warnf("Unable to find old snapshots: %v", err)
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	tracked := make(map[string]bool)
+	for _, version := range c.versions {
+		tracked[version] = true
+	}
+	var versions []string
+	for _, version := range recorded {
+		if version == current || tracked[version] {
+			continue
+		}
+		if _, err := os.Stat(data.DBPath("common/" + version)); err != nil {
+			forgetSnapshotVersion(version)
+			continue
+		}
+		if strings.HasPrefix(version, tableSnapshotPrefix) || version == scopeSnapshotName {
+			c.remove(version)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	for _, version := range c.versions {
+		if version != current {
+			versions = append(versions, version)
+		}
+	}
+	if current != "" {
+		versions = append(versions, current)
+	}
+	c.versions = versions
+	c.collect()
+}
+
+func (c *snapshotCollector) getMetrics() snapshotGcMetrics {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return snapshotGcMetrics{
+		Versions:       len(c.versions),
+		Removed:        c.removed,
+		ReclaimedBytes: c.reclaimedBytes,
+	}
+}
+
+// the directory of the DB versions, shared with the DBs of apid and of other plugins
+func commonDbDir() string {
+	return filepath.Dir(filepath.Dir(data.DBPath("common/" + scopeSnapshotName)))
+}
+
+/*
+ * The DB versions installed by this plugin are recorded in the default DB, oldest first.
+ * Only those are ever collected, the directory of DB versions isn't the plugin's own.
+ */
+func createSnapshotVersionsTable(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_SNAPSHOT_VERSIONS (
+	    id integer PRIMARY KEY AUTOINCREMENT,
+	    version text UNIQUE
+	);
+	`)
+	return err
+}
+
+// records a version about to be installed, a version installed again becomes the newest
+func recordSnapshotVersion(version string) error {
+	db, err := dataService.DB()
+	if err != nil {
+		return err
+	}
+	if err = createSnapshotVersionsTable(db); err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO APID_SNAPSHOT_VERSIONS (version) VALUES (?)", version)
+	return err
+}
+
+func forgetSnapshotVersion(version string) {
+	db, err := dataService.DB()
+	if err == nil {
+		_, err = db.Exec("DELETE FROM APID_SNAPSHOT_VERSIONS WHERE version=?", version)
+	}
+	if err != nil {
+		log.Warnf("Unable to forget snapshot %s: %v", version, err)
+	}
+}
+
+// the recorded versions, oldest first
+func readSnapshotVersions() ([]string, error) {
+	db, err := dataService.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err = createSnapshotVersionsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version FROM APID_SNAPSHOT_VERSIONS ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []string
+	for rows.Next() {
+		var version string
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
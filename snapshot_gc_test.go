@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var _ = Describe("Snapshot garbage collection", func() {
+	testCount := 0
+	var collector *snapshotCollector
+	var storagePath string
+
+	// creates a DB version on disk, of size bytes
+	createVersion := func(version string, size int) {
+		path := data.DBPath("common/" + version)
+		Expect(os.MkdirAll(filepath.Dir(path), 0700)).Should(Succeed())
+		Expect(ioutil.WriteFile(path, make([]byte, size), 0600)).Should(Succeed())
+	}
+
+	exists := func(version string) bool {
+		_, err := os.Stat(data.DBPath("common/" + version))
+		return err == nil
+	}
+
+	version := func(name string) string {
+		return "gc_" + strconv.Itoa(testCount) + "_" + name
+	}
+
+	// switches from the previous version to the next, as processSnapshot() does
+	activate := func(previous, next string) {
+		collector.activate(next)
+		if previous != "" {
+			collector.release(previous)
+		}
+	}
+
+	BeforeEach(func() {
+		testCount++
+		collector = createSnapshotCollector()
+		storagePath = config.GetString(configLocalStoragePath)
+	})
+
+	AfterEach(func() {
+		config.Set(configSnapshotRetention, 1)
+		config.Set(configLocalStoragePath, storagePath)
+	})
+
+	It("should keep the current version and the previous ones", func() {
+		for _, retention := range []int{0, 1, 2} {
+			config.Set(configSnapshotRetention, retention)
+			collector = createSnapshotCollector()
+			var versions []string
+			for i := 0; i < 4; i++ {
+				v := version(strconv.Itoa(retention) + "_" + strconv.Itoa(i))
+				createVersion(v, 100)
+				previous := ""
+				if i > 0 {
+					previous = versions[i-1]
+				}
+				activate(previous, v)
+				versions = append(versions, v)
+			}
+			for i, v := range versions {
+				Expect(exists(v)).Should(Equal(i >= 3-retention), v)
+			}
+			Expect(collector.getMetrics()).Should(Equal(snapshotGcMetrics{
+				Versions:       retention + 1,
+				Removed:        int64(3 - retention),
+				ReclaimedBytes: int64(100 * (3 - retention)),
+			}))
+		}
+	})
+
+	It("should keep a version until plugins processed the next one", func() {
+		config.Set(configSnapshotRetention, 0)
+		v1, v2 := version("1"), version("2")
+		createVersion(v1, 10)
+		createVersion(v2, 10)
+		activate("", v1)
+		collector.deliver(v1)
+		activate(v1, v2)
+		Expect(exists(v1)).Should(BeTrue())
+		collector.deliver(v2)
+		Expect(exists(v1)).Should(BeFalse())
+		Expect(exists(v2)).Should(BeTrue())
+	})
+
+	It("should count the current version once", func() {
+		config.Set(configSnapshotRetention, 0)
+		v1, v2 := version("1"), version("2")
+		createVersion(v1, 10)
+		createVersion(v2, 10)
+		activate("", v1)
+		// a restart processes the current snapshot again
+		activate("", v1)
+		collector.deliver(v1)
+		collector.deliver(v1)
+		activate(v1, v2)
+		collector.deliver(v2)
+		Expect(exists(v1)).Should(BeFalse())
+	})
+
+	It("should remove old versions at startup", func() {
+		config.Set(configLocalStoragePath, filepath.Join(storagePath, version("storage")))
+		// in the order they were installed
+		for _, v := range []string{"old_1", "old_2", "current", "old_3", tableSnapshotPrefix + "kms_app", scopeSnapshotName} {
+			Expect(recordSnapshotVersion(v)).Should(Succeed())
+			createVersion(v, 10)
+		}
+		// installed again
+		Expect(recordSnapshotVersion("old_1")).Should(Succeed())
+		// next to apid's default DB, common/base, holding the records
+		createVersion("other_plugin", 10)
+		Expect(recordSnapshotVersion("gone")).Should(Succeed())
+		partial := snapshotStagingPath("next")
+		Expect(ioutil.WriteFile(partial, []byte("partial"), 0600)).Should(Succeed())
+
+		collector.collectAtStartup("current")
+		for v, kept := range map[string]bool{
+			"old_1":                         true,
+			"old_2":                         false,
+			"old_3":                         false,
+			"current":                       true,
+			"base":                          true,
+			"other_plugin":                  true,
+			tableSnapshotPrefix + "kms_app": false,
+			scopeSnapshotName:               false,
+		} {
+			Expect(exists(v)).Should(Equal(kept), v)
+		}
+		Expect(partial).Should(BeAnExistingFile())
+		Expect(collector.getMetrics()).Should(Equal(snapshotGcMetrics{Versions: 2, Removed: 4, ReclaimedBytes: 40}))
+		Expect(readSnapshotVersions()).Should(Equal([]string{"current", "old_1"}))
+
+		// the current version is collected once replaced
+		createVersion("next", 10)
+		activate("current", "next")
+		Expect(exists("old_1")).Should(BeFalse())
+		Expect(exists("current")).Should(BeTrue())
+	})
+
+	It("should reject a negative retention", func() {
+		config.Set(configSnapshotRetention, -1)
+		Expect(checkForRequiredValues(true)).Should(MatchError(ContainSubstring(configSnapshotRetention)))
+	})
+})
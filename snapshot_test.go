@@ -15,13 +15,19 @@
 package apidApigeeSync
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/apid/apid-core"
 	"github.com/apid/apid-core/api"
+	"github.com/apid/apid-core/data"
 	"github.com/apigee-labs/transicator/common"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -64,6 +70,174 @@ var _ = Describe("Snapshot Manager", func() {
 		})
 	})
 
+	Context("resumable snapshot download", func() {
+		var testSnapMan *apidSnapshotManager
+		var testServer *httptest.Server
+		var snapshotData []byte
+		var rangeHeaders, ifRangeHeaders []string
+		// TXID of the snapshot served after the first, interrupted response
+		var resumedTxid string
+		var supportsRanges bool
+
+		// cuts the connection after half of the snapshot, then serves ranges if supported
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+			ifRangeHeaders = append(ifRangeHeaders, r.Header.Get("If-Range"))
+			if len(rangeHeaders) == 1 {
+				conn, buf, err := w.(http.Hijacker).Hijack()
+				Expect(err).Should(Succeed())
+				fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\n%s: txid-1\r\nContent-Length: %d\r\n\r\n",
+					headerSnapshotNumber, len(snapshotData))
+				buf.Write(snapshotData[:len(snapshotData)/2])
+				buf.Flush()
+				conn.Close()
+				return
+			}
+			w.Header().Set(headerSnapshotNumber, resumedTxid)
+			var start int
+			if supportsRanges && r.Header.Get("If-Range") == `"`+resumedTxid+`"` &&
+				r.Header.Get("Range") != "" {
+				_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+				Expect(err).Should(Succeed())
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(snapshotData)-1, len(snapshotData)))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			w.Write(snapshotData[start:])
+		}
+
+		download := func() *common.Snapshot {
+			snapshot := &common.Snapshot{}
+			testSnapMan.downloadSnapshot(false, []string{"s1"}, snapshot)
+			downloaded, err := ioutil.ReadFile(data.DBPath("common/" + snapshot.SnapshotInfo))
+			Expect(err).Should(Succeed())
+			Expect(downloaded).Should(Equal(snapshotData))
+			return snapshot
+		}
+
+		BeforeEach(func() {
+			snapshotData = mockSnapshotData("./sql/init_mock_db.sql")
+			rangeHeaders, ifRangeHeaders = nil, nil
+			resumedTxid, supportsRanges = "txid-1", true
+			testServer = httptest.NewServer(http.HandlerFunc(handler))
+			config.Set(configSnapServerBaseURI, testServer.URL)
+			initialBackoffInterval = time.Millisecond
+			dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+			testSnapMan = createSnapShotManager(dummyDbMan, dummyTokenMan, &http.Client{})
+		})
+
+		AfterEach(func() {
+			testServer.Close()
+			<-testSnapMan.close()
+			config.Set(configSnapServerBaseURI, dummyConfigValue)
+		})
+
+		It("should resume an interrupted download", func() {
+			Expect(download().SnapshotInfo).Should(Equal("txid-1"))
+			Expect(rangeHeaders).Should(Equal([]string{"", fmt.Sprintf("bytes=%d-", len(snapshotData)/2)}))
+			Expect(ifRangeHeaders).Should(Equal([]string{"", `"txid-1"`}))
+		})
+
+		It("should download again if the server doesn't support ranges", func() {
+			supportsRanges = false
+			Expect(download().SnapshotInfo).Should(Equal("txid-1"))
+			Expect(rangeHeaders).Should(HaveLen(2))
+		})
+
+		It("should download again if the snapshot changed", func() {
+			resumedTxid = "txid-2"
+			Expect(download().SnapshotInfo).Should(Equal("txid-2"))
+			Expect(ifRangeHeaders).Should(Equal([]string{"", `"txid-1"`}))
+			_, err := os.Stat(data.DBPath("common/txid-1"))
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		})
+	})
+
+	Context("staged snapshot install", func() {
+		var snapshotData []byte
+
+		BeforeEach(func() {
+			snapshotData = mockSnapshotData("./sql/init_mock_db.sql")
+		})
+
+		exists := func(path string) bool {
+			_, err := os.Stat(path)
+			return err == nil
+		}
+
+		It("should install a complete snapshot", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			Expect(writeSnapshotFile(dbId, bytes.NewReader(snapshotData), 0)).Should(Equal(int64(len(snapshotData))))
+			Expect(exists(data.DBPath("common/" + dbId))).Should(BeFalse())
+			Expect(installSnapshotFile(dbId)).Should(Succeed())
+			Expect(ioutil.ReadFile(data.DBPath("common/" + dbId))).Should(Equal(snapshotData))
+			Expect(exists(snapshotStagingPath(dbId))).Should(BeFalse())
+		})
+
+		It("should reject a truncated snapshot", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			for _, truncated := range [][]byte{snapshotData[:len(snapshotData)-100], snapshotData[:50], []byte("not a db")} {
+				_, err := writeSnapshotFile(dbId, bytes.NewReader(truncated), 0)
+				Expect(err).Should(Succeed())
+				Expect(installSnapshotFile(dbId)).ShouldNot(Succeed())
+				Expect(exists(data.DBPath("common/" + dbId))).Should(BeFalse())
+				Expect(exists(snapshotStagingPath(dbId))).Should(BeFalse())
+			}
+		})
+
+		It("should keep the old bootstrap snapshot until the new one is installed", func() {
+			Expect(processSnapshotServerFileResponse(bootstrapSnapshotName, bytes.NewReader(snapshotData), &common.Snapshot{})).
+				Should(Succeed())
+			err := processSnapshotServerFileResponse(bootstrapSnapshotName, bytes.NewReader(snapshotData[:1000]), &common.Snapshot{})
+			Expect(err).ShouldNot(Succeed())
+			Expect(ioutil.ReadFile(data.DBPath("common/" + bootstrapSnapshotName))).Should(Equal(snapshotData))
+		})
+
+		It("should replace an installed snapshot", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			dbDir := filepath.Dir(data.DBPath("common/" + dbId))
+			newData := mockSnapshotData("./sql/init_listener_test_valid_snapshot.sql")
+			Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(snapshotData), &common.Snapshot{})).Should(Succeed())
+			Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(newData), &common.Snapshot{})).Should(Succeed())
+			Expect(ioutil.ReadFile(data.DBPath("common/" + dbId))).Should(Equal(newData))
+			Expect(exists(dbDir + installingSnapshotSuffix)).Should(BeFalse())
+			Expect(exists(dbDir + replacedSnapshotSuffix)).Should(BeFalse())
+		})
+
+		It("should restore the old snapshot after a crash while installing", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			dbDir := filepath.Dir(data.DBPath("common/" + dbId))
+			Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(snapshotData), &common.Snapshot{})).Should(Succeed())
+			// crash after moving the old directory out of the way
+			Expect(os.Rename(dbDir, dbDir+replacedSnapshotSuffix)).Should(Succeed())
+			Expect(os.MkdirAll(dbDir+installingSnapshotSuffix, 0700)).Should(Succeed())
+			cleanupPartialSnapshots()
+			Expect(ioutil.ReadFile(data.DBPath("common/" + dbId))).Should(Equal(snapshotData))
+			Expect(exists(dbDir + installingSnapshotSuffix)).Should(BeFalse())
+			Expect(exists(dbDir + replacedSnapshotSuffix)).Should(BeFalse())
+		})
+
+		It("should remove the old snapshot after a crash once the new one is installed", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			dbDir := filepath.Dir(data.DBPath("common/" + dbId))
+			Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(snapshotData), &common.Snapshot{})).Should(Succeed())
+			Expect(os.MkdirAll(dbDir+replacedSnapshotSuffix, 0700)).Should(Succeed())
+			cleanupPartialSnapshots()
+			Expect(ioutil.ReadFile(data.DBPath("common/" + dbId))).Should(Equal(snapshotData))
+			Expect(exists(dbDir + replacedSnapshotSuffix)).Should(BeFalse())
+		})
+
+		It("should remove partial downloads at startup", func() {
+			dbId := "staged_" + strconv.Itoa(testCount)
+			Expect(processSnapshotServerFileResponse(dbId, bytes.NewReader(snapshotData), &common.Snapshot{})).Should(Succeed())
+			_, err := writeSnapshotFile(dbId+"_partial", bytes.NewReader(snapshotData[:1000]), 0)
+			Expect(err).Should(Succeed())
+			cleanupPartialSnapshots()
+			Expect(exists(snapshotStagingPath(dbId + "_partial"))).Should(BeFalse())
+			Expect(exists(data.DBPath("common/" + dbId))).Should(BeTrue())
+		})
+	})
+
 	Context("apidSnapshotManager", func() {
 		var testSnapMan *apidSnapshotManager
 		var dummyTokenMan *dummyTokenManager
@@ -141,6 +315,35 @@ var _ = Describe("Snapshot Manager", func() {
 			Expect(<-dummyTokenMan.invalidateChan).Should(BeTrue())
 		})
 
+		It("downloadTableSnapshot happy path", func() {
+			testMock.normalAuthCheck()
+			snapshotDbId, err := testSnapMan.downloadTableSnapshot("kms.developer")
+			Expect(err).Should(Succeed())
+			Expect(snapshotDbId).Should(Equal(tableSnapshotPrefix + "kms_developer"))
+			_, err = os.Stat(data.DBPath("common/" + snapshotDbId))
+			Expect(err).Should(Succeed())
+			releaseTableSnapshot(snapshotDbId)
+		})
+
+		It("downloadScopeSnapshot happy path", func() {
+			testMock.params.Scope = "test_scope_" + strconv.Itoa(testCount)
+			testMock.params.ClusterID = testMock.params.Scope
+			testMock.normalAuthCheck()
+			snapshotDbId, err := testSnapMan.downloadScopeSnapshot([]string{testMock.params.Scope})
+			Expect(err).Should(Succeed())
+			Expect(snapshotDbId).Should(Equal(scopeSnapshotName))
+			_, err = os.Stat(data.DBPath("common/" + snapshotDbId))
+			Expect(err).Should(Succeed())
+			releaseTableSnapshot(snapshotDbId)
+		})
+
+		It("downloadTableSnapshot should report unavailable table snapshots", func() {
+			testMock.normalAuthCheck()
+			config.Set(configSnapServerBaseURI, testServer.URL+"/unknown")
+			_, err := testSnapMan.downloadTableSnapshot("kms.developer")
+			Expect(err).Should(Equal(partialSnapshotUnavailableError))
+		})
+
 	})
 
 })
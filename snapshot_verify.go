@@ -0,0 +1,217 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/apid/apid-core/data"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// optional checksum of the snapshot file sent by the snapshot server, as "sha256:<hex>"
+const headerSnapshotChecksum = "Transicator-Snapshot-Checksum"
+
+// SQLite integrity check run on downloaded snapshots
+const (
+	snapshotIntegrityCheckFull  = "full"
+	snapshotIntegrityCheckQuick = "quick"
+	snapshotIntegrityCheckNone  = "none"
+)
+
+// snapshots failing verification are kept for debugging, up to this many
+const maxQuarantinedSnapshots = 3
+
+const quarantinedSnapshotsDir = "quarantined_snapshots"
+
+// verifies the downloaded file against the checksum header of the snapshot server
+func verifySnapshotChecksum(path, checksum string) error {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "sha256" {
+		return fmt.Errorf("unsupported snapshot checksum %s", checksum)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, parts[1]) {
+		return fmt.Errorf("snapshot checksum mismatch: expected %s, got sha256:%s", checksum, actual)
+	}
+	return nil
+}
+
+/*
+ * Verifies the downloaded snapshot file before it is installed: the SQLite integrity check, the
+ * transicator metadata, a _transicator_tables entry for each column of each table, and a single
+ * edgex_apid_cluster row. _transicator_tables may list tables the snapshot doesn't have.
+ */
+func verifySnapshotDb(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var pragma string
+	switch config.GetString(configSnapshotIntegrityCheck) {
+	case snapshotIntegrityCheckFull:
+		pragma = "PRAGMA integrity_check"
+	case snapshotIntegrityCheckQuick:
+		pragma = "PRAGMA quick_check"
+	}
+	if pragma != "" {
+		rows, err := db.Query(pragma)
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", pragma, err)
+		}
+		var problems []string
+		for rows.Next() {
+			var result string
+			if err = rows.Scan(&result); err != nil {
+				rows.Close()
+				return err
+			}
+			if result != "ok" {
+				problems = append(problems, result)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("%s failed: %v", pragma, err)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%s failed: %s", pragma, strings.Join(problems, "; "))
+		}
+	}
+
+	var snapshotInfo string
+	err = db.QueryRow("SELECT value FROM _transicator_metadata WHERE key='snapshot'").Scan(&snapshotInfo)
+	if err != nil {
+		return fmt.Errorf("no snapshot in _transicator_metadata: %v", err)
+	}
+
+	columns := make(map[string]map[string]bool)
+	rows, err := db.Query("SELECT tableName, columnName FROM _transicator_tables")
+	if err != nil {
+		return fmt.Errorf("unable to read _transicator_tables: %v", err)
+	}
+	for rows.Next() {
+		var tableName, columnName string
+		if err = rows.Scan(&tableName, &columnName); err != nil {
+			rows.Close()
+			return err
+		}
+		if columns[tableName] == nil {
+			columns[tableName] = make(map[string]bool)
+		}
+		columns[tableName][columnName] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var tableNames []string
+	rows, err = db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE '_transicator_%' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var tableName string
+		if err = rows.Scan(&tableName); err != nil {
+			rows.Close()
+			return err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		if columns[tableName] == nil {
+			return fmt.Errorf("table %s has no _transicator_tables entries", tableName)
+		}
+		tableColumns, err := queryTableColumns(db, tableName)
+		if err != nil {
+			return err
+		}
+		for columnName := range columns[tableName] {
+			if !tableColumns[columnName] {
+				return fmt.Errorf("column %s.%s of _transicator_tables doesn't exist", tableName, columnName)
+			}
+		}
+	}
+
+	var numApidClusters int
+	if err = db.QueryRow("SELECT COUNT(*) FROM edgex_apid_cluster").Scan(&numApidClusters); err != nil {
+		return fmt.Errorf("unable to read edgex_apid_cluster: %v", err)
+	}
+	if numApidClusters != 1 {
+		return fmt.Errorf("illegal state for apid_cluster, must be a single row, found %d", numApidClusters)
+	}
+	return nil
+}
+
+/*
+ * Moves a downloaded snapshot that failed verification out of the way, along with the reason.
+ * An installed DB version of the same name is left alone. Only the latest maxQuarantinedSnapshots are kept.
+ */
+func quarantineSnapshot(dbId string, reason error) {
+	log.Errorf("Quarantining snapshot %s: %v", dbId, reason)
+	stagingPath := snapshotStagingPath(dbId)
+
+	dir := filepath.Join(quarantineRoot(), dbId+"-"+time.Now().UTC().Format("20060102T150405.000"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorf("Unable to quarantine snapshot %s: %v", dbId, err)
+		os.Remove(stagingPath)
+		return
+	}
+	if err := os.Rename(stagingPath, filepath.Join(dir, filepath.Base(data.DBPath("common/"+dbId)))); err != nil {
+		log.Errorf("Unable to quarantine snapshot %s: %v", dbId, err)
+		os.Remove(stagingPath)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "reason"), []byte(reason.Error()+"\n"), 0600); err != nil {
+		log.Warnf("Unable to write quarantine reason of %s: %v", dbId, err)
+	}
+
+	entries, err := ioutil.ReadDir(quarantineRoot())
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for i := 0; i < len(entries)-maxQuarantinedSnapshots; i++ {
+		os.RemoveAll(filepath.Join(quarantineRoot(), entries[i].Name()))
+	}
+}
+
+func quarantineRoot() string {
+	return filepath.Join(config.GetString(configLocalStoragePath), quarantinedSnapshotsDir)
+}
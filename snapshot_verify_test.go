@@ -0,0 +1,283 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/apid/apid-core/data"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Snapshot verification", func() {
+	testCount := 0
+
+	BeforeEach(func() {
+		testCount++
+		Expect(os.RemoveAll(quarantineRoot())).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(configSnapshotIntegrityCheck, snapshotIntegrityCheckFull)
+	})
+
+	checksumOf := func(snapshotData []byte) string {
+		sum := sha256.Sum256(snapshotData)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	quarantined := func() []os.FileInfo {
+		entries, err := ioutil.ReadDir(quarantineRoot())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		Expect(err).Should(Succeed())
+		return entries
+	}
+
+	Context("verifySnapshotDb", func() {
+		// stages a snapshot created from the statements, then runs the extra statements on it
+		stage := func(snapshotData []byte, extra ...string) string {
+			dbId := "verify_" + strconv.Itoa(testCount)
+			_, err := writeSnapshotFile(dbId, bytes.NewReader(snapshotData), 0)
+			Expect(err).Should(Succeed())
+			path := snapshotStagingPath(dbId)
+			if len(extra) > 0 {
+				db, err := sql.Open("sqlite3", path)
+				Expect(err).Should(Succeed())
+				defer db.Close()
+				for _, stmt := range extra {
+					_, err = db.Exec(stmt)
+					Expect(err).Should(Succeed())
+				}
+			}
+			return path
+		}
+
+		AfterEach(func() {
+			removeSnapshotFile("verify_" + strconv.Itoa(testCount))
+		})
+
+		for _, check := range []string{snapshotIntegrityCheckFull, snapshotIntegrityCheckQuick, snapshotIntegrityCheckNone} {
+			check := check
+			It("should accept a valid snapshot with integrity check "+check, func() {
+				config.Set(configSnapshotIntegrityCheck, check)
+				Expect(verifySnapshotDb(stage(mockSnapshotData("./sql/init_mock_db.sql")))).Should(Succeed())
+			})
+		}
+
+		It("should reject a snapshot with several apid clusters", func() {
+			path := stage(mockSnapshotData("./sql/init_listener_test_duplicate_apids.sql"))
+			Expect(verifySnapshotDb(path)).Should(MatchError(ContainSubstring("must be a single row")))
+		})
+
+		for _, testCase := range []struct {
+			description string
+			stmt        string
+			reason      string
+		}{
+			{"without transicator metadata", "DROP TABLE _transicator_metadata", "_transicator_metadata"},
+			{"without a snapshot in the metadata", "DELETE FROM _transicator_metadata", "_transicator_metadata"},
+			{"without _transicator_tables", "DROP TABLE _transicator_tables", "_transicator_tables"},
+			{"with a table missing from _transicator_tables", "CREATE TABLE extra_table (id text)", "extra_table"},
+			{"with a column missing from the table",
+				"INSERT INTO _transicator_tables VALUES('kms_app','missing_column',25,0)", "kms_app.missing_column"},
+			{"without edgex_apid_cluster", "DROP TABLE edgex_apid_cluster", "edgex_apid_cluster"},
+		} {
+			testCase := testCase
+			It("should reject a snapshot "+testCase.description, func() {
+				path := stage(mockSnapshotData("./sql/init_mock_db.sql"), testCase.stmt)
+				Expect(verifySnapshotDb(path)).Should(MatchError(ContainSubstring(testCase.reason)))
+			})
+		}
+
+		It("should reject a corrupted snapshot", func() {
+			snapshotData := mockSnapshotData("./sql/init_mock_db.sql")
+			// overwrite the b-tree pages following the schema, keeping the file size
+			pageSize := int(binary.BigEndian.Uint16(snapshotData[16:18]))
+			Expect(len(snapshotData)).Should(BeNumerically(">", 3*pageSize))
+			for i := pageSize; i < 3*pageSize; i++ {
+				snapshotData[i] = 0x5a
+			}
+			Expect(verifySnapshotDb(stage(snapshotData))).ShouldNot(Succeed())
+		})
+	})
+
+	Context("verifySnapshotChecksum", func() {
+		var path string
+		snapshotData := []byte("snapshot data")
+
+		BeforeEach(func() {
+			path = filepath.Join(tmpDir, "checksum_"+strconv.Itoa(testCount))
+			Expect(ioutil.WriteFile(path, snapshotData, 0600)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("should accept a matching checksum", func() {
+			Expect(verifySnapshotChecksum(path, checksumOf(snapshotData))).Should(Succeed())
+			Expect(verifySnapshotChecksum(path, strings.ToUpper(checksumOf(snapshotData)))).Should(Succeed())
+		})
+
+		It("should reject a different checksum", func() {
+			Expect(verifySnapshotChecksum(path, checksumOf([]byte("other data")))).
+				Should(MatchError(ContainSubstring("checksum mismatch")))
+		})
+
+		It("should reject unsupported checksums", func() {
+			for _, checksum := range []string{"md5:abcd", "abcd", ""} {
+				Expect(verifySnapshotChecksum(path, checksum)).Should(MatchError(ContainSubstring("unsupported")))
+			}
+		})
+	})
+
+	Context("quarantine", func() {
+		var testSnapMan *apidSnapshotManager
+		var testServer *httptest.Server
+		// served in order, the last one is served again
+		var responses []struct {
+			txid     string
+			data     []byte
+			checksum string
+		}
+		var requests int
+
+		BeforeEach(func() {
+			responses, requests = nil, 0
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				response := responses[len(responses)-1]
+				if requests < len(responses) {
+					response = responses[requests]
+				}
+				requests++
+				w.Header().Set(headerSnapshotNumber, response.txid)
+				if response.checksum != "" {
+					w.Header().Set(headerSnapshotChecksum, response.checksum)
+				}
+				w.Write(response.data)
+			}))
+			config.Set(configSnapServerBaseURI, testServer.URL)
+			initialBackoffInterval = time.Millisecond
+			dummyTokenMan := &dummyTokenManager{invalidateChan: make(chan bool, 1)}
+			testSnapMan = createSnapShotManager(&dummyDbManager{}, dummyTokenMan, &http.Client{})
+		})
+
+		AfterEach(func() {
+			testServer.Close()
+			<-testSnapMan.close()
+			config.Set(configSnapServerBaseURI, dummyConfigValue)
+		})
+
+		serve := func(txid string, snapshotData []byte, checksum string) {
+			responses = append(responses, struct {
+				txid     string
+				data     []byte
+				checksum string
+			}{txid, snapshotData, checksum})
+		}
+
+		download := func() *common.Snapshot {
+			snapshot := &common.Snapshot{}
+			testSnapMan.downloadSnapshot(false, []string{"s1"}, snapshot)
+			return snapshot
+		}
+
+		reasonOf := func(entry os.FileInfo) string {
+			reason, err := ioutil.ReadFile(filepath.Join(quarantineRoot(), entry.Name(), "reason"))
+			Expect(err).Should(Succeed())
+			return string(reason)
+		}
+
+		It("should quarantine a snapshot with a wrong checksum and download it again", func() {
+			snapshotData := mockSnapshotData("./sql/init_mock_db.sql")
+			txid := "checksum_" + strconv.Itoa(testCount)
+			serve(txid, snapshotData, checksumOf([]byte("other data")))
+			serve(txid, snapshotData, checksumOf(snapshotData))
+
+			Expect(download().SnapshotInfo).Should(Equal(txid))
+			Expect(requests).Should(Equal(2))
+			Expect(ioutil.ReadFile(data.DBPath("common/" + txid))).Should(Equal(snapshotData))
+			entries := quarantined()
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Name()).Should(HavePrefix(txid + "-"))
+			Expect(reasonOf(entries[0])).Should(ContainSubstring("checksum mismatch"))
+			Expect(ioutil.ReadFile(filepath.Join(quarantineRoot(), entries[0].Name(), "sqlite"))).
+				Should(Equal(snapshotData))
+		})
+
+		It("should never activate a snapshot failing verification", func() {
+			badTxid, goodTxid := "bad_"+strconv.Itoa(testCount), "good_"+strconv.Itoa(testCount)
+			serve(badTxid, mockSnapshotData("./sql/init_listener_test_duplicate_apids.sql"), "")
+			serve(goodTxid, mockSnapshotData("./sql/init_mock_db.sql"), "")
+
+			Expect(download().SnapshotInfo).Should(Equal(goodTxid))
+			_, err := os.Stat(data.DBPath("common/" + badTxid))
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+			entries := quarantined()
+			Expect(entries).Should(HaveLen(1))
+			Expect(entries[0].Name()).Should(HavePrefix(badTxid + "-"))
+			Expect(reasonOf(entries[0])).Should(ContainSubstring("must be a single row"))
+		})
+
+		It("should keep the installed snapshot if a new one fails verification", func() {
+			txid, goodTxid := "kept_"+strconv.Itoa(testCount), "good_"+strconv.Itoa(testCount)
+			installed := mockSnapshotData("./sql/init_mock_db.sql")
+			Expect(processSnapshotServerFileResponse(txid, bytes.NewReader(installed), &common.Snapshot{})).
+				Should(Succeed())
+			serve(txid, mockSnapshotData("./sql/init_listener_test_duplicate_apids.sql"), "")
+			serve(goodTxid, mockSnapshotData("./sql/init_mock_db.sql"), "")
+
+			Expect(download().SnapshotInfo).Should(Equal(goodTxid))
+			Expect(ioutil.ReadFile(data.DBPath("common/" + txid))).Should(Equal(installed))
+			entries := quarantined()
+			Expect(entries).Should(HaveLen(1))
+			Expect(reasonOf(entries[0])).Should(ContainSubstring("must be a single row"))
+		})
+
+		It("should keep only the latest quarantined snapshots", func() {
+			snapshotData := mockSnapshotData("./sql/init_mock_db.sql")
+			for i := 0; i < maxQuarantinedSnapshots+2; i++ {
+				dbId := "quarantine_" + strconv.Itoa(testCount) + "_" + strconv.Itoa(i)
+				_, err := writeSnapshotFile(dbId, bytes.NewReader(snapshotData), 0)
+				Expect(err).Should(Succeed())
+				quarantineSnapshot(dbId, errors.New("test"))
+				Expect(snapshotStagingPath(dbId)).ShouldNot(BeAnExistingFile())
+				time.Sleep(10 * time.Millisecond)
+			}
+			entries := quarantined()
+			Expect(entries).Should(HaveLen(maxQuarantinedSnapshots))
+			for _, entry := range entries {
+				Expect(entry.Name()).ShouldNot(HavePrefix("quarantine_" + strconv.Itoa(testCount) + "_0-"))
+				Expect(entry.Name()).ShouldNot(HavePrefix("quarantine_" + strconv.Itoa(testCount) + "_1-"))
+			}
+		})
+	})
+})
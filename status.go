@@ -0,0 +1,215 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusOnline       = "ONLINE"
+	statusDegraded     = "DEGRADED"
+	statusShuttingDown = "SHUTTING_DOWN"
+	statusOffline      = "OFFLINE"
+)
+
+const (
+	// a shutdown shouldn't wait for an unresponsive proxy server
+	statusReportTimeout = 5 * time.Second
+)
+
+// body of a heartbeat
+type syncHealth struct {
+	Status       string `json:"status"`
+	LastSequence string `json:"lastSequence"`
+	LastSnapshot string `json:"lastSnapshot"`
+	// seconds since changes were last received
+	LagSeconds          int64 `json:"lagSeconds"`
+	ConsecutiveFailures int   `json:"consecutiveFailures"`
+	// replayed changes, see configIdempotentApply
+	Apply applyMetrics `json:"apply"`
+	// old snapshots removed from disk
+	Snapshots snapshotGcMetrics `json:"snapshots"`
+}
+
+/*
+ * Tells the proxy server about the lifecycle and sync health of this apid instance.
+ * Heartbeats are sent every apigeesync_heartbeat_interval, independent of token refreshes.
+ * The status is DEGRADED while the change poller keeps failing, and SHUTTING_DOWN followed by
+ * OFFLINE on a graceful close.
+ */
+type statusReporter struct {
+	tokenMan tokenManager
+	client   *http.Client
+	// 0 for not closed, 1 for closed
+	isClosed *int32
+	quitChan chan bool
+	// token captured by shuttingDown(), the token manager is closed before offline()
+	lastToken    string
+	mux          sync.Mutex
+	lastSequence string
+	lastSync     time.Time
+	failures     int
+	// nil if not available
+	applyMetrics func() applyMetrics
+}
+
+func createStatusReporter(tokenMan tokenManager, client *http.Client) *statusReporter {
+	isClosedInt := int32(0)
+	return &statusReporter{
+		tokenMan: tokenMan,
+		client:   client,
+		isClosed: &isClosedInt,
+		quitChan: make(chan bool),
+		lastSync: time.Now(),
+	}
+}
+
+func (r *statusReporter) start() {
+	interval := config.GetDuration(configHeartbeatInterval)
+	if interval <= 0 {
+		log.Info("Heartbeats are disabled")
+		return
+	}
+	go r.sendHeartbeats(interval)
+}
+
+func (r *statusReporter) sendHeartbeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quitChan:
+			log.Debug("Stopped sending heartbeats")
+			return
+		case <-ticker.C:
+			if err := r.report(r.getHealth(), r.tokenMan.getBearerToken()); err != nil {
+				log.Warnf("Unable to send heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// called after a change list has been applied
+func (r *statusReporter) changesApplied(lastSequence string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.lastSequence = lastSequence
+	r.lastSync = time.Now()
+	r.failures = 0
+}
+
+// called when polling the change server failed
+func (r *statusReporter) changesFailed() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.failures++
+}
+
+func (r *statusReporter) getStatus() string {
+	return r.getHealth().Status
+}
+
+func (r *statusReporter) getHealth() syncHealth {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	health := syncHealth{
+		Status:              statusOnline,
+		LastSequence:        r.lastSequence,
+		LastSnapshot:        apidInfo.LastSnapshot,
+		LagSeconds:          int64(time.Since(r.lastSync).Seconds()),
+		ConsecutiveFailures: r.failures,
+	}
+	if r.applyMetrics != nil {
+		health.Apply = r.applyMetrics()
+	}
+	health.Snapshots = snapshotGc.getMetrics()
+	if atomic.LoadInt32(r.isClosed) == int32(1) {
+		health.Status = statusShuttingDown
+	} else if r.failures >= config.GetInt(configDegradedAfterFailures) {
+		health.Status = statusDegraded
+	}
+	return health
+}
+
+/*
+ * Stops the heartbeats and reports SHUTTING_DOWN.
+ * Call it before closing the token manager, offline() reuses the current token.
+ */
+func (r *statusReporter) shuttingDown() {
+	if atomic.SwapInt32(r.isClosed, 1) == int32(1) {
+		log.Warn("statusReporter: shuttingDown() called on a closed statusReporter!")
+		return
+	}
+	close(r.quitChan)
+	r.lastToken = r.tokenMan.getBearerToken()
+	if err := r.report(r.getHealth(), r.lastToken); err != nil {
+		log.Warnf("Unable to report %s: %v", statusShuttingDown, err)
+	}
+}
+
+// reports OFFLINE after everything has been closed
+func (r *statusReporter) offline() {
+	health := r.getHealth()
+	health.Status = statusOffline
+	if err := r.report(health, r.lastToken); err != nil {
+		log.Warnf("Unable to report %s: %v", statusOffline, err)
+		return
+	}
+	log.Infof("Reported %s to the proxy server", statusOffline)
+}
+
+func (r *statusReporter) report(health syncHealth, token string) error {
+	uri, err := url.Parse(config.GetString(configProxyServerBaseURI))
+	if err != nil {
+		return err
+	}
+	uri.Path = path.Join(uri.Path, "/heartbeat")
+	body, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusReportTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	addHeaders(req, token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("display_name", apidInfo.InstanceName)
+	req.Header.Set("status", health.Status)
+
+	log.Debugf("Sending heartbeat: %#v", health)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Errorf("Heartbeat failed with Resp Code: %d", resp.StatusCode)
+		return expected200Error
+	}
+	return nil
+}
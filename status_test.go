@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"github.com/apid/apid-core/api"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("status reporter", func() {
+	var testServer *httptest.Server
+	var testMock *MockServer
+	var dummyTokenMan *dummyTokenManager
+	var reporter *statusReporter
+
+	BeforeEach(func() {
+		testRouter := api.CreateService().Router()
+		testServer = httptest.NewServer(testRouter)
+		testMock = Mock(MockParms{
+			ReliableAPI: true,
+			ClusterID:   config.GetString(configApidClusterId),
+			TokenKey:    config.GetString(configConsumerKey),
+			TokenSecret: config.GetString(configConsumerSecret),
+		}, testRouter)
+		testMock.oauthToken = "status_token"
+		apidInfo.ClusterID = config.GetString(configApidClusterId)
+		config.Set(configProxyServerBaseURI, testServer.URL)
+
+		dummyTokenMan = &dummyTokenManager{
+			invalidateChan: make(chan bool, 1),
+			token:          testMock.oauthToken,
+		}
+		reporter = createStatusReporter(dummyTokenMan, &http.Client{})
+	})
+
+	AfterEach(func() {
+		testServer.Close()
+		config.Set(configProxyServerBaseURI, dummyConfigValue)
+		config.Set(configHeartbeatInterval, time.Minute)
+	})
+
+	statuses := func() []string {
+		var s []string
+		for _, h := range testMock.receivedHeartbeats() {
+			s = append(s, h.Status)
+		}
+		return s
+	}
+
+	It("should send heartbeats with the sync health", func() {
+		config.Set(configHeartbeatInterval, 20*time.Millisecond)
+		apidInfo.LastSnapshot = "status_snapshot"
+		defer func() { apidInfo.LastSnapshot = "" }()
+		reporter.changesApplied("1.2.3")
+		reporter.start()
+		defer reporter.shuttingDown()
+
+		Eventually(testMock.receivedHeartbeats).ShouldNot(BeEmpty())
+		health := testMock.receivedHeartbeats()[0]
+		Expect(health.Status).Should(Equal(statusOnline))
+		Expect(health.LastSequence).Should(Equal("1.2.3"))
+		Expect(health.LastSnapshot).Should(Equal("status_snapshot"))
+		Expect(health.ConsecutiveFailures).Should(BeZero())
+		Eventually(func() int { return len(testMock.receivedHeartbeats()) }).Should(BeNumerically(">=", 3))
+	}, 3)
+
+	It("should be degraded while the change poller is failing", func() {
+		degradedAfter := config.GetInt(configDegradedAfterFailures)
+		for i := 1; i < degradedAfter; i++ {
+			reporter.changesFailed()
+		}
+		Expect(reporter.getStatus()).Should(Equal(statusOnline))
+		reporter.changesFailed()
+		Expect(reporter.getStatus()).Should(Equal(statusDegraded))
+		Expect(reporter.getHealth().ConsecutiveFailures).Should(Equal(degradedAfter))
+
+		reporter.changesApplied("1.2.4")
+		Expect(reporter.getStatus()).Should(Equal(statusOnline))
+	})
+
+	It("should report replayed changes", func() {
+		Expect(reporter.getHealth().Apply).Should(BeZero())
+		reporter.applyMetrics = func() applyMetrics {
+			return applyMetrics{ReplacedInserts: 2, MissingDeletes: 1}
+		}
+		Expect(reporter.getHealth().Apply).Should(Equal(applyMetrics{ReplacedInserts: 2, MissingDeletes: 1}))
+	})
+
+	It("should report the lag since changes were last applied", func() {
+		reporter.lastSync = time.Now().Add(-time.Minute)
+		Expect(reporter.getHealth().LagSeconds).Should(BeNumerically(">=", 60))
+		reporter.changesApplied("1.2.5")
+		Expect(reporter.getHealth().LagSeconds).Should(BeNumerically("<", 2))
+	})
+
+	It("should report SHUTTING_DOWN and OFFLINE on close", func() {
+		testChangeMan := createChangeManager(&dummyDbManager{}, &dummySnapshotManager{}, dummyTokenMan, reporter, &http.Client{})
+		Expect(<-testChangeMan.close()).Should(BeFalse())
+		Expect(statuses()).Should(Equal([]string{statusShuttingDown, statusOffline}))
+
+		// heartbeats are stopped
+		config.Set(configHeartbeatInterval, 20*time.Millisecond)
+		reporter.start()
+		Consistently(statuses, 200*time.Millisecond).Should(HaveLen(2))
+	}, 3)
+})
@@ -140,6 +140,7 @@ func (d *dummyChangeManager) pollChangeWithBackoff() {
 type dummyTokenManager struct {
 	invalidateChan chan bool
 	token          string
+	tokenInfo      OauthToken
 	tokenReadyChan chan bool
 }
 
@@ -151,6 +152,12 @@ func (t *dummyTokenManager) getBearerToken() string {
 	return t.token
 }
 
+func (t *dummyTokenManager) getToken() *OauthToken {
+	token := t.tokenInfo
+	token.AccessToken = t.token
+	return &token
+}
+
 func (t *dummyTokenManager) invalidateToken() {
 	log.Debug("invalidateToken called")
 	t.invalidateChan <- true
@@ -167,6 +174,11 @@ func (t *dummyTokenManager) start() {
 type dummySnapshotManager struct {
 	downloadCalledChan chan bool
 	startCalledChan    chan bool
+	// table snapshot DB versions by table name
+	tableSnapshots map[string]string
+	// scopes of the scope snapshots downloaded
+	scopeSnapshots   [][]string
+	scopeSnapshotErr error
 }
 
 func (s *dummySnapshotManager) close() <-chan bool {
@@ -184,6 +196,18 @@ func (s *dummySnapshotManager) downloadDataSnapshot() error {
 	return nil
 }
 
+func (s *dummySnapshotManager) downloadTableSnapshot(tableName string) (string, error) {
+	if snapshotDbId, ok := s.tableSnapshots[tableName]; ok {
+		return snapshotDbId, nil
+	}
+	return "", partialSnapshotUnavailableError
+}
+
+func (s *dummySnapshotManager) downloadScopeSnapshot(scopes []string) (string, error) {
+	s.scopeSnapshots = append(s.scopeSnapshots, scopes)
+	return scopeSnapshotName, s.scopeSnapshotErr
+}
+
 func (s *dummySnapshotManager) startOnDataSnapshot(snapshot string) error {
 	s.startCalledChan <- true
 	return nil
@@ -196,6 +220,14 @@ type dummyDbManager struct {
 	snapshot       *common.Snapshot
 	isDataSnapshot bool
 	lastSeqUpdated chan string
+	// returned by processChangeList and reapplyDeadLetter
+	processErr  error
+	quarantined []*common.ChangeList
+	// changes of this table are quarantined by processChangeListQuarantining, the others applied
+	failingTable string
+	deadLetters  []deadLetter
+	// passed to processScopeChangeList
+	removedScopes []string
 }
 
 func (d *dummyDbManager) initDB() error {
@@ -211,6 +243,7 @@ func (d *dummyDbManager) findScopesForId(configId string) (scopes []string, err
 	return d.scopes, nil
 }
 func (d *dummyDbManager) updateLastSequence(lastSequence string) error {
+	d.lastSequence = lastSequence
 	d.lastSeqUpdated <- lastSequence
 	return nil
 }
@@ -223,8 +256,58 @@ func (d *dummyDbManager) getApidInstanceInfo() (info apidInstanceInfo, err error
 	}, nil
 }
 func (d *dummyDbManager) processChangeList(changes *common.ChangeList) error {
+	if d.processErr != nil {
+		return d.processErr
+	}
+	// last_sequence is moved along with the rows
+	if changes.LastSequence != "" {
+		return d.updateLastSequence(changes.LastSequence)
+	}
 	return nil
 }
+func (d *dummyDbManager) processChangeListQuarantining(changes *common.ChangeList) (*common.ChangeList, error) {
+	d.quarantined = append(d.quarantined, changes)
+	if changes.LastSequence != "" {
+		d.updateLastSequence(changes.LastSequence)
+	}
+	applied := *changes
+	applied.Changes = nil
+	for _, change := range changes.Changes {
+		if change.Table != d.failingTable {
+			applied.Changes = append(applied.Changes, change)
+		}
+	}
+	return &applied, nil
+}
+func (d *dummyDbManager) getDeadLetters() ([]deadLetter, error) {
+	return d.deadLetters, nil
+}
+func (d *dummyDbManager) reapplyDeadLetter(id int64) (*deadLetter, error) {
+	for i, dl := range d.deadLetters {
+		if dl.Id == id {
+			if d.processErr != nil {
+				return &dl, d.processErr
+			}
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			return &dl, nil
+		}
+	}
+	return nil, nil
+}
+func (d *dummyDbManager) processTableSnapshot(snapshotDbId, tableName string) error {
+	d.knownTables[normalizeTableName(tableName)] = true
+	return nil
+}
+func (d *dummyDbManager) findScopesAfterChangeList(changes *common.ChangeList, configId string) ([]string, error) {
+	return d.scopes, nil
+}
+func (d *dummyDbManager) processScopeChangeList(changes *common.ChangeList, snapshotDbId string, removedScopes []string) error {
+	if d.processErr != nil {
+		return d.processErr
+	}
+	d.removedScopes = append(d.removedScopes, removedScopes...)
+	return d.processChangeList(changes)
+}
 func (d *dummyDbManager) processSnapshot(snapshot *common.Snapshot, isDataSnapshot bool) error {
 	d.snapshot = snapshot
 	d.isDataSnapshot = isDataSnapshot
@@ -0,0 +1,228 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/apid/apid-core/util"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// how often the TLS files are checked for rotation
+	tlsReloadInterval = time.Minute
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/*
+ * Creates the transport shared by the token, snapshot and change clients.
+ * If any TLS option is configured, the transport is rebuilt whenever the
+ * configured certificate, key or CA files change on disk.
+ */
+func createUpstreamTransport() (http.RoundTripper, error) {
+	if !isUpstreamTlsConfigured() {
+		return buildUpstreamTransport(nil), nil
+	}
+	t := &reloadingTransport{
+		files: getTlsFiles(),
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func isUpstreamTlsConfigured() bool {
+	for _, key := range []string{configTlsCertFile, configTlsKeyFile, configTlsCaFile, configTlsMinVersion} {
+		if config.GetString(key) != "" {
+			return true
+		}
+	}
+	// pins may be configured as a list, which GetString() doesn't return
+	return len(getConfigList(configTlsPinnedKeys)) > 0
+}
+
+func getTlsFiles() []string {
+	var files []string
+	for _, key := range []string{configTlsCertFile, configTlsKeyFile, configTlsCaFile} {
+		if f := config.GetString(key); f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func buildUpstreamTransport(tlsConfig *tls.Config) *http.Transport {
+	// check for forward proxy
+	tr := util.Transport(config.GetString(util.ConfigfwdProxyPortURL))
+	tr.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+	return tr
+}
+
+func buildUpstreamTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if v := config.GetString(configTlsMinVersion); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("illegal value for %s: %s", configTlsMinVersion, v)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	certFile := config.GetString(configTlsCertFile)
+	keyFile := config.GetString(configTlsKeyFile)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", configTlsCertFile, configTlsKeyFile)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// a private CA bundle replaces the system roots
+	if caFile := config.GetString(configTlsCaFile); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if pins := getConfigList(configTlsPinnedKeys); len(pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = getVerifyPinnedKeys(pins)
+	}
+
+	return tlsConfig, nil
+}
+
+/*
+ * Pins are base64 encoded SHA-256 hashes of a SubjectPublicKeyInfo.
+ * The connection is accepted if any certificate of a verified chain matches a pin.
+ */
+func getVerifyPinnedKeys(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		pinned[pin] = true
+	}
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pinned[spkiHash(cert)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no pinned public key found in server certificate chain")
+	}
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+/*
+ * http.RoundTripper that swaps its underlying transport when the TLS files are rotated.
+ * Requests in flight keep using the old transport, whose idle connections are closed.
+ */
+type reloadingTransport struct {
+	mux       sync.Mutex
+	files     []string
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+	transport *http.Transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
+
+func (t *reloadingTransport) current() *http.Transport {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if time.Now().Sub(t.lastCheck) >= tlsReloadInterval {
+		t.lastCheck = time.Now()
+		if t.filesChanged() {
+			log.Info("TLS files changed, reloading")
+			old := t.transport
+			if err := t.reload(); err != nil {
+				log.Errorf("Unable to reload TLS files, keep using the old ones: %v", err)
+			} else {
+				old.CloseIdleConnections()
+			}
+		}
+	}
+	return t.transport
+}
+
+// must be called with t.mux held, or before t is shared
+func (t *reloadingTransport) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range t.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	tlsConfig, err := buildUpstreamTlsConfig()
+	if err != nil {
+		return err
+	}
+	t.transport = buildUpstreamTransport(tlsConfig)
+	t.modTimes = modTimes
+	t.lastCheck = time.Now()
+	return nil
+}
+
+func (t *reloadingTransport) filesChanged() bool {
+	for _, f := range t.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			// probably in the middle of a rotation, check again later
+			log.Debugf("Unable to stat %s: %v", f, err)
+			return false
+		}
+		if !info.ModTime().Equal(t.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+var testCertSerial int64
+
+// issues a certificate signed by parent, or a self-signed CA if parent is nil
+func createTestCert(cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).Should(Succeed())
+	testCertSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testCertSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	Expect(err).Should(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).Should(Succeed())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).Should(Succeed())
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPem, c.keyPem)
+	Expect(err).Should(Succeed())
+	return cert
+}
+
+var _ = Describe("upstream TLS", func() {
+	var testDir string
+	var ca, serverCert *testCert
+	var server *httptest.Server
+	var certFile, keyFile, caFile string
+
+	BeforeEach(func() {
+		var err error
+		testDir, err = ioutil.TempDir(tmpDir, "tls_test")
+		Expect(err).Should(Succeed())
+		certFile = filepath.Join(testDir, "client.crt")
+		keyFile = filepath.Join(testDir, "client.key")
+		caFile = filepath.Join(testDir, "ca.crt")
+
+		ca = createTestCert("test-ca", nil)
+		serverCert = createTestCert("server", ca)
+		Expect(ioutil.WriteFile(caFile, ca.certPem, 0600)).Should(Succeed())
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.cert)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		for _, key := range []string{configTlsCertFile, configTlsKeyFile, configTlsCaFile, configTlsMinVersion, configTlsPinnedKeys} {
+			config.Set(key, "")
+		}
+		tlsReloadInterval = time.Minute
+		Expect(os.RemoveAll(testDir)).Should(Succeed())
+	})
+
+	writeClientCert := func(cn string) {
+		client := createTestCert(cn, ca)
+		Expect(ioutil.WriteFile(certFile, client.certPem, 0600)).Should(Succeed())
+		Expect(ioutil.WriteFile(keyFile, client.keyPem, 0600)).Should(Succeed())
+	}
+
+	configureMutualTls := func() {
+		config.Set(configTlsCertFile, certFile)
+		config.Set(configTlsKeyFile, keyFile)
+		config.Set(configTlsCaFile, caFile)
+	}
+
+	get := func(tr http.RoundTripper) (string, error) {
+		client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	It("should use a plain transport without TLS config", func() {
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		_, ok := tr.(*http.Transport)
+		Expect(ok).Should(BeTrue())
+	})
+
+	It("should connect with client certificate and private CA", func() {
+		writeClientCert("client-1")
+		configureMutualTls()
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		Expect(get(tr)).Should(Equal("client-1"))
+	})
+
+	It("should fail without client certificate", func() {
+		config.Set(configTlsCaFile, caFile)
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		_, err = get(tr)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should fail without private CA", func() {
+		writeClientCert("client-1")
+		config.Set(configTlsCertFile, certFile)
+		config.Set(configTlsKeyFile, keyFile)
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		_, err = get(tr)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should reject bad configuration", func() {
+		config.Set(configTlsCertFile, certFile)
+		_, err := createUpstreamTransport()
+		Expect(err).ShouldNot(Succeed())
+
+		config.Set(configTlsCertFile, "")
+		config.Set(configTlsMinVersion, "0.9")
+		_, err = createUpstreamTransport()
+		Expect(err).ShouldNot(Succeed())
+
+		config.Set(configTlsMinVersion, "1.2")
+		config.Set(configTlsCaFile, filepath.Join(testDir, "missing.crt"))
+		_, err = createUpstreamTransport()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should accept all TLS minimum versions", func() {
+		for v, version := range tlsVersions {
+			config.Set(configTlsMinVersion, v)
+			tlsConfig, err := buildUpstreamTlsConfig()
+			Expect(err).Should(Succeed())
+			Expect(tlsConfig.MinVersion).Should(Equal(version))
+		}
+		config.Set(configTlsMinVersion, "1.3")
+		tlsConfig, err := buildUpstreamTlsConfig()
+		Expect(err).Should(Succeed())
+		Expect(tlsConfig.MinVersion).Should(BeEquivalentTo(tls.VersionTLS13))
+	})
+
+	It("should check pinned public keys", func() {
+		writeClientCert("client-1")
+		configureMutualTls()
+		config.Set(configTlsMinVersion, "1.2")
+		config.Set(configTlsPinnedKeys, spkiHash(ca.cert))
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		Expect(get(tr)).Should(Equal("client-1"))
+
+		config.Set(configTlsPinnedKeys, spkiHash(createTestCert("other", nil).cert))
+		tr, err = createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		_, err = get(tr)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should check pinned public keys configured as a list", func() {
+		config.Set(configTlsPinnedKeys, []interface{}{spkiHash(createTestCert("other", nil).cert)})
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		t, ok := tr.(*reloadingTransport)
+		Expect(ok).Should(BeTrue())
+		Expect(t.transport.TLSClientConfig.VerifyPeerCertificate).ShouldNot(BeNil())
+		Expect(t.transport.TLSClientConfig.VerifyPeerCertificate(nil, [][]*x509.Certificate{{ca.cert}})).
+			ShouldNot(Succeed())
+
+		config.Set(configTlsPinnedKeys, []interface{}{spkiHash(ca.cert)})
+		tr, err = createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		t = tr.(*reloadingTransport)
+		Expect(t.transport.TLSClientConfig.VerifyPeerCertificate(nil, [][]*x509.Certificate{{serverCert.cert, ca.cert}})).
+			Should(Succeed())
+	})
+
+	It("should reload rotated client certificate", func() {
+		writeClientCert("client-1")
+		configureMutualTls()
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		Expect(get(tr)).Should(Equal("client-1"))
+
+		tlsReloadInterval = 0
+		writeClientCert("client-2")
+		future := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(certFile, future, future)).Should(Succeed())
+		Expect(os.Chtimes(keyFile, future, future)).Should(Succeed())
+		Expect(get(tr)).Should(Equal("client-2"))
+	})
+
+	It("token manager should use the TLS transport", func() {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			body, err := json.Marshal(OauthToken{
+				AccessToken: "ABCD",
+				ExpiresIn:   200,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			w.Write(body)
+		}))
+		defer ts.Close()
+		tsCaPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.TLS.Certificates[0].Certificate[0]})
+		Expect(ioutil.WriteFile(caFile, tsCaPem, 0600)).Should(Succeed())
+		config.Set(configTlsCaFile, caFile)
+		config.Set(configProxyServerBaseURI, ts.URL)
+
+		tr, err := createUpstreamTransport()
+		Expect(err).Should(Succeed())
+		testedTokenManager := createApidTokenManager(false, &http.Client{Transport: tr}, &configCredentialProvider{}, nil)
+		testedTokenManager.start()
+		Expect(testedTokenManager.getBearerToken()).Should(Equal("ABCD"))
+		testedTokenManager.close()
+	}, 3)
+})
@@ -16,12 +16,13 @@ package apidApigeeSync
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"github.com/apid/apid-core/util"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -37,82 +38,183 @@ Usage:
    will automatically update config(configBearerToken) for other modules
 */
 
-func createApidTokenManager(isNewInstance bool) *apidTokenManager {
+func createApidTokenManager(isNewInstance bool, client *http.Client, credentials credentialProvider, store tokenStore) *apidTokenManager {
 	isClosedInt := int32(0)
+	refreshRequested := int32(0)
+	numRefreshes := int64(0)
+	numRefreshFailures := int64(0)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	t := &apidTokenManager{
 		quitPollingForToken: make(chan bool, 1),
 		closed:              make(chan bool),
-		getTokenChan:        make(chan bool),
-		invalidateTokenChan: make(chan bool),
-		returnTokenChan:     make(chan *OauthToken),
-		invalidateDone:      make(chan bool),
-		tokenUpdatedChan:    make(chan bool, 1),
+		maintainDone:        make(chan bool),
+		invalidateTokenChan: make(chan bool, 1),
+		tokenUpdated:        createTokenBroadcast(),
 		isClosed:            &isClosedInt,
+		refreshRequested:    &refreshRequested,
 		isNewInstance:       isNewInstance,
+		client:              client,
+		ctx:                 ctx,
+		cancel:              cancel,
+		credentials:         credentials,
+		store:               store,
+		numRefreshes:        &numRefreshes,
+		numRefreshFailures:  &numRefreshFailures,
+		status:              func() string { return statusOnline },
 	}
 	return t
 }
 
+/*
+ * The current token is swapped atomically, so reads never wait for a refresh.
+ * All refreshes run in the maintainToken() goroutine, one at a time.
+ */
 type apidTokenManager struct {
-	token               *OauthToken
+	// holds *OauthToken
+	token               atomic.Value
 	isClosed            *int32
 	quitPollingForToken chan bool
 	closed              chan bool
-	getTokenChan        chan bool
+	maintainDone        chan bool
 	invalidateTokenChan chan bool
-	refreshTimer        <-chan time.Time
-	returnTokenChan     chan *OauthToken
-	invalidateDone      chan bool
-	tokenUpdatedChan    chan bool
-	isNewInstance       bool
+	// 1 from invalidateToken() until the next token is set
+	refreshRequested *int32
+	refreshTimer     <-chan time.Time
+	tokenUpdated     *tokenBroadcast
+	isNewInstance    bool
+	client           *http.Client
+	// cancels requests in flight on close()
+	ctx         context.Context
+	cancel      context.CancelFunc
+	credentials credentialProvider
+	// nil if the token is not persisted
+	store tokenStore
+	// credentials used for the current token
+	lastCredentials  consumerCredentials
+	credentialsTimer <-chan time.Time
+	// diagnostics of the refresh token flow
+	numRefreshes       *int64
+	numRefreshFailures *int64
+	// status sent with token requests
+	status func() string
 }
 
 func (t *apidTokenManager) start() {
-	t.retrieveNewToken()
-	t.refreshTimer = time.After(t.token.refreshIn())
+	if !t.reuseSavedToken() {
+		t.retrieveNewToken()
+	}
+	t.refreshTimer = time.After(t.currentToken().refreshIn())
+	t.credentialsTimer = time.After(config.GetDuration(configCredentialsPollInterval))
 	go t.maintainToken()
 }
 
+/*
+ * Uses the token saved by the last run if it is still valid and was issued for the current
+ * consumer key. If it needs a refresh, the refresh timer fires right away and it is refreshed
+ * in the background.
+ */
+func (t *apidTokenManager) reuseSavedToken() bool {
+	if t.store == nil {
+		return false
+	}
+	saved, err := t.store.loadToken()
+	if err != nil {
+		log.Warnf("Unable to load saved token: %v", err)
+		return false
+	}
+	if saved == nil || !saved.Token.isValid() {
+		return false
+	}
+	creds, err := t.credentials.getCredentials()
+	if err != nil || creds.Key != saved.ClientId {
+		log.Debug("Saved token was issued for other credentials")
+		return false
+	}
+	log.Infof("Reusing saved token, expires at %v", saved.Token.ExpiresAt)
+	t.setToken(saved.Token, creds)
+	return true
+}
+
 func (t *apidTokenManager) getBearerToken() string {
-	return t.getToken().AccessToken
+	token := t.getToken()
+	if token == nil {
+		return ""
+	}
+	return token.AccessToken
 }
 
 func (t *apidTokenManager) maintainToken() {
+	defer close(t.maintainDone)
 	for {
 		select {
 		case <-t.closed:
 			return
 		case <-t.refreshTimer:
 			log.Debug("auto refresh token")
-			t.retrieveNewToken()
-			t.refreshTimer = time.After(t.token.refreshIn())
-		case <-t.getTokenChan:
-			token := t.token
-			t.returnTokenChan <- token
+			if !t.refreshToken() {
+				t.retrieveNewToken()
+			}
+			t.refreshTimer = time.After(t.currentToken().refreshIn())
 		case <-t.invalidateTokenChan:
 			t.retrieveNewToken()
-			t.refreshTimer = time.After(t.token.refreshIn())
-			t.invalidateDone <- true
+			t.refreshTimer = time.After(t.currentToken().refreshIn())
+		case <-t.credentialsTimer:
+			// same as invalidateToken(), if the credentials have been rotated
+			if t.credentialsChanged() {
+				log.Info("Consumer credentials changed, getting new token")
+				t.retrieveNewToken()
+				t.refreshTimer = time.After(t.currentToken().refreshIn())
+			}
+			t.credentialsTimer = time.After(config.GetDuration(configCredentialsPollInterval))
 		}
 	}
 }
 
-// will block until valid
+func (t *apidTokenManager) credentialsChanged() bool {
+	creds, err := t.credentials.getCredentials()
+	if err != nil {
+		// probably in the middle of a rotation, check again later
+		log.Warnf("Unable to get consumer credentials: %v", err)
+		return false
+	}
+	return creds != t.lastCredentials
+}
+
+/*
+ * Will block until a new token has been retrieved, or the token manager is closed.
+ * Concurrent callers share a single refresh.
+ */
 func (t *apidTokenManager) invalidateToken() {
 	log.Debug("invalidating token")
-	t.invalidateTokenChan <- true
-	<-t.invalidateDone
+	// get it before requesting the refresh, to not miss its notification
+	ready := t.getTokenReadyChannel()
+	// otherwise wait for the refresh requested by another caller
+	if atomic.CompareAndSwapInt32(t.refreshRequested, 0, 1) {
+		select {
+		case t.invalidateTokenChan <- true:
+		default:
+		}
+	}
+	select {
+	case <-ready:
+	case <-t.closed:
+	}
 }
 
+// never blocks, returns nil before start() and after close()
 func (t *apidTokenManager) getToken() *OauthToken {
 	//has been closed
 	if atomic.LoadInt32(t.isClosed) == int32(1) {
 		log.Debug("TokenManager: getToken() called on closed tokenManager")
 		return nil
 	}
-	t.getTokenChan <- true
-	return <-t.returnTokenChan
+	return t.currentToken()
+}
+
+func (t *apidTokenManager) currentToken() *OauthToken {
+	token, _ := t.token.Load().(*OauthToken)
+	return token
 }
 
 /*
@@ -127,9 +229,9 @@ func (t *apidTokenManager) close() {
 	}
 	log.Debug("close token manager")
 	t.quitPollingForToken <- true
-	// sending instead of closing, to make sure it enters the t.doRefresh branch
-	t.closed <- true
+	t.cancel()
 	close(t.closed)
+	<-t.maintainDone
 	log.Debug("token manager closed")
 }
 
@@ -137,91 +239,237 @@ func (t *apidTokenManager) close() {
 func (t *apidTokenManager) retrieveNewToken() {
 
 	log.Debug("Getting OAuth token...")
+	pollWithBackoff(t.quitPollingForToken, t.getRetrieveNewTokenClosure(getTokenUri()), func(err error) { log.Errorf("Error getting new token : %v", err) })
+}
+
+func getTokenUri() *url.URL {
 	uriString := config.GetString(configProxyServerBaseURI)
 	uri, err := url.Parse(uriString)
 	if err != nil {
 		log.Panicf("unable to parse uri config '%s' value: '%s': %v", configProxyServerBaseURI, uriString, err)
 	}
 	uri.Path = path.Join(uri.Path, "/accesstoken")
+	return uri
+}
 
-	pollWithBackoff(t.quitPollingForToken, t.getRetrieveNewTokenClosure(uri), func(err error) { log.Errorf("Error getting new token : %v", err) })
+/*
+ * Single attempt to renew the token with grant_type=refresh_token.
+ * Returns false if there is no usable refresh token or the server rejected it,
+ * the caller should then fall back to retrieveNewToken().
+ */
+func (t *apidTokenManager) refreshToken() bool {
+	current := t.currentToken()
+	if !current.canRefresh() {
+		return false
+	}
+	log.Debug("Refreshing OAuth token...")
+	creds := t.lastCredentials
+	form := url.Values{}
+	form.Set("grant_type", grantTypeRefreshToken)
+	form.Add("refresh_token", current.RefreshToken)
+	form.Add("client_id", creds.Key)
+	if config.GetString(configTokenGrantType) == grantTypeClientCredentials {
+		form.Add("client_secret", creds.Secret)
+	}
+	token, err := t.requestToken(getTokenUri(), form)
+	if err != nil {
+		atomic.AddInt64(t.numRefreshFailures, 1)
+		log.Warnf("Unable to refresh token, getting a new one: %v", err)
+		return false
+	}
+	// the server may keep the refresh token unchanged
+	if token.RefreshToken == "" {
+		token.RefreshToken = current.RefreshToken
+		token.RefreshExpiresAt = current.RefreshExpiresAt
+	}
+	if token.RefreshCount == 0 {
+		token.RefreshCount = current.RefreshCount + 1
+	}
+	atomic.AddInt64(t.numRefreshes, 1)
+	t.setToken(token, creds)
+	log.Debugf("Token refreshed. Refreshes: %d, failed refreshes: %d", t.getNumRefreshes(), t.getNumRefreshFailures())
+	return true
 }
 
 func (t *apidTokenManager) getRetrieveNewTokenClosure(uri *url.URL) func(chan bool) error {
 	return func(_ chan bool) error {
-		form := url.Values{}
-		form.Set("grant_type", "client_credentials")
-		form.Add("client_id", config.GetString(configConsumerKey))
-		form.Add("client_secret", config.GetString(configConsumerSecret))
-		req, err := http.NewRequest("POST", uri.String(), bytes.NewBufferString(form.Encode()))
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
-		req.Header.Set("display_name", apidInfo.InstanceName)
-		req.Header.Set("apid_instance_id", apidInfo.InstanceID)
-		req.Header.Set("apid_cluster_Id", apidInfo.ClusterID)
-		req.Header.Set("status", "ONLINE")
-		req.Header.Set("plugin_details", apidPluginDetails)
-
-		if t.isNewInstance {
-			req.Header.Set("created_at_apid", time.Now().Format(time.RFC3339))
-			t.isNewInstance = false
-		} else {
-			req.Header.Set("updated_at_apid", time.Now().Format(time.RFC3339))
+		// the quit signal may have been taken by an earlier poll
+		if t.ctx.Err() != nil {
+			return quitSignalError
 		}
-
-		client := &http.Client{
-			Transport: util.Transport(config.GetString(util.ConfigfwdProxyPortURL)),
-			Timeout:   httpTimeout,
+		creds, err := t.credentials.getCredentials()
+		if err != nil {
+			log.Errorf("Unable to get consumer credentials: %v", err)
+			return err
 		}
-		resp, err := client.Do(req)
+		form, err := getTokenForm(creds, uri)
 		if err != nil {
-			log.Errorf("Unable to Connect to Edge Proxy Server: %v", err)
+			log.Errorf("Unable to create token request: %v", err)
 			return err
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+		token, err := t.requestToken(uri, form)
 		if err != nil {
-			log.Errorf("Unable to read EdgeProxy Sever response: %v", err)
+			if t.ctx.Err() != nil {
+				return quitSignalError
+			}
 			return err
 		}
+		t.setToken(token, creds)
+		return nil
+	}
+}
 
-		if resp.StatusCode != 200 {
-			log.Errorf("Oauth Request Failed with Resp Code: %d. Body: %s", resp.StatusCode, string(body))
-			return expected200Error
+func (t *apidTokenManager) requestToken(uri *url.URL, form url.Values) (*OauthToken, error) {
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(t.ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	req.Header.Set("display_name", apidInfo.InstanceName)
+	req.Header.Set("apid_instance_id", apidInfo.InstanceID)
+	req.Header.Set("apid_cluster_Id", apidInfo.ClusterID)
+	req.Header.Set("status", t.status())
+	req.Header.Set("plugin_details", apidPluginDetails)
+
+	if t.isNewInstance {
+		req.Header.Set("created_at_apid", time.Now().Format(time.RFC3339))
+		t.isNewInstance = false
+	} else {
+		req.Header.Set("updated_at_apid", time.Now().Format(time.RFC3339))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Errorf("Unable to Connect to Edge Proxy Server: %v", err)
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Errorf("Unable to read EdgeProxy Sever response: %v", err)
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		log.Errorf("Oauth Request Failed with Resp Code: %d. Body: %s", resp.StatusCode, string(body))
+		return nil, expected200Error
+	}
+
+	var token OauthToken
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		log.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
+		return nil, err
+	}
+
+	if token.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	} else {
+		// no expiration, arbitrarily expire about a year from now
+		token.ExpiresAt = time.Now().Add(365 * 24 * time.Hour)
+	}
+	if token.RefreshToken != "" && token.RefreshExpIn > 0 {
+		token.RefreshExpiresAt = time.Now().Add(time.Duration(token.RefreshExpIn) * time.Second)
+	}
+	return &token, nil
+}
+
+func (t *apidTokenManager) setToken(token *OauthToken, creds consumerCredentials) {
+	log.Debugf("Got new token: %#v", token)
+	t.token.Store(token)
+	t.lastCredentials = creds
+	config.Set(configBearerToken, token.AccessToken)
+	if t.store != nil {
+		if err := t.store.saveToken(&savedToken{Token: token, ClientId: creds.Key}); err != nil {
+			log.Errorf("Unable to save token: %v", err)
 		}
+	}
+
+	// wake up every client waiting for a new token
+	atomic.StoreInt32(t.refreshRequested, 0)
+	t.tokenUpdated.notify()
+}
+
+// number of tokens renewed with a refresh token
+func (t *apidTokenManager) getNumRefreshes() int64 {
+	return atomic.LoadInt64(t.numRefreshes)
+}
+
+// number of rejected refresh tokens, each followed by a full authentication
+func (t *apidTokenManager) getNumRefreshFailures() int64 {
+	return atomic.LoadInt64(t.numRefreshFailures)
+}
 
-		var token OauthToken
-		err = json.Unmarshal(body, &token)
+/*
+ * With the jwt_bearer grant type, the consumer key is sent in an assertion signed with the
+ * configured private key, and the consumer secret is not used.
+ */
+func getTokenForm(creds consumerCredentials, uri *url.URL) (url.Values, error) {
+	form := url.Values{}
+	if config.GetString(configTokenGrantType) == grantTypeJwtBearer {
+		signer, err := loadJwtSigner(config.GetString(configJwtKeyFile), config.GetString(configJwtKeyId))
 		if err != nil {
-			log.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
-			return err
+			return nil, err
 		}
-
-		if token.ExpiresIn > 0 {
-			token.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
-		} else {
-			// no expiration, arbitrarily expire about a year from now
-			token.ExpiresAt = time.Now().Add(365 * 24 * time.Hour)
+		assertion, err := signer.createAssertion(creds.Key, uri.String(), config.GetDuration(configJwtLifetime))
+		if err != nil {
+			return nil, err
 		}
+		form.Set("grant_type", jwtBearerGrantUrn)
+		form.Add("assertion", assertion)
+		form.Add("client_id", creds.Key)
+		return form, nil
+	}
+	form.Set("grant_type", grantTypeClientCredentials)
+	form.Add("client_id", creds.Key)
+	form.Add("client_secret", creds.Secret)
+	return form, nil
+}
 
-		log.Debugf("Got new token: %#v", token)
-		t.token = &token
-		config.Set(configBearerToken, token.AccessToken)
+// The returned channel is closed the next time a new token is retrieved.
+// Get it before reading the current token to avoid missing a refresh in between.
+func (t *apidTokenManager) getTokenReadyChannel() <-chan bool {
+	return t.tokenUpdated.ready()
+}
 
-		//don't block on the buffered channel.  that means there is already a signal to serve new token
-		//TODO: This assumes apid-gateway is 1-1 mapping. Make use of generic long-polling provided by apid-core
-		select {
-		case t.tokenUpdatedChan <- true:
-		default:
-			log.Debug("Token refresh notification already sent")
-		}
+/*
+ * Fan-out notification of token refreshes. All channels handed out by ready()
+ * since the last notify() are closed by the next notify(), so every waiter is
+ * released at once. generation counts the refreshes so far.
+ */
+type tokenBroadcast struct {
+	mux        sync.Mutex
+	generation int64
+	readyChan  chan bool
+}
 
-		return nil
+func createTokenBroadcast() *tokenBroadcast {
+	return &tokenBroadcast{
+		readyChan: make(chan bool),
 	}
 }
 
-func (t *apidTokenManager) getTokenReadyChannel() <-chan bool {
-	return t.tokenUpdatedChan
+func (b *tokenBroadcast) ready() <-chan bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.readyChan
+}
+
+func (b *tokenBroadcast) notify() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	close(b.readyChan)
+	b.readyChan = make(chan bool)
+	b.generation++
+	log.Debugf("Token generation %d ready", b.generation)
+}
+
+func (b *tokenBroadcast) getGeneration() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.generation
 }
 
 type OauthToken struct {
@@ -238,7 +486,10 @@ type OauthToken struct {
 	AccessToken    string `json:"accessToken"`
 	RefreshExpIn   int64  `json:"refreshTokenExpiresIn"`
 	RefreshCount   int64  `json:"refreshCount"`
+	RefreshToken   string `json:"refreshToken"`
 	ExpiresAt      time.Time
+	// zero if the server didn't tell
+	RefreshExpiresAt time.Time
 }
 
 var noTime time.Time
@@ -257,6 +508,13 @@ func (t *OauthToken) refreshIn() time.Duration {
 	return t.ExpiresAt.Sub(time.Now()) - refreshFloatTime
 }
 
+func (t *OauthToken) canRefresh() bool {
+	if t == nil || t.RefreshToken == "" {
+		return false
+	}
+	return t.RefreshExpiresAt == noTime || time.Now().Before(t.RefreshExpiresAt)
+}
+
 func (t *OauthToken) needsRefresh() bool {
 	if t == nil || t.ExpiresAt == noTime {
 		return true
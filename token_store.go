@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultTokenStoreKeyFile = "apigeesync_token.key"
+)
+
+/*
+ * Keeps the current token across restarts.
+ * loadToken() returns nil if no token has been saved.
+ */
+type tokenStore interface {
+	loadToken() (*savedToken, error)
+	saveToken(token *savedToken) error
+}
+
+type savedToken struct {
+	Token *OauthToken `json:"token"`
+	// consumer key the token was issued for
+	ClientId string `json:"clientId"`
+}
+
+/*
+ * Stores the token in the APID_TOKEN table of the default DB, encrypted with encryptWithKey().
+ * Without a configured key file, a key is generated in the local storage path on first use.
+ */
+type dbTokenStore struct {
+	dbMan      *dbManager
+	instanceId string
+	key        []byte
+}
+
+func createDbTokenStore(dbMan *dbManager, instanceId string) (*dbTokenStore, error) {
+	keyFile := config.GetString(configTokenStoreKeyFile)
+	if keyFile == "" {
+		keyFile = filepath.Join(config.GetString(configLocalStoragePath), defaultTokenStoreKeyFile)
+		if err := createEncryptionKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	key, err := readEncryptionKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTokenStore{
+		dbMan:      dbMan,
+		instanceId: instanceId,
+		key:        key,
+	}, nil
+}
+
+// does nothing if the file exists
+func createEncryptionKeyFile(keyFile string) error {
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	log.Infof("Created token encryption key %s", keyFile)
+	_, err = f.WriteString(base64.StdEncoding.EncodeToString(key))
+	return err
+}
+
+func (s *dbTokenStore) loadToken() (*savedToken, error) {
+	encrypted, err := s.dbMan.getSavedToken(s.instanceId)
+	if err != nil || encrypted == "" {
+		return nil, err
+	}
+	plain, err := decryptWithKey(s.key, []byte(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedToken{}
+	if err = json.Unmarshal(plain, saved); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (s *dbTokenStore) saveToken(token *savedToken) error {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptWithKey(s.key, plain)
+	if err != nil {
+		return err
+	}
+	return s.dbMan.saveToken(s.instanceId, string(encrypted))
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidApigeeSync
+
+import (
+	"encoding/json"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("token store", func() {
+	var testDir string
+	var testDbMan *dbManager
+	var store *dbTokenStore
+
+	BeforeEach(func() {
+		var err error
+		testDir, err = ioutil.TempDir(tmpDir, "token_store_test")
+		Expect(err).Should(Succeed())
+		config.Set(configLocalStoragePath, testDir)
+		testDbMan = creatDbManager()
+		Expect(testDbMan.initDB()).Should(Succeed())
+		store, err = createDbTokenStore(testDbMan, apidInfo.InstanceID)
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(configLocalStoragePath, tmpDir)
+		config.Set(configTokenStoreKeyFile, "")
+		config.Set(configProxyServerBaseURI, dummyConfigValue)
+		Expect(os.RemoveAll(testDir)).Should(Succeed())
+	})
+
+	createToken := func(expiresIn time.Duration) *OauthToken {
+		return &OauthToken{
+			AccessToken: util.GenerateUUID(),
+			ExpiresIn:   int64(expiresIn.Seconds()),
+			ExpiresAt:   time.Now().Add(expiresIn),
+		}
+	}
+
+	It("should save and load encrypted tokens", func() {
+		Expect(store.loadToken()).Should(BeNil())
+
+		token := createToken(time.Hour)
+		Expect(store.saveToken(&savedToken{Token: token, ClientId: "key"})).Should(Succeed())
+		saved, err := store.loadToken()
+		Expect(err).Should(Succeed())
+		Expect(saved.ClientId).Should(Equal("key"))
+		Expect(saved.Token.AccessToken).Should(Equal(token.AccessToken))
+		Expect(saved.Token.ExpiresAt.Equal(token.ExpiresAt)).Should(BeTrue())
+
+		encrypted, err := testDbMan.getSavedToken(apidInfo.InstanceID)
+		Expect(err).Should(Succeed())
+		Expect(encrypted).ShouldNot(ContainSubstring(token.AccessToken))
+
+		// other instances don't see it
+		otherStore, err := createDbTokenStore(testDbMan, "other-instance")
+		Expect(err).Should(Succeed())
+		Expect(otherStore.loadToken()).Should(BeNil())
+	})
+
+	It("should keep the generated key", func() {
+		keyFile := filepath.Join(testDir, defaultTokenStoreKeyFile)
+		info, err := os.Stat(keyFile)
+		Expect(err).Should(Succeed())
+		Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+
+		Expect(store.saveToken(&savedToken{Token: createToken(time.Hour)})).Should(Succeed())
+		restarted, err := createDbTokenStore(testDbMan, apidInfo.InstanceID)
+		Expect(err).Should(Succeed())
+		Expect(restarted.key).Should(Equal(store.key))
+		Expect(restarted.loadToken()).ShouldNot(BeNil())
+	})
+
+	It("should fail to load with another key", func() {
+		Expect(store.saveToken(&savedToken{Token: createToken(time.Hour)})).Should(Succeed())
+		keyFile := filepath.Join(testDir, "other.key")
+		Expect(createEncryptionKeyFile(keyFile)).Should(Succeed())
+		config.Set(configTokenStoreKeyFile, keyFile)
+		otherStore, err := createDbTokenStore(testDbMan, apidInfo.InstanceID)
+		Expect(err).Should(Succeed())
+		_, err = otherStore.loadToken()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	Context("token manager", func() {
+		var numRequests int32
+		var ts *httptest.Server
+		// if set, requests wait until it is closed
+		var release chan bool
+
+		BeforeEach(func() {
+			numRequests = 0
+			release = nil
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				atomic.AddInt32(&numRequests, 1)
+				if release != nil {
+					<-release
+				}
+				body, err := json.Marshal(OauthToken{
+					AccessToken: "new-token",
+					ExpiresIn:   200,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				w.Write(body)
+			}))
+			config.Set(configProxyServerBaseURI, ts.URL)
+		})
+
+		AfterEach(func() {
+			ts.Close()
+		})
+
+		startTokenManager := func() *apidTokenManager {
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, store)
+			testedTokenManager.start()
+			return testedTokenManager
+		}
+
+		It("should reuse a valid saved token", func() {
+			token := createToken(time.Hour)
+			Expect(store.saveToken(&savedToken{Token: token, ClientId: config.GetString(configConsumerKey)})).Should(Succeed())
+			testedTokenManager := startTokenManager()
+			defer testedTokenManager.close()
+			Expect(testedTokenManager.getBearerToken()).Should(Equal(token.AccessToken))
+			Expect(config.GetString(configBearerToken)).Should(Equal(token.AccessToken))
+			Consistently(func() int32 { return atomic.LoadInt32(&numRequests) }, 200*time.Millisecond).Should(BeZero())
+		}, 3)
+
+		It("should get a new token if the saved one is expired", func() {
+			Expect(store.saveToken(&savedToken{Token: createToken(-time.Second), ClientId: config.GetString(configConsumerKey)})).Should(Succeed())
+			testedTokenManager := startTokenManager()
+			defer testedTokenManager.close()
+			Expect(testedTokenManager.getBearerToken()).Should(Equal("new-token"))
+			Expect(atomic.LoadInt32(&numRequests)).Should(BeEquivalentTo(1))
+
+			saved, err := store.loadToken()
+			Expect(err).Should(Succeed())
+			Expect(saved.Token.AccessToken).Should(Equal("new-token"))
+		}, 3)
+
+		It("should get a new token if the consumer key changed", func() {
+			Expect(store.saveToken(&savedToken{Token: createToken(time.Hour), ClientId: "old-key"})).Should(Succeed())
+			testedTokenManager := startTokenManager()
+			defer testedTokenManager.close()
+			Expect(testedTokenManager.getBearerToken()).Should(Equal("new-token"))
+		}, 3)
+
+		It("should refresh a saved token in the background", func() {
+			// still valid, but due for a refresh
+			token := createToken(30 * time.Second)
+			Expect(store.saveToken(&savedToken{Token: token, ClientId: config.GetString(configConsumerKey)})).Should(Succeed())
+			release = make(chan bool)
+			testedTokenManager := startTokenManager()
+			defer testedTokenManager.close()
+			Expect(config.GetString(configBearerToken)).Should(Equal(token.AccessToken))
+			Eventually(func() int32 { return atomic.LoadInt32(&numRequests) }).Should(BeEquivalentTo(1))
+
+			close(release)
+			Eventually(testedTokenManager.getBearerToken).Should(Equal("new-token"))
+		}, 3)
+	})
+})
@@ -18,6 +18,7 @@ package apidApigeeSync
  * Unit test of token manager
  */
 import (
+	"sync"
 	"time"
 
 	"net/http"
@@ -76,6 +77,19 @@ var _ = Describe("token", func() {
 			Expect(t.refreshIn().Seconds()).To(BeNumerically("<=", 0))
 			Expect(t.needsRefresh()).To(BeTrue())
 			Expect(t.isValid()).To(BeFalse())
+			Expect(t.canRefresh()).To(BeFalse())
+		}, 3)
+
+		It("should calculate usable refresh token", func() {
+
+			t := &OauthToken{
+				RefreshToken: "r",
+			}
+			Expect(t.canRefresh()).To(BeTrue())
+			t.RefreshExpiresAt = time.Now().Add(time.Minute)
+			Expect(t.canRefresh()).To(BeTrue())
+			t.RefreshExpiresAt = time.Now().Add(-time.Second)
+			Expect(t.canRefresh()).To(BeFalse())
 		}, 3)
 	})
 
@@ -94,7 +108,7 @@ var _ = Describe("token", func() {
 				w.Write(body)
 			}))
 			config.Set(configProxyServerBaseURI, ts.URL)
-			testedTokenManager := createApidTokenManager(false)
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
 			testedTokenManager.start()
 			token := testedTokenManager.getToken()
 
@@ -123,7 +137,7 @@ var _ = Describe("token", func() {
 			}))
 			config.Set(configProxyServerBaseURI, ts.URL)
 
-			testedTokenManager := createApidTokenManager(false)
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
 			testedTokenManager.start()
 			token := testedTokenManager.getToken()
 			Expect(token.AccessToken).ToNot(BeEmpty())
@@ -137,6 +151,200 @@ var _ = Describe("token", func() {
 			ts.Close()
 		}, 3)
 
+		It("should notify all waiters when refreshed", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				res := OauthToken{
+					AccessToken: util.GenerateUUID(),
+					ExpiresIn:   200,
+				}
+				body, err := json.Marshal(res)
+				Expect(err).NotTo(HaveOccurred())
+				w.Write(body)
+			}))
+			config.Set(configProxyServerBaseURI, ts.URL)
+
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
+			testedTokenManager.start()
+			generation := testedTokenManager.tokenUpdated.getGeneration()
+
+			var waiters []<-chan bool
+			for i := 0; i < 5; i++ {
+				waiters = append(waiters, testedTokenManager.getTokenReadyChannel())
+			}
+			for _, w := range waiters {
+				Consistently(w, 100*time.Millisecond).ShouldNot(BeClosed())
+			}
+
+			testedTokenManager.invalidateToken()
+
+			for _, w := range waiters {
+				Eventually(w).Should(BeClosed())
+			}
+			Expect(testedTokenManager.tokenUpdated.getGeneration()).Should(Equal(generation + 1))
+			// channels handed out after the refresh wait for the next one
+			Expect(testedTokenManager.getTokenReadyChannel()).ShouldNot(BeClosed())
+			testedTokenManager.close()
+			ts.Close()
+		}, 3)
+
+		It("should not block reads while refreshing", func() {
+			var mux sync.Mutex
+			numRequests := 0
+			release := make(chan bool)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				mux.Lock()
+				numRequests++
+				first := numRequests == 1
+				mux.Unlock()
+				if !first {
+					<-release
+				}
+				body, err := json.Marshal(OauthToken{
+					AccessToken: util.GenerateUUID(),
+					ExpiresIn:   200,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				w.Write(body)
+			}))
+			config.Set(configProxyServerBaseURI, ts.URL)
+
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
+			testedTokenManager.start()
+			bearer := testedTokenManager.getBearerToken()
+			Expect(bearer).ShouldNot(BeEmpty())
+
+			// concurrent invalidations share a single refresh
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					testedTokenManager.invalidateToken()
+				}()
+			}
+			Eventually(func() int {
+				mux.Lock()
+				defer mux.Unlock()
+				return numRequests
+			}).Should(Equal(2))
+
+			// the refresh is blocked, reads still return the current token
+			done := make(chan bool)
+			go func() {
+				defer GinkgoRecover()
+				for i := 0; i < 100; i++ {
+					Expect(testedTokenManager.getBearerToken()).Should(Equal(bearer))
+				}
+				close(done)
+			}()
+			Eventually(done, 500*time.Millisecond).Should(BeClosed())
+
+			close(release)
+			wg.Wait()
+			Expect(testedTokenManager.getBearerToken()).ShouldNot(Equal(bearer))
+			mux.Lock()
+			Expect(numRequests).Should(Equal(2))
+			mux.Unlock()
+			testedTokenManager.close()
+			ts.Close()
+		}, 3)
+
+		Context("refresh token", func() {
+			var mux sync.Mutex
+			var grantTypes []string
+			var refreshAccepted bool
+			var ts *httptest.Server
+
+			BeforeEach(func() {
+				grantTypes = nil
+				refreshAccepted = true
+				// refresh 100ms after each token
+				refreshFloatTime = 900 * time.Millisecond
+				ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					defer GinkgoRecover()
+					Expect(r.ParseForm()).Should(Succeed())
+					mux.Lock()
+					defer mux.Unlock()
+					grantType := r.PostFormValue("grant_type")
+					grantTypes = append(grantTypes, grantType)
+					res := OauthToken{
+						AccessToken:  util.GenerateUUID(),
+						ExpiresIn:    1,
+						RefreshToken: "refresh-1",
+						RefreshExpIn: 60,
+					}
+					if grantType == grantTypeRefreshToken {
+						Expect(r.PostFormValue("refresh_token")).To(Equal("refresh-1"))
+						Expect(r.PostFormValue("client_id")).To(Equal(config.GetString(configConsumerKey)))
+						if !refreshAccepted {
+							w.WriteHeader(http.StatusUnauthorized)
+							return
+						}
+						// keep the refresh token
+						res.RefreshToken = ""
+						res.RefreshExpIn = 0
+					}
+					body, err := json.Marshal(res)
+					Expect(err).NotTo(HaveOccurred())
+					w.Write(body)
+				}))
+				config.Set(configProxyServerBaseURI, ts.URL)
+			})
+
+			AfterEach(func() {
+				refreshFloatTime = time.Minute
+				ts.Close()
+			})
+
+			getGrantTypes := func() []string {
+				mux.Lock()
+				defer mux.Unlock()
+				return append([]string{}, grantTypes...)
+			}
+
+			It("should renew the token with the refresh token", func() {
+				testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
+				testedTokenManager.start()
+
+				Eventually(testedTokenManager.getNumRefreshes).Should(BeNumerically(">=", 2))
+				token := testedTokenManager.getToken()
+				Expect(token.RefreshToken).To(Equal("refresh-1"))
+				Expect(token.RefreshCount).To(BeNumerically(">=", 2))
+				Expect(testedTokenManager.getNumRefreshFailures()).To(BeZero())
+				testedTokenManager.close()
+
+				grants := getGrantTypes()
+				Expect(grants[0]).To(Equal(grantTypeClientCredentials))
+				for _, grantType := range grants[1:] {
+					Expect(grantType).To(Equal(grantTypeRefreshToken))
+				}
+			}, 3)
+
+			It("should fall back to client credentials if refresh fails", func() {
+				mux.Lock()
+				refreshAccepted = false
+				mux.Unlock()
+				testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
+				testedTokenManager.start()
+
+				Eventually(testedTokenManager.getNumRefreshFailures).Should(BeNumerically(">=", 3))
+				Expect(testedTokenManager.getNumRefreshes()).To(BeZero())
+				testedTokenManager.close()
+
+				grants := getGrantTypes()
+				Expect(grants[:5]).To(Equal([]string{
+					grantTypeClientCredentials,
+					grantTypeRefreshToken,
+					grantTypeClientCredentials,
+					grantTypeRefreshToken,
+					grantTypeClientCredentials,
+				}))
+			}, 3)
+		})
+
 		It("should refresh in refresh interval", func(done Done) {
 
 			finished := make(chan bool, 1)
@@ -163,7 +371,7 @@ var _ = Describe("token", func() {
 			}))
 
 			config.Set(configProxyServerBaseURI, ts.URL)
-			testedTokenManager := createApidTokenManager(false)
+			testedTokenManager := createApidTokenManager(false, &http.Client{}, &configCredentialProvider{}, nil)
 			testedTokenManager.start()
 			testedTokenManager.getToken()
 
@@ -200,7 +408,7 @@ var _ = Describe("token", func() {
 			}))
 
 			config.Set(configProxyServerBaseURI, ts.URL)
-			testedTokenManager := createApidTokenManager(true)
+			testedTokenManager := createApidTokenManager(true, &http.Client{}, &configCredentialProvider{}, nil)
 			testedTokenManager.start()
 			testedTokenManager.getToken()
 			testedTokenManager.invalidateToken()
@@ -19,6 +19,7 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -39,6 +40,8 @@ var (
 	expected200Error = fmt.Errorf("did not receive OK response")
 	quitSignalError  = fmt.Errorf("signal to quit encountered")
 	authFailError    = fmt.Errorf("authorization failed")
+	// the snapshot server doesn't offer snapshots of single tables or data scopes
+	partialSnapshotUnavailableError = fmt.Errorf("partial snapshot not available")
 )
 
 type Backoff struct {
@@ -156,6 +159,28 @@ func pollWithBackoff(quit chan bool, toExecute func(chan bool) error, handleErro
 	}
 }
 
+// list values may be configured as a list or as a comma-separated string
+func getConfigList(key string) []string {
+	var values []string
+	switch v := config.Get(key).(type) {
+	case []string:
+		values = v
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+	case string:
+		values = strings.Split(v, ",")
+	}
+	var result []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
 func addHeaders(req *http.Request, token string) {
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("apid_instance_id", apidInfo.InstanceID)